@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type alert struct {
+	ShopifyDomain string    `json:"shopify_domain"`
+	Kind          string    `json:"kind"`
+	Message       string    `json:"message"`
+	Details       []string  `json:"details,omitempty"`
+	RaisedAt      time.Time `json:"raised_at"`
+}
+
+// raiseAlert logs the alert and, when ALERT_WEBHOOK_URL is configured, posts it to the webhook
+// so that operators are notified without having to watch the logs
+func raiseAlert(config Config, storename, kind, message string, details []string) {
+	log.WithFields(log.Fields{
+		"File":    "alert_ops",
+		"Caller":  "RaiseAlert",
+		"Shop":    storename,
+		"Kind":    kind,
+		"Details": details,
+	}).Error(message)
+	if config.ALERT_WEBHOOK_URL == "" {
+		return
+	}
+	payload, err := json.Marshal(alert{
+		ShopifyDomain: storename,
+		Kind:          kind,
+		Message:       message,
+		Details:       details,
+		RaisedAt:      time.Now(),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "alert_ops",
+			"Caller": "RaiseAlert",
+		}).Errorf("Unable to marshal alert %v", err)
+		return
+	}
+	// the webhook url is a credential, so alerts are sent with a client of their own rather than through
+	// the store api transport, which a cassette may be recording
+	httpclient := &http.Client{Timeout: 10 * time.Second}
+	res, err := httpclient.Post(config.ALERT_WEBHOOK_URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "alert_ops",
+			"Caller": "RaiseAlert",
+		}).Errorf("Unable to send alert to webhook %v", err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.WithFields(log.Fields{
+			"File":   "alert_ops",
+			"Caller": "RaiseAlert",
+		}).Errorf("Alert webhook returned status %d", res.StatusCode)
+	}
+}
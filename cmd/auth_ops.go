@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const etsyAuthorizeURL = "https://www.etsy.com/oauth/connect"
+
+// the scopes the sync needs: reading the shop, and reading and writing listing inventory
+const etsyDefaultScopes = "shops_r listings_r listings_w"
+
+func authCommand(args []string, config Config, client *mongo.Client) error {
+	if len(args) == 0 || args[0] != "etsy" {
+		return fmt.Errorf("usage: %s", commands["auth"].Usage)
+	}
+	fs := flag.NewFlagSet("auth etsy", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shopify domain to store the etsy token against")
+	redirect := fs.String("redirect", "http://localhost:3003/etsy/callback", "the loopback redirect uri registered for the etsy app")
+	scopes := fs.String("scopes", etsyDefaultScopes, "space separated etsy scopes to request")
+	timeout := fs.Duration("timeout", 5*time.Minute, "how long to wait for the authorisation to complete")
+	fs.Parse(args[1:])
+	if *shop == "" {
+		return fmt.Errorf("a shop is required to store the etsy token against")
+	}
+	return authoriseEtsy(*shop, *redirect, *scopes, *timeout, config, client)
+}
+
+// randomURLString returns n random bytes encoded as unpadded base64url, which is valid for both the PKCE
+// verifier and the state parameter
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge returns the S256 code challenge for the verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func etsyAuthoriseURL(clientid, redirecturi, scopes, state, challenge string) string {
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", clientid)
+	q.Set("redirect_uri", redirecturi)
+	q.Set("scope", scopes)
+	q.Set("state", state)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+	return etsyAuthorizeURL + "?" + q.Encode()
+}
+
+// writeEtsyAuthRequest stores the state and PKCE verifier of an authorisation in progress on the shop record
+func writeEtsyAuthRequest(storename, state, verifier string, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	update := bson.M{"$set": bson.M{
+		"etsy_state_secret":  state,
+		"etsy_code_verifier": verifier,
+	}}
+	_, err := shopCollection.UpdateOne(ctx, bson.M{"shopify_domain": storename}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// authoriseEtsy runs the etsy OAuth authorisation code flow with PKCE for the shop: it prints the url for the
+// merchant to open, waits for etsy to redirect back to a listener on the loopback redirect uri, and exchanges
+// the code for a token which is stored on the shop record.
+func authoriseEtsy(storename, redirecturi, scopes string, timeout time.Duration, config Config, client *mongo.Client) error {
+	redirect, err := url.Parse(redirecturi)
+	if err != nil {
+		return fmt.Errorf("invalid redirect uri %s: %v", redirecturi, err)
+	}
+	if ip := net.ParseIP(redirect.Hostname()); redirect.Hostname() != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("redirect uri %s is not a loopback address", redirecturi)
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		return err
+	}
+	state, err := randomURLString(16)
+	if err != nil {
+		return err
+	}
+	if err := writeEtsyAuthRequest(storename, state, verifier, client); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", redirect.Host)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", redirect.Host, err)
+	}
+	result := make(chan error, 1)
+	// a redirect uri without a path, eg. http://localhost:3003, is redirected to the root
+	path := redirect.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, etsyCallbackHandler(state, func(query url.Values) error {
+		return completeEtsyAuth(storename, redirecturi, query, config, client)
+	}, result))
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fmt.Printf("Open this url to authorise etsync for %s:\n\n%s\n\nWaiting for etsy to redirect to %s\n",
+		storename, etsyAuthoriseURL(config.ETSY_CLIENT_ID, redirecturi, scopes, state, pkceChallenge(verifier)), redirecturi)
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v waiting for the etsy authorisation", timeout)
+	}
+}
+
+// etsyCallbackHandler answers the requests made to the redirect uri. Only the redirect from etsy for this
+// authorisation, which carries its state, is completed and ends the flow; any other request, such as the
+// browser asking for /favicon.ico or a reload of the page of an earlier attempt, is turned away and the
+// listener keeps waiting until that redirect arrives or the timeout runs out.
+func etsyCallbackHandler(state string, complete func(url.Values) error, result chan<- error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+			log.WithFields(log.Fields{
+				"File":   "auth_ops",
+				"Caller": "EtsyCallbackHandler",
+			}).Debugf("Ignoring request to %s without the state of this authorisation", r.URL.Path)
+			http.Error(w, "Not the etsy authorisation callback, still waiting for etsy to redirect here.", http.StatusBadRequest)
+			return
+		}
+		err := complete(query)
+		if err != nil {
+			http.Error(w, "Etsy authorisation failed: "+err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "Etsy authorisation complete, you can close this window.")
+		}
+		select {
+		case result <- err:
+		default:
+		}
+	}
+}
+
+// completeEtsyAuth handles the redirect from etsy, checking the state matches the one stored for the shop
+// before exchanging the code
+func completeEtsyAuth(storename, redirecturi string, query url.Values, config Config, client *mongo.Client) error {
+	if e := query.Get("error"); e != "" {
+		return fmt.Errorf("etsy returned %s: %s", e, query.Get("error_description"))
+	}
+	token, err := readEtsyToken(storename, client)
+	if err != nil {
+		return err
+	}
+	state := query.Get("state")
+	if token.EtsyStateSecret == "" || subtle.ConstantTimeCompare([]byte(state), []byte(token.EtsyStateSecret)) != 1 {
+		log.WithFields(log.Fields{
+			"File":   "auth_ops",
+			"Caller": "CompleteEtsyAuth",
+		}).Warn("State returned by etsy does not match the state stored for the shop")
+		return errors.New("state does not match")
+	}
+	code := query.Get("code")
+	if code == "" {
+		return errors.New("no authorisation code returned")
+	}
+	token.EtsyOnBoarded = false
+	token.EtsyCodeReference = code
+	rtoken, err := getEtsyTokenFromAPI(config.ETSY_CLIENT_ID, redirecturi, token)
+	if err != nil {
+		return err
+	}
+	rtoken.EtsyOnBoarded = true
+	rtoken.ShopifyDomain = storename
+	if err := writeEtsyToken(storename, rtoken, client); err != nil {
+		return err
+	}
+	// the state and verifier are single use
+	if err := writeEtsyAuthRequest(storename, "", "", client); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "auth_ops",
+			"Caller": "CompleteEtsyAuth",
+		}).Warnf("Unable to clear the etsy state secret %v", err)
+	}
+	log.WithFields(log.Fields{
+		"File":   "auth_ops",
+		"Caller": "CompleteEtsyAuth",
+	}).Infof("Etsy token stored for %s with expiration %v", storename, rtoken.EtsyTokenExpires)
+	etsyshopid, err := getUsersEtsyShops(storename, config.ETSY_CLIENT_ID, fixedEtsyAccess(rtoken.EtsyAccessToken), client)
+	if err != nil {
+		// the token is good so the worker can retry resolving the shop
+		setShopState(storename, shopStateFailing, fmt.Sprintf("GetUsersEtsyShops: %v", err), client)
+		return err
+	}
+	return setShopState(storename, shopStateEtsyResolved, fmt.Sprintf("etsy shop %s authorised", etsyshopid), client)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestEtsyCallbackHandler(t *testing.T) {
+	cases := []struct {
+		name      string
+		target    string
+		completed bool
+		status    int
+	}{
+		{name: "the browser asking for the favicon", target: "/favicon.ico", status: http.StatusBadRequest},
+		{name: "a request without code or state", target: "/etsy/callback", status: http.StatusBadRequest},
+		{name: "a reload of an earlier attempt", target: "/etsy/callback?code=old&state=stale", status: http.StatusBadRequest},
+		{name: "the redirect from etsy", target: "/etsy/callback?code=abc&state=current", completed: true, status: http.StatusOK},
+		{name: "etsy reporting the merchant declined", target: "/etsy/callback?error=access_denied&state=current", completed: true, status: http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result := make(chan error, 1)
+			var completed url.Values
+			handler := etsyCallbackHandler("current", func(query url.Values) error {
+				completed = query
+				if query.Get("error") != "" {
+					return errors.New(query.Get("error"))
+				}
+				return nil
+			}, result)
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", c.target, nil))
+			if w.Code != c.status {
+				t.Errorf("got status %d, want %d", w.Code, c.status)
+			}
+			if (completed != nil) != c.completed {
+				t.Errorf("authorisation completed is %v, want %v", completed != nil, c.completed)
+			}
+			select {
+			case <-result:
+				if !c.completed {
+					t.Errorf("the request ended the authorisation")
+				}
+			default:
+				if c.completed {
+					t.Errorf("the callback did not end the authorisation")
+				}
+			}
+		})
+	}
+}
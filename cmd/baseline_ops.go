@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A baselineChange is the reset of one stock record to the live levels of both stores
+type baselineChange struct {
+	Item         StockItem
+	Shopify      int
+	HasShopify   bool
+	Etsy         int
+	HasEtsy      bool
+	Reinitialise bool
+}
+
+func (c baselineChange) changed() bool {
+	i := c.Item
+	return (c.HasShopify && (i.Available != c.Shopify || i.PriorAvailable != c.Shopify)) ||
+		(c.HasEtsy && (i.EtsyQuantity != c.Etsy || i.EtsyPriorQuantity != c.Etsy)) ||
+		(c.Reinitialise && i.EtsyItemInitialised)
+}
+
+func (c baselineChange) String() string {
+	i := c.Item
+	var parts []string
+	if c.HasShopify {
+		parts = append(parts, fmt.Sprintf("shopify %d/%d -> %d", i.PriorAvailable, i.Available, c.Shopify))
+	}
+	if c.HasEtsy {
+		parts = append(parts, fmt.Sprintf("etsy %d/%d -> %d", i.EtsyPriorQuantity, i.EtsyQuantity, c.Etsy))
+	}
+	if c.Reinitialise && i.EtsyItemInitialised {
+		parts = append(parts, "etsy item reinitialised")
+	}
+	return fmt.Sprintf("sku %s (variant %s, etsy product %d): %s", i.SKU, i.VariantID, i.EtsyProductID, strings.Join(parts, ", "))
+}
+
+// A connectionBaselineChange is the reset of one item on a further connection to its live level
+type connectionBaselineChange struct {
+	Stored   ConnectionStockItem
+	Recorded bool
+	Live     ConnectionStockItem
+}
+
+func (c connectionBaselineChange) changed() bool {
+	return !c.Recorded || c.Stored.Current != c.Live.Current || c.Stored.Previous != c.Live.Current || c.Stored.Source != c.Live.Source
+}
+
+func (c connectionBaselineChange) String() string {
+	if !c.Recorded {
+		return fmt.Sprintf("sku %s (connection %s item %s): not recorded -> %d", c.Live.SKU, c.Live.ConnectionID, c.Live.ItemKey, c.Live.Current)
+	}
+	return fmt.Sprintf("sku %s (connection %s item %s): %d/%d -> %d", c.Live.SKU, c.Live.ConnectionID, c.Live.ItemKey, c.Stored.Previous, c.Stored.Current, c.Live.Current)
+}
+
+// A baselineReset is every record a reset of the baseline changes, and the skus it leaves alone
+type baselineReset struct {
+	Changes     []baselineChange
+	Connections []connectionBaselineChange
+	Skipped     []string
+}
+
+func resetBaselineCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("reset-baseline", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to reset")
+	skulist := fs.String("skus", "", "comma separated skus to reset, defaults to every record of the shop")
+	reinit := fs.Bool("reinit-etsy", false, "also clear e_item_initialised so that the etsy level is taken as new on the next run")
+	dryrun := fs.Bool("dry-run", false, "print the changes without writing them")
+	fs.Parse(args)
+	if *shop == "" {
+		return fmt.Errorf("usage: %s", commands["reset-baseline"].Usage)
+	}
+	var skus []string
+	for _, s := range strings.Split(*skulist, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			skus = append(skus, s)
+		}
+	}
+	plans, err := getPendingPlans(*shop, client)
+	if err != nil {
+		return err
+	}
+	if len(plans) > 0 {
+		return fmt.Errorf("%s has %d plans waiting for approval, approve or reject them before resetting the baseline", *shop, len(plans))
+	}
+	reset, err := planBaselineReset(config, *shop, skus, *reinit, client)
+	if err != nil {
+		return err
+	}
+	for _, s := range reset.Skipped {
+		fmt.Println("skipped", s)
+	}
+	for _, c := range reset.Changes {
+		fmt.Println(c)
+	}
+	for _, c := range reset.Connections {
+		fmt.Println(c)
+	}
+	if *dryrun {
+		fmt.Printf("%d stock records and %d connection items would be reset\n", len(reset.Changes), len(reset.Connections))
+		return nil
+	}
+	if err := applyBaselineReset(*shop, reset, client); err != nil {
+		return err
+	}
+	fmt.Printf("%d stock records and %d connection items reset\n", len(reset.Changes), len(reset.Connections))
+	return nil
+}
+
+// planBaselineReset reads the live levels of both stores and of the further connections, without
+// recording them, and returns the records whose previous and current levels differ from them. Records of
+// quarantined skus, and of skus shared by more than one etsy product, are skipped as there is no single
+// live level to reset them to.
+func planBaselineReset(config Config, storename string, skus []string, reinit bool, client *mongo.Client) (baselineReset, error) {
+	var reset baselineReset
+	quarantined, err := getQuarantinedSkus(storename, client)
+	if err != nil {
+		return reset, err
+	}
+	shopifylive, err := liveShopifyLevels(storename, client)
+	if err != nil {
+		return reset, err
+	}
+	etsybysku, etsybyproduct, etsyconflicts, err := liveEtsyLevels(config, storename, client)
+	if err != nil {
+		return reset, err
+	}
+	etsyconflicted := make(map[string]bool)
+	for _, c := range etsyconflicts {
+		etsyconflicted[c.SKU] = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	filter := bson.M{"shopify_domain": storename}
+	if len(skus) > 0 {
+		filter["sku"] = bson.M{"$in": skus}
+	}
+	stockCollection := client.Database("etsync").Collection("stock")
+	cursor, err := stockCollection.Find(ctx, filter)
+	if err != nil {
+		return reset, err
+	}
+	var items []StockItem
+	if err := cursor.All(ctx, &items); err != nil {
+		return reset, err
+	}
+	for _, item := range items {
+		switch {
+		case quarantined[item.SKU]:
+			reset.Skipped = append(reset.Skipped, fmt.Sprintf("sku %s (variant %s): the sku is quarantined", item.SKU, item.VariantID))
+			continue
+		case etsyconflicted[item.SKU]:
+			reset.Skipped = append(reset.Skipped, fmt.Sprintf("sku %s (variant %s): the sku is on more than one etsy product", item.SKU, item.VariantID))
+			continue
+		}
+		c := baselineChange{Item: item, Reinitialise: reinit}
+		c.Shopify, c.HasShopify = shopifylive[item.InventoryID]
+		if item.SKU != "" {
+			c.Etsy, c.HasEtsy = etsybysku[item.SKU]
+		}
+		if !c.HasEtsy && item.EtsyProductID != 0 {
+			c.Etsy, c.HasEtsy = etsybyproduct[item.EtsyProductID]
+		}
+		if c.changed() {
+			reset.Changes = append(reset.Changes, c)
+		}
+	}
+
+	conns, err := getConnections(storename, client)
+	if err != nil {
+		return reset, err
+	}
+	for _, conn := range conns {
+		if conn.Disabled {
+			continue
+		}
+		changes, skipped, err := planConnectionBaselineReset(config, storename, conn, skus, quarantined, client)
+		if err != nil {
+			return reset, err
+		}
+		reset.Connections = append(reset.Connections, changes...)
+		reset.Skipped = append(reset.Skipped, skipped...)
+	}
+	return reset, nil
+}
+
+// planConnectionBaselineReset reads the live level of every item on the connection and returns the items
+// whose recorded levels differ from it. For a snapshot channel the live level is the one the latest
+// snapshot reconciles to, and the item is marked as having taken the snapshot into account.
+func planConnectionBaselineReset(config Config, storename string, conn ChannelConnection, skus []string, quarantined map[string]bool, client *mongo.Client) ([]connectionBaselineChange, []string, error) {
+	var changes []connectionBaselineChange
+	var skipped []string
+	adapter, err := newChannelAdapter(config, storename, conn, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	items, err := adapter.fetch()
+	if err != nil {
+		return nil, nil, err
+	}
+	conflicted := make(map[string]bool)
+	for _, c := range connectionSkuConflicts(storename, conn, items) {
+		conflicted[c.SKU] = true
+	}
+	stored, err := getConnectionStock(storename, conn.ID, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	if items, err = reconcileConnectionStock(storename, conn, items, client); err != nil {
+		return nil, nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, sku := range skus {
+		wanted[sku] = true
+	}
+	for _, item := range items {
+		if len(wanted) > 0 && !wanted[item.SKU] {
+			continue
+		}
+		switch {
+		case quarantined[item.SKU]:
+			skipped = append(skipped, fmt.Sprintf("sku %s on connection %s: the sku is quarantined", item.SKU, conn.ID))
+			continue
+		case conflicted[item.SKU]:
+			skipped = append(skipped, fmt.Sprintf("sku %s on connection %s: the sku is on more than one item", item.SKU, conn.ID))
+			continue
+		}
+		item.Previous = item.Current
+		c := connectionBaselineChange{Live: item}
+		c.Stored, c.Recorded = stored[item.ItemKey]
+		if c.changed() {
+			changes = append(changes, c)
+		}
+	}
+	return changes, skipped, nil
+}
+
+// liveShopifyLevels reads the available stock of every inventory item through the bulk query
+func liveShopifyLevels(storename string, client *mongo.Client) (map[string]int, error) {
+	levels := make(map[string]int)
+	inventoryurl, err := getinventorylevels(storename, getstoretoken(storename, client))
+	if err != nil {
+		return nil, err
+	}
+	items, err := readinventorylevels(inventoryurl)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range items {
+		levels[i.InventoryID] = i.Available
+	}
+	return levels, nil
+}
+
+// liveEtsyLevels reads the quantity of every etsy product, by sku and by product id. A sku on more than one
+// product is returned as a conflict and left out of the levels by sku.
+func liveEtsyLevels(config Config, storename string, client *mongo.Client) (map[string]int, map[int]int, []SkuConflict, error) {
+	bysku := make(map[string]int)
+	byproduct := make(map[int]int)
+	skuids := make(map[string][]string)
+	tokens := etsyTokens(config, client)
+	if _, err := tokens.Token(storename); err != nil {
+		return nil, nil, nil, err
+	}
+	etoken := tokens.Access(storename)
+	etsyshopid, err := getUsersEtsyShops(storename, config.ETSY_CLIENT_ID, etoken, client)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	listings, err := getEtsyShopListings(etsyshopid, config.ETSY_CLIENT_ID, etoken)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, l := range listings {
+		inventory, err := getListingInventory(l.ListingID, config.ETSY_CLIENT_ID, etoken)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, p := range inventory.Products {
+			if len(p.Offerings) == 0 || p.IsDeleted {
+				continue
+			}
+			if p.Sku != "" {
+				bysku[p.Sku] = p.Offerings[0].Quantity
+				skuids[p.Sku] = append(skuids[p.Sku], fmt.Sprintf("%d", p.ProductID))
+			}
+			byproduct[int(p.ProductID)] = p.Offerings[0].Quantity
+		}
+	}
+	conflicts := findSkuConflicts(storename, "etsy", skuids)
+	for _, c := range conflicts {
+		delete(bysku, c.SKU)
+		log.WithFields(log.Fields{
+			"File":   "baseline_ops",
+			"Caller": "LiveEtsyLevels",
+			"Shop":   storename,
+		}).Warnf("Sku %s is on etsy products %s, its live level is ambiguous", c.SKU, strings.Join(c.IDs, ", "))
+	}
+	return bysku, byproduct, conflicts, nil
+}
+
+// applyBaselineReset sets the previous and current levels of each record to the live level, so that the
+// next run sees no change on either store or on the further connections
+func applyBaselineReset(storename string, reset baselineReset, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	for _, c := range reset.Changes {
+		set := bson.M{}
+		if c.HasShopify {
+			set["s_curr_stock"] = c.Shopify
+			set["s_prev_stock"] = c.Shopify
+		}
+		if c.HasEtsy {
+			set["e_curr_stock"] = c.Etsy
+			set["e_prev_stock"] = c.Etsy
+		}
+		if c.Reinitialise {
+			set["e_item_initialised"] = false
+		}
+		if _, err := stockCollection.UpdateOne(ctx, bson.M{"_id": c.Item.ID}, bson.M{"$set": set}); err != nil {
+			log.WithFields(log.Fields{
+				"File":   "baseline_ops",
+				"Caller": "ApplyBaselineReset",
+			}).Errorf("Unable to reset sku %s %v", c.Item.SKU, err)
+			return err
+		}
+	}
+	var items []ConnectionStockItem
+	var skus []string
+	for _, c := range reset.Changes {
+		skus = append(skus, c.Item.SKU)
+	}
+	for _, c := range reset.Connections {
+		items = append(items, c.Live)
+		skus = append(skus, c.Live.SKU)
+	}
+	if err := commitConnectionStock(items, client); err != nil {
+		return err
+	}
+	// the changes kept for connections that could not be read are part of the baseline being replaced
+	if err := clearConnectionBacklog(storename, skus, client); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"File":   "baseline_ops",
+		"Caller": "ApplyBaselineReset",
+		"Shop":   storename,
+	}).Infof("Reset the baseline of %d stock records and %d connection items", len(reset.Changes), len(reset.Connections))
+	return nil
+}
+
+// the fields of a stock record that a run moves on as it reads the stores: the levels the changes are
+// worked out from and the requests the run takes up
+var stockBaselineFields = []string{"s_curr_stock", "s_prev_stock", "e_curr_stock", "e_prev_stock", "e_item_initialised", "override_stock_requested", "e_sku_sync_requested"}
+
+// A StockBaseline is a stock record moved on by a run, with its baseline fields before and after the run
+// read the stores. The baselines of a plan are only committed when the plan is applied.
+type StockBaseline struct {
+	ID     primitive.ObjectID `bson:"_id"`
+	Before bson.M             `bson:"before"`
+	After  bson.M             `bson:"after"`
+}
+
+// getStockBaselines reads the baseline fields of every stock record of the shop, by record id
+func getStockBaselines(storename string, client *mongo.Client) (map[primitive.ObjectID]bson.M, error) {
+	baselines := make(map[primitive.ObjectID]bson.M)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	projection := bson.M{}
+	for _, f := range stockBaselineFields {
+		projection[f] = 1
+	}
+	stockCollection := client.Database("etsync").Collection("stock")
+	cursor, err := stockCollection.Find(ctx, bson.M{"shopify_domain": storename}, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		id, ok := doc["_id"].(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		delete(doc, "_id")
+		baselines[id] = doc
+	}
+	return baselines, cursor.Err()
+}
+
+// stockBaselineChanges returns the records whose baseline fields differ between two reads. Records that
+// were added in between are left out, as a new record starts with no change.
+func stockBaselineChanges(before, after map[primitive.ObjectID]bson.M) []StockBaseline {
+	var changes []StockBaseline
+	for id, b := range before {
+		a, ok := after[id]
+		if !ok || reflect.DeepEqual(a, b) {
+			continue
+		}
+		changes = append(changes, StockBaseline{ID: id, Before: b, After: a})
+	}
+	return changes
+}
+
+// setStockBaselines puts the baseline fields of each record back to their values before the run, or
+// forward to their values after it
+func setStockBaselines(baselines []StockBaseline, forward bool, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	for _, b := range baselines {
+		to, from := b.Before, b.After
+		if forward {
+			to, from = b.After, b.Before
+		}
+		update := bson.M{"$set": to}
+		unset := bson.M{}
+		for f := range from {
+			if _, ok := to[f]; !ok {
+				unset[f] = ""
+			}
+		}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		if len(to) == 0 {
+			delete(update, "$set")
+		}
+		if len(update) == 0 {
+			continue
+		}
+		if _, err := stockCollection.UpdateOne(ctx, bson.M{"_id": b.ID}, update); err != nil {
+			log.WithFields(log.Fields{
+				"File":   "baseline_ops",
+				"Caller": "SetStockBaselines",
+			}).Errorf("Unable to set the baseline of stock record %s %v", b.ID.Hex(), err)
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreStockBaselines puts every record the run has moved on back to its baseline before the run, so
+// that the changes the run read are picked up again by the next run
+func restoreStockBaselines(storename string, before map[primitive.ObjectID]bson.M, client *mongo.Client) error {
+	if before == nil {
+		return nil
+	}
+	after, err := getStockBaselines(storename, client)
+	if err != nil {
+		return err
+	}
+	return setStockBaselines(stockBaselineChanges(before, after), false, client)
+}
+
+// movedStockBaselines describes the records whose baseline fields no longer hold the values the plan
+// left them with, eg. because an override was requested while the plan was held
+func movedStockBaselines(storename string, baselines []StockBaseline, client *mongo.Client) ([]string, error) {
+	var moved []string
+	if len(baselines) == 0 {
+		return moved, nil
+	}
+	current, err := getStockBaselines(storename, client)
+	if err != nil {
+		return moved, err
+	}
+	for _, b := range baselines {
+		if c, ok := current[b.ID]; !ok || !reflect.DeepEqual(c, b.Before) {
+			moved = append(moved, fmt.Sprintf("stock record %s has changed since the plan was computed", b.ID.Hex()))
+		}
+	}
+	return moved, nil
+}
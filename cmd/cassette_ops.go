@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A cassette is a directory of the api calls made by a run, one json file per call in the order they
+// were made, with the tokens redacted. A recording transport writes them and a replaying transport
+// serves them back so that a run can be repeated against the same payloads.
+
+const redacted = "REDACTED"
+
+// the headers, form fields and json fields holding credentials
+var (
+	redactedHeaders = []string{"Authorization", "X-Shopify-Access-Token", "X-Api-Key", "Cookie", "Set-Cookie"}
+	redactedFields  = []string{"access_token", "refresh_token", "code", "code_verifier", "client_secret"}
+	redactedJSON    = []string{"access_token", "refresh_token"}
+	// the signed bulk result urls carry their credentials in the query
+	redactedParams = []string{"X-Goog-Signature", "X-Goog-Credential", "Signature", "signature"}
+)
+
+type cassetteCall struct {
+	Method          string              `json:"method"`
+	URL             string              `json:"url"`
+	RequestHeaders  map[string][]string `json:"request_headers,omitempty"`
+	RequestBody     string              `json:"request_body,omitempty"`
+	Status          int                 `json:"status"`
+	ResponseHeaders map[string][]string `json:"response_headers,omitempty"`
+	ResponseBody    string              `json:"response_body"`
+}
+
+// initCassette records or replays the api calls when HTTP_RECORD_DIR or HTTP_REPLAY_DIR is set
+func initCassette(config Config) error {
+	if config.HTTP_RECORD_DIR != "" && config.HTTP_REPLAY_DIR != "" {
+		return fmt.Errorf("HTTP_RECORD_DIR and HTTP_REPLAY_DIR cannot both be set")
+	}
+	if config.HTTP_RECORD_DIR != "" {
+		recorder, err := newRecordingTransport(config.HTTP_RECORD_DIR, apiHTTP.Transport)
+		if err != nil {
+			return err
+		}
+		setHTTPTransport(recorder)
+		log.WithFields(log.Fields{
+			"File":   "cassette_ops",
+			"Caller": "InitCassette",
+		}).Infof("Recording api calls to %s", config.HTTP_RECORD_DIR)
+	}
+	if config.HTTP_REPLAY_DIR != "" {
+		replayer, err := newReplayingTransport(config.HTTP_REPLAY_DIR)
+		if err != nil {
+			return err
+		}
+		setHTTPTransport(replayer)
+		log.WithFields(log.Fields{
+			"File":   "cassette_ops",
+			"Caller": "InitCassette",
+		}).Infof("Replaying %d api calls from %s", len(replayer.calls), config.HTTP_REPLAY_DIR)
+	}
+	return nil
+}
+
+type recordingTransport struct {
+	mu    sync.Mutex
+	dir   string
+	next  http.RoundTripper
+	count int
+}
+
+func newRecordingTransport(dir string, next http.RoundTripper) (*recordingTransport, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// carry on numbering after any calls already in the directory
+	existing, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	return &recordingTransport{dir: dir, next: next, count: len(existing)}, nil
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqbody []byte
+	if req.Body != nil {
+		var err error
+		if reqbody, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqbody))
+	}
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resbody, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(resbody))
+
+	call := cassetteCall{
+		Method:          req.Method,
+		URL:             redactURL(req.URL.String()),
+		RequestHeaders:  redactHeaders(req.Header),
+		RequestBody:     redactBody(reqbody, req.Header.Get("Content-Type")),
+		Status:          res.StatusCode,
+		ResponseHeaders: redactHeaders(res.Header),
+		ResponseBody:    redactBody(resbody, res.Header.Get("Content-Type")),
+	}
+	if err := t.save(call); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "cassette_ops",
+			"Caller": "RoundTrip",
+		}).Errorf("Unable to record %s %s %v", call.Method, call.URL, err)
+	}
+	return res, nil
+}
+
+func (t *recordingTransport) save(call cassetteCall) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count++
+	b, err := json.MarshalIndent(call, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(t.dir, fmt.Sprintf("%04d.json", t.count)), b, 0600)
+}
+
+// replayingTransport serves the recorded responses, matching calls by method and url. Calls to the same
+// url are answered in the order they were recorded, and a call that was not recorded fails.
+type replayingTransport struct {
+	mu     sync.Mutex
+	calls  []cassetteCall
+	queues map[string][]cassetteCall
+}
+
+func newReplayingTransport(dir string) (*replayingTransport, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recorded calls in %s", dir)
+	}
+	sort.Strings(files)
+	t := &replayingTransport{queues: make(map[string][]cassetteCall)}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var call cassetteCall
+		if err := json.Unmarshal(b, &call); err != nil {
+			return nil, fmt.Errorf("unable to read recorded call %s: %v", f, err)
+		}
+		t.calls = append(t.calls, call)
+		key := call.Method + " " + call.URL
+		t.queues[key] = append(t.queues[key], call)
+	}
+	return t, nil
+}
+
+func (t *replayingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	key := req.Method + " " + redactURL(req.URL.String())
+	t.mu.Lock()
+	queue := t.queues[key]
+	if len(queue) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("no recorded response for %s", key)
+	}
+	call := queue[0]
+	t.queues[key] = queue[1:]
+	t.mu.Unlock()
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", call.Status, http.StatusText(call.Status)),
+		StatusCode:    call.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(call.ResponseHeaders),
+		Body:          ioutil.NopCloser(strings.NewReader(call.ResponseBody)),
+		ContentLength: int64(len(call.ResponseBody)),
+		Request:       req,
+	}, nil
+}
+
+func redactHeaders(headers http.Header) map[string][]string {
+	redactedheaders := make(map[string][]string)
+	for k, v := range headers {
+		redactedheaders[k] = v
+	}
+	for _, h := range redactedHeaders {
+		if _, ok := headers[http.CanonicalHeaderKey(h)]; ok {
+			redactedheaders[http.CanonicalHeaderKey(h)] = []string{redacted}
+		}
+	}
+	return redactedheaders
+}
+
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.RawQuery == "" {
+		return rawurl
+	}
+	query := u.Query()
+	changed := false
+	for _, p := range redactedParams {
+		if _, ok := query[p]; ok {
+			query.Set(p, redacted)
+			changed = true
+		}
+	}
+	if !changed {
+		return rawurl
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// redactToken keeps the user id etsy prefixes its tokens with, as the worker reads it from the token
+func redactToken(token string) string {
+	if i := strings.Index(token, "."); i > 0 {
+		return token[:i] + "." + redacted
+	}
+	return redacted
+}
+
+// redactBody redacts the credentials in form and json bodies. Bodies are only rewritten when there is
+// something to redact, so that the recorded payloads are otherwise kept as sent.
+func redactBody(body []byte, contenttype string) string {
+	if strings.HasPrefix(contenttype, "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return string(body)
+		}
+		changed := false
+		for _, f := range redactedFields {
+			if v := form.Get(f); v != "" {
+				form.Set(f, redactToken(v))
+				changed = true
+			}
+		}
+		if changed {
+			return form.Encode()
+		}
+		return string(body)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return string(body)
+	}
+	if !redactJSON(doc) {
+		return string(body)
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return string(body)
+	}
+	return string(b)
+}
+
+// redactJSON redacts the credential fields and signed urls anywhere in a decoded json document
+func redactJSON(doc interface{}) bool {
+	changed := false
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if s, ok := value.(string); ok {
+				for _, f := range redactedJSON {
+					if k == f && s != "" {
+						v[k] = redactToken(s)
+						changed = true
+					}
+				}
+				if r := redactURL(s); r != s && strings.HasPrefix(s, "http") {
+					v[k] = r
+					changed = true
+				}
+				continue
+			}
+			if redactJSON(value) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if redactJSON(value) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
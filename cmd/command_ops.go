@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A command is an operator task that can be run in place of the sync, eg. `etsync -shop x approve <plan-id>`
+type command struct {
+	Usage string
+	Run   func(args []string, config Config, client *mongo.Client) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"sync": {
+			Usage: "sync [-shop X]: run the full sync pipeline, as when no command is given",
+			Run:   syncCommand,
+		},
+		"fetch": {
+			Usage: "fetch shopify|etsy [-shop X]: print the live levels of one store without recording anything",
+			Run:   fetchCommand,
+		},
+		"status": {
+			Usage: "status [-shop X]: show the state, last run, pending plans and requests of the shop",
+			Run:   statusCommand,
+		},
+		"link": {
+			Usage: "link [-shop X] <etsy-product-id> <sku>: request the sku is set on the etsy product",
+			Run:   linkCommand,
+		},
+		"override": {
+			Usage: "override [-shop X] <sku> <quantity>: request the stock level of the sku is set on both stores",
+			Run:   overrideCommand,
+		},
+		"reset-baseline": {
+			Usage: "reset-baseline [-shop X] [-skus a,b] [-reinit-etsy] [-dry-run]: set the previous and current stock levels to the live levels",
+			Run:   resetBaselineCommand,
+		},
+		"explain": {
+			Usage: "explain [-shop X] -sku Y [-n 10] [-offline]: show what is recorded for a sku and what the next run would do to it",
+			Run:   explainCommand,
+		},
+		"tokens": {
+			Usage: "tokens [-shop X]: show how the tokens of a shop record are stored and when they expire",
+			Run:   tokensCommand,
+		},
+		"runs": {
+			Usage: "runs [-shop X] [-n 10]: show the most recent sync runs",
+			Run:   runsCommand,
+		},
+		"plans": {
+			Usage: "plans [-shop X]: list the plans waiting for approval",
+			Run:   plansCommand,
+		},
+		"approve": {
+			Usage: "approve [-shop x] <plan-id>: apply a pending plan if the live stock levels have not moved",
+			Run:   approveCommand,
+		},
+		"reject": {
+			Usage: "reject [-shop x] <plan-id>: discard a pending plan",
+			Run:   rejectCommand,
+		},
+		"rollback": {
+			Usage: "rollback [-force] <run-id>: restore the stock levels written by a run",
+			Run:   rollbackCommand,
+		},
+		"auth": {
+			Usage: "auth etsy [-shop X] [-redirect uri]: authorise etsync on an etsy shop and store the token",
+			Run:   authCommand,
+		},
+		"state": {
+			Usage: "state [-shop X] [-set paused|active] [-reason r]: show or set the state of a shop",
+			Run:   stateCommand,
+		},
+		"conflicts": {
+			Usage: "conflicts [-shop X]: list the skus shared by more than one item, which are left out of the sync",
+			Run:   conflictsCommand,
+		},
+		"connections": {
+			Usage: "connections [-shop X]: list the further stores sharing the shop's stock",
+			Run:   connectionsCommand,
+		},
+		"connect": {
+			Usage: "connect [-shop X] -channel shopify|etsy|woocommerce|ebay|file [-account A] [-token-from T] [-location L] [-output F] <id>: add or replace a connection",
+			Run:   connectCommand,
+		},
+		"disconnect": {
+			Usage: "disconnect [-shop X] <id>: remove a connection",
+			Run:   disconnectCommand,
+		},
+		"woo-keys": {
+			Usage: "woo-keys -shop X -key K -secret S: store the woocommerce REST api keys on a shop record",
+			Run:   wooKeysCommand,
+		},
+		"ebay-token": {
+			Usage: "ebay-token -shop X -refresh-token R: store an ebay user token on a shop record",
+			Run:   ebayTokenCommand,
+		},
+		"import": {
+			Usage: "import [-shop X] [-kind overrides|links] [-dry-run] <file.csv>: request stock overrides (sku,quantity) or sku links (etsy_product_id,sku) in bulk",
+			Run:   importCommand,
+		},
+		"export": {
+			Usage: "export [-shop X] [-kind stock|overrides|links] [-o file.csv]: dump the stock records, or the pending overrides or sku links",
+			Run:   exportCommand,
+		},
+		"pair": {
+			Usage: "pair <name>: add a pair keeping two stores of the same channel in sync, add its stores with connect -shop <name>",
+			Run:   pairCommand,
+		},
+		"price-sync": {
+			Usage: "price-sync [-shop X] [-direction off|shopify_to_etsy|etsy_to_shopify] [-markup-percent P] [-markup-fixed F] [-ending 0.99] [-shopify-currency C]: show or set how prices are synced",
+			Run:   priceSyncCommand,
+		},
+		"encrypt-tokens": {
+			Usage: "encrypt-tokens [-dry-run]: encrypt plain text shop tokens and re-encrypt tokens sealed with an old key",
+			Run:   encryptTokensCommand,
+		},
+	}
+}
+
+func runCommand(args []string, config Config, client *mongo.Client) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage()
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+	return cmd.Run(args[1:], config, client)
+}
+
+func printUsage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].Usage)
+	}
+}
+
+func plansCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("plans", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to list plans for")
+	fs.Parse(args)
+	plans, err := getPendingPlans(*shop, client)
+	if err != nil {
+		return err
+	}
+	for _, p := range plans {
+		fmt.Printf("%s %s %s: %d etsy listings, %d shopify variants, %d stock changes\n", p.ID.Hex(), p.CreatedAt.Format("2006-01-02 15:04"), p.Status, len(p.EtsyWrites), len(p.ShopifySets), len(p.changes()))
+		if p.Status == planStatusApplying {
+			state := "in progress"
+			if p.claimExpired() {
+				state = "expired, approve or reject it again"
+			}
+			fmt.Printf("    claimed by an approve at %s, %s\n", p.ClaimedAt.Format("2006-01-02 15:04"), state)
+		}
+		for _, r := range p.HoldReasons {
+			fmt.Printf("    %s\n", r)
+		}
+	}
+	return nil
+}
+
+func approveCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("approve", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop the plan belongs to")
+	fs.Parse(args)
+	if *shop == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: %s", commands["approve"].Usage)
+	}
+	return approvePlan(*shop, fs.Arg(0), config, client)
+}
+
+func rejectCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("reject", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop the plan belongs to")
+	fs.Parse(args)
+	if *shop == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: %s", commands["reject"].Usage)
+	}
+	return rejectPlan(*shop, fs.Arg(0), client)
+}
+
+func rollbackCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	force := fs.Bool("force", false, "restore items that have changed since the run")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: %s", commands["rollback"].Usage)
+	}
+	return rollbackRun(fs.Arg(0), *force, config, client)
+}
+
+func runsCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("runs", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to show runs for")
+	limit := fs.Int64("n", 10, "the number of runs to show")
+	fs.Parse(args)
+	runs, err := getSyncRuns(*shop, *limit, client)
+	if err != nil {
+		return err
+	}
+	for _, r := range runs {
+		fmt.Printf("%s %s %-8s %-21s variants=%d levels=%d listings=%d products=%d to_etsy=%d to_shopify=%d to_connections=%d errors=%d\n",
+			r.ID.Hex(), r.StartedAt.Format("2006-01-02 15:04"), r.Command, r.Status,
+			r.Variants, r.InventoryLevels, r.Listings, r.Products, len(r.ShopifyToEtsy), len(r.EtsyToShopify), len(r.ToConnections), len(r.Errors))
+		for _, e := range r.Errors {
+			fmt.Printf("    %s: %s\n", e.Call, e.Error)
+		}
+	}
+	return nil
+}
+
+func encryptTokensCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("encrypt-tokens", flag.ExitOnError)
+	dryrun := fs.Bool("dry-run", false, "report the shops that would be updated without writing them")
+	fs.Parse(args)
+	updated, err := migrateTokenEncryption(config, *dryrun, client)
+	if err != nil {
+		return err
+	}
+	if *dryrun {
+		fmt.Printf("%d shops have tokens to encrypt\n", updated)
+	} else {
+		fmt.Printf("encrypted tokens for %d shops\n", updated)
+	}
+	return nil
+}
+
+func stateCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("state", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to show or set the state of")
+	set := fs.String("set", "", "the state to move the shop to")
+	reason := fs.String("reason", "set by operator", "the reason recorded with the new state")
+	fs.Parse(args)
+	if *set != "" {
+		if !isShopState(*set) {
+			return fmt.Errorf("unknown state %s", *set)
+		}
+		if err := setShopState(*shop, *set, *reason, client); err != nil {
+			return err
+		}
+	}
+	state, err := getShopState(*shop, client)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s: %s\n", state.ShopifyDomain, state.State, state.StateReason)
+	for _, t := range state.StateHistory {
+		fmt.Printf("    %s %s -> %s: %s\n", t.At.Format("2006-01-02 15:04"), t.From, t.To, t.Reason)
+	}
+	return nil
+}
+
+func conflictsCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("conflicts", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to list sku conflicts for")
+	fs.Parse(args)
+	if *shop == "" {
+		return fmt.Errorf("usage: %s", commands["conflicts"].Usage)
+	}
+	conflicts, err := getSkuConflicts(*shop, client)
+	if err != nil {
+		return err
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Channel != conflicts[j].Channel {
+			return conflicts[i].Channel < conflicts[j].Channel
+		}
+		return conflicts[i].SKU < conflicts[j].SKU
+	})
+	for _, c := range conflicts {
+		fmt.Printf("%s %s: %d items (%s), detected %s\n", c.Channel, c.SKU, len(c.IDs), strings.Join(c.IDs, ", "), c.DetectedAt.Format("2006-01-02 15:04"))
+	}
+	fmt.Printf("%d skus in conflict\n", len(conflicts))
+	return nil
+}
+
+func connectionsCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("connections", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to list connections for")
+	fs.Parse(args)
+	conns, err := getConnections(*shop, client)
+	if err != nil {
+		return err
+	}
+	for _, c := range conns {
+		status := "enabled"
+		if c.Disabled {
+			status = "disabled"
+		}
+		fmt.Printf("%s %s account=%s token_from=%s location=%s output=%s %s\n", c.ID, c.Channel, c.Account, c.TokenFrom, c.LocationID, c.Output, status)
+	}
+	return nil
+}
+
+func connectCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("connect", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop whose stock the connection shares")
+	channel := fs.String("channel", "", "the channel of the connected store")
+	account := fs.String("account", "", "the shopify domain, etsy shop id, woocommerce site url or watched directory of the connected store")
+	tokenfrom := fs.String("token-from", "", "the shop record holding the token for the connected store")
+	location := fs.String("location", "", "the shopify location id to sync")
+	output := fs.String("output", "", "the csv file a file connection writes the reconciled levels to")
+	disabled := fs.Bool("disabled", false, "add the connection without syncing it")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *channel == "" {
+		return fmt.Errorf("usage: %s", commands["connect"].Usage)
+	}
+	conn := ChannelConnection{
+		ID:         fs.Arg(0),
+		Channel:    *channel,
+		Account:    *account,
+		TokenFrom:  *tokenfrom,
+		LocationID: *location,
+		Output:     *output,
+		Disabled:   *disabled,
+	}
+	// check the connection can be set up before storing it
+	if _, err := newChannelAdapter(config, *shop, conn, client); err != nil {
+		return err
+	}
+	return saveConnection(*shop, conn, client)
+}
+
+func disconnectCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("disconnect", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to remove the connection from")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: %s", commands["disconnect"].Usage)
+	}
+	if _, err := getConnection(*shop, fs.Arg(0), client); err != nil {
+		return err
+	}
+	return removeConnection(*shop, fs.Arg(0), client)
+}
+
+func statusCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to show the status of")
+	fs.Parse(args)
+	state, err := getShopState(*shop, client)
+	if err != nil {
+		return err
+	}
+	kind := state.Kind
+	if kind == "" {
+		kind = "shop"
+	}
+	fmt.Printf("%s (%s) %s since %s: %s\n", state.ShopifyDomain, kind, state.State, state.StateChangedAt.Format("2006-01-02 15:04"), state.StateReason)
+	runs, err := getSyncRuns(*shop, 1, client)
+	if err != nil {
+		return err
+	}
+	for _, r := range runs {
+		fmt.Printf("last run %s %s %s %s, %d errors\n", r.ID.Hex(), r.StartedAt.Format("2006-01-02 15:04"), r.Command, r.Status, len(r.Errors))
+	}
+	plans, err := getPendingPlans(*shop, client)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d plans waiting for approval\n", len(plans))
+	if kind == "shop" {
+		counts, err := stockStatus(*shop, client)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("stock records=%d overrides_requested=%d sku_links_requested=%d quarantined=%d\n", counts["records"], counts["overrides"], counts["links"], counts["quarantined"])
+	}
+	conns, err := getConnections(*shop, client)
+	if err != nil {
+		return err
+	}
+	for _, c := range conns {
+		status := "enabled"
+		if c.Disabled {
+			status = "disabled"
+		}
+		fmt.Printf("connection %s %s %s\n", c.ID, c.Channel, status)
+	}
+	return nil
+}
+
+// stockStatus counts the stock records of the shop and the requests waiting on the next run
+func stockStatus(storename string, client *mongo.Client) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	filters := map[string]bson.M{
+		"records":     {"shopify_domain": storename},
+		"overrides":   {"shopify_domain": storename, "override_stock_requested": true},
+		"links":       {"shopify_domain": storename, "e_sku_sync_requested": true},
+		"quarantined": {"shopify_domain": storename, "sku_quarantined": true},
+	}
+	counts := make(map[string]int64)
+	for name, filter := range filters {
+		n, err := stockCollection.CountDocuments(ctx, filter)
+		if err != nil {
+			return counts, err
+		}
+		counts[name] = n
+	}
+	return counts, nil
+}
+
+func linkCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("link", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop the etsy product belongs to")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: %s", commands["link"].Usage)
+	}
+	rows, problems, err := validateLinkRows(*shop, [][]string{fs.Args()}, 0, client)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.TrimPrefix(problems[0], "line 1: "))
+	}
+	return applyLinkRows(*shop, rows, client)
+}
+
+func overrideCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("override", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop the sku belongs to")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: %s", commands["override"].Usage)
+	}
+	rows, problems, err := validateOverrideRows(*shop, [][]string{fs.Args()}, 0, client)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.TrimPrefix(problems[0], "line 1: "))
+	}
+	return applyOverrideRows(*shop, rows, client)
+}
+
+// the token fields shown by the tokens command, with the field holding their expiry
+var tokenFields = []struct {
+	Name    string
+	Field   string
+	Expires string
+}{
+	{"shopify", "accessToken", ""},
+	{"etsy access", "etsy_access_token", "etsy_token_expires"},
+	{"etsy refresh", "etsy_refresh_token", ""},
+	{"ebay access", "ebay_access_token", "ebay_token_expires"},
+	{"ebay refresh", "ebay_refresh_token", ""},
+	{"woocommerce", "woo_consumer_secret", ""},
+}
+
+func tokensCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("tokens", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop record to inspect")
+	fs.Parse(args)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var doc bson.M
+	shopCollection := client.Database("etsync").Collection("shops")
+	if err := shopCollection.FindOne(ctx, bson.M{"shopify_domain": *shop}).Decode(&doc); err != nil {
+		return err
+	}
+	fmt.Printf("%s %v\n", *shop, doc["state"])
+	for _, t := range tokenFields {
+		value, _ := doc[t.Field].(string)
+		if value == "" {
+			continue
+		}
+		storage := "plain text"
+		if token, err := parseEncryptedToken(value); err != nil {
+			storage = err.Error()
+		} else if token.kid != "" && !token.bound {
+			storage = "encrypted with key " + token.kid + ", not bound to the shop"
+		} else if token.kid != "" {
+			storage = "encrypted with key " + token.kid
+		}
+		expiry := ""
+		if expires, ok := doc[t.Expires].(primitive.DateTime); ok {
+			at := expires.Time()
+			expiry = fmt.Sprintf(", expires %s (in %v)", at.Format("2006-01-02 15:04"), time.Until(at).Round(time.Minute))
+			if time.Now().After(at) {
+				expiry = fmt.Sprintf(", expired %s", at.Format("2006-01-02 15:04"))
+			}
+		}
+		fmt.Printf("    %-13s %s%s\n", t.Name, storage, expiry)
+	}
+	return nil
+}
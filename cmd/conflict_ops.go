@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A SkuConflict records a sku that is shared by more than one item within a single channel
+// (two shopify variants, or two etsy products). Lookups by sku cannot tell these items apart so
+// they are quarantined from sync until the merchant fixes their catalog.
+type SkuConflict struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	ShopifyDomain string             `bson:"shopify_domain"`
+	Channel       string             `bson:"channel"`
+	SKU           string             `bson:"sku"`
+	IDs           []string           `bson:"ids"`
+	DetectedAt    time.Time          `bson:"detected_at"`
+}
+
+// findSkuConflicts takes a map of sku -> item ids seen during ingestion and returns a conflict
+// for every sku that maps to more than one item. Items without a sku are not considered.
+func findSkuConflicts(storename, channel string, skuids map[string][]string) []SkuConflict {
+	var conflicts []SkuConflict
+	now := time.Now()
+	for sku, ids := range skuids {
+		if sku == "" || len(ids) < 2 {
+			continue
+		}
+		conflicts = append(conflicts, SkuConflict{
+			ShopifyDomain: storename,
+			Channel:       channel,
+			SKU:           sku,
+			IDs:           ids,
+			DetectedAt:    now,
+		})
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].SKU < conflicts[j].SKU })
+	return conflicts
+}
+
+func shopifySkuConflicts(storename string, items []StockItem) []SkuConflict {
+	skuids := make(map[string][]string)
+	for _, item := range items {
+		skuids[item.SKU] = append(skuids[item.SKU], item.VariantID)
+	}
+	return findSkuConflicts(storename, "shopify", skuids)
+}
+
+// etsySkuConflicts uses the sku the product will be stored under, so a pending sku link that
+// would collide with another product is caught before it is written
+func etsySkuConflicts(storename string, listings map[int]etsyListing, eSkusToSet map[int]string) []SkuConflict {
+	skuids := make(map[string][]string)
+	for _, l := range listings {
+		for _, p := range l.Products {
+			if p.IsDeleted {
+				continue
+			}
+			sku := p.Sku
+			if s, ok := eSkusToSet[int(p.ProductID)]; ok {
+				sku = s
+			}
+			skuids[sku] = append(skuids[sku], fmt.Sprintf("%d", p.ProductID))
+		}
+	}
+	for sku := range skuids {
+		sort.Strings(skuids[sku])
+	}
+	return findSkuConflicts(storename, "etsy", skuids)
+}
+
+// connectionSkuConflicts finds the skus shared by more than one item on a further connection
+func connectionSkuConflicts(storename string, conn ChannelConnection, items []ConnectionStockItem) []SkuConflict {
+	skuids := make(map[string][]string)
+	for _, item := range items {
+		skuids[item.SKU] = append(skuids[item.SKU], item.ItemKey)
+	}
+	return findSkuConflicts(storename, "connection/"+conn.ID, skuids)
+}
+
+// saveSkuConflicts replaces the conflict report for the channel with the conflicts found in this run
+// and refreshes the quarantine flag on the affected stock records
+func saveSkuConflicts(storename, channel string, conflicts []SkuConflict, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conflictCollection := client.Database("etsync").Collection("sku_conflicts")
+	if _, err := conflictCollection.DeleteMany(ctx, bson.M{"shopify_domain": storename, "channel": channel}); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "conflict_ops",
+			"Caller": "SaveSkuConflicts",
+		}).Errorf("Unable to clear previous %s sku conflicts %v", channel, err)
+		return err
+	}
+	if len(conflicts) > 0 {
+		docs := make([]interface{}, len(conflicts))
+		for i, c := range conflicts {
+			docs[i] = c
+			log.WithFields(log.Fields{
+				"File":    "conflict_ops",
+				"Caller":  "SaveSkuConflicts",
+				"Channel": channel,
+				"Sku":     c.SKU,
+			}).Warnf("Sku is shared by %d items (%v), quarantining from sync", len(c.IDs), c.IDs)
+		}
+		if _, err := conflictCollection.InsertMany(ctx, docs); err != nil {
+			log.WithFields(log.Fields{
+				"File":   "conflict_ops",
+				"Caller": "SaveSkuConflicts",
+			}).Errorf("Unable to write %s sku conflicts %v", channel, err)
+			return err
+		}
+	}
+
+	quarantined, err := getQuarantinedSkus(storename, client)
+	if err != nil {
+		return err
+	}
+	skus := make([]string, 0, len(quarantined))
+	for sku := range quarantined {
+		skus = append(skus, sku)
+	}
+	stockCollection := client.Database("etsync").Collection("stock")
+	if _, err := stockCollection.UpdateMany(ctx,
+		bson.M{"shopify_domain": storename, "sku": bson.M{"$in": skus}},
+		bson.M{"$set": bson.M{"sku_quarantined": true}}); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "conflict_ops",
+			"Caller": "SaveSkuConflicts",
+		}).Errorf("Unable to flag quarantined stock items %v", err)
+		return err
+	}
+	if _, err := stockCollection.UpdateMany(ctx,
+		bson.M{"shopify_domain": storename, "sku": bson.M{"$nin": skus}, "sku_quarantined": true},
+		bson.M{"$set": bson.M{"sku_quarantined": false}}); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "conflict_ops",
+			"Caller": "SaveSkuConflicts",
+		}).Errorf("Unable to release quarantined stock items %v", err)
+		return err
+	}
+	return nil
+}
+
+// getSkuConflicts returns the current conflict report for the shop across all channels
+func getSkuConflicts(storename string, client *mongo.Client) ([]SkuConflict, error) {
+	var conflicts []SkuConflict
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conflictCollection := client.Database("etsync").Collection("sku_conflicts")
+	cursor, err := conflictCollection.Find(ctx, bson.M{"shopify_domain": storename})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "conflict_ops",
+			"Caller": "GetSkuConflicts",
+		}).Errorf("Error getting sku conflicts %v", err)
+		return conflicts, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &conflicts); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "conflict_ops",
+			"Caller": "GetSkuConflicts",
+		}).Errorf("Error decoding sku conflicts %v", err)
+		return conflicts, err
+	}
+	return conflicts, nil
+}
+
+// getQuarantinedSkus returns the set of skus that are in conflict on any channel
+func getQuarantinedSkus(storename string, client *mongo.Client) (map[string]bool, error) {
+	quarantined := make(map[string]bool)
+	conflicts, err := getSkuConflicts(storename, client)
+	if err != nil {
+		return quarantined, err
+	}
+	for _, c := range conflicts {
+		quarantined[c.SKU] = true
+	}
+	return quarantined, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// conflictSkus reduces conflicts to sku -> ids, dropping the detection time
+func conflictSkus(t *testing.T, conflicts []SkuConflict, storename, channel string) map[string][]string {
+	t.Helper()
+	got := make(map[string][]string)
+	for _, c := range conflicts {
+		if c.ShopifyDomain != storename || c.Channel != channel {
+			t.Errorf("conflict %s recorded for %s %s, want %s %s", c.SKU, c.ShopifyDomain, c.Channel, storename, channel)
+		}
+		got[c.SKU] = c.IDs
+	}
+	return got
+}
+
+func TestFindSkuConflicts(t *testing.T) {
+	cases := []struct {
+		name   string
+		skuids map[string][]string
+		want   map[string][]string
+	}{
+		{
+			name:   "no shared skus",
+			skuids: map[string][]string{"MUG": {"1"}, "BOWL": {"2"}},
+			want:   map[string][]string{},
+		},
+		{
+			name:   "a sku on two items",
+			skuids: map[string][]string{"MUG": {"1", "2"}, "BOWL": {"3"}},
+			want:   map[string][]string{"MUG": {"1", "2"}},
+		},
+		{
+			name:   "items without a sku are not a conflict",
+			skuids: map[string][]string{"": {"1", "2", "3"}, "BOWL": {"4", "5", "6"}},
+			want:   map[string][]string{"BOWL": {"4", "5", "6"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conflicts := findSkuConflicts("test.myshopify.com", "shopify", c.skuids)
+			if got := conflictSkus(t, conflicts, "test.myshopify.com", "shopify"); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+			for i := 1; i < len(conflicts); i++ {
+				if conflicts[i-1].SKU > conflicts[i].SKU {
+					t.Errorf("conflicts are not sorted by sku: %s before %s", conflicts[i-1].SKU, conflicts[i].SKU)
+				}
+			}
+		})
+	}
+}
+
+func TestShopifySkuConflicts(t *testing.T) {
+	cases := []struct {
+		name  string
+		items []StockItem
+		want  map[string][]string
+	}{
+		{
+			name:  "every variant has its own sku",
+			items: []StockItem{{SKU: "MUG-BLUE", VariantID: "101"}, {SKU: "MUG-RED", VariantID: "102"}},
+			want:  map[string][]string{},
+		},
+		{
+			name: "variants of different products sharing a sku",
+			items: []StockItem{
+				{SKU: "MUG-BLUE", VariantID: "101"},
+				{SKU: "MUG-RED", VariantID: "102"},
+				{SKU: "MUG-BLUE", VariantID: "201"},
+			},
+			want: map[string][]string{"MUG-BLUE": {"101", "201"}},
+		},
+		{
+			name:  "variants without a sku",
+			items: []StockItem{{VariantID: "101"}, {VariantID: "102"}},
+			want:  map[string][]string{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := conflictSkus(t, shopifySkuConflicts("test.myshopify.com", c.items), "test.myshopify.com", "shopify")
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestEtsySkuConflicts(t *testing.T) {
+	mugs := etsyListing{Products: []etsyProduct{{ProductID: 11, Sku: "MUG-BLUE"}, {ProductID: 12, Sku: "MUG-RED"}}}
+	cases := []struct {
+		name     string
+		listings map[int]etsyListing
+		skus     map[int]string
+		want     map[string][]string
+	}{
+		{
+			name:     "every product has its own sku",
+			listings: map[int]etsyListing{1: mugs},
+			want:     map[string][]string{},
+		},
+		{
+			name: "products in different listings sharing a sku",
+			listings: map[int]etsyListing{
+				1: mugs,
+				2: {Products: []etsyProduct{{ProductID: 21, Sku: "MUG-BLUE"}}},
+			},
+			want: map[string][]string{"MUG-BLUE": {"11", "21"}},
+		},
+		{
+			name: "a deleted product keeps no sku",
+			listings: map[int]etsyListing{
+				1: mugs,
+				2: {Products: []etsyProduct{{ProductID: 21, Sku: "MUG-BLUE", IsDeleted: true}}},
+			},
+			want: map[string][]string{},
+		},
+		{
+			name:     "a sku link onto a sku another product has",
+			listings: map[int]etsyListing{1: mugs, 2: {Products: []etsyProduct{{ProductID: 21}}}},
+			skus:     map[int]string{21: "MUG-RED"},
+			want:     map[string][]string{"MUG-RED": {"12", "21"}},
+		},
+		{
+			name:     "a sku link moving a product off a shared sku",
+			listings: map[int]etsyListing{1: mugs, 2: {Products: []etsyProduct{{ProductID: 21, Sku: "MUG-RED"}}}},
+			skus:     map[int]string{21: "MUG-GREEN"},
+			want:     map[string][]string{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := conflictSkus(t, etsySkuConflicts("test.myshopify.com", c.listings, c.skus), "test.myshopify.com", "etsy")
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
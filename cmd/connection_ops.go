@@ -0,0 +1,633 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	channelShopify = "shopify"
+	channelEtsy    = "etsy"
+)
+
+// A ChannelConnection is a further store that sells the stock of a shop. Every shop has its own shopify
+// store and etsy shop (the primary connections, whose stock is kept in the stock collection); any other
+// stores sharing the same physical inventory are listed in the connections field of the shop record and
+// their stock is kept per connection in connection_stock.
+type ChannelConnection struct {
+	ID      string `bson:"id"`
+	Channel string `bson:"channel"`
+	// the store on the channel, ie. the shopify domain, the etsy shop id (resolved from the token if empty),
+	// the url of the woocommerce site or the directory watched by a file connection
+	Account string `bson:"account,omitempty"`
+	// the shop record holding the token for the store, defaults to the account for shopify and woocommerce
+	TokenFrom string `bson:"token_from,omitempty"`
+	// the shopify location whose stock is synced, defaults to the first location of each item
+	LocationID string `bson:"location_id,omitempty"`
+	// the file the reconciled levels are written to, for file connections
+	Output   string `bson:"output,omitempty"`
+	Disabled bool   `bson:"disabled,omitempty"`
+}
+
+// A ConnectionStockItem is the stock of a single item on a connection. Previous is the level the item had
+// at the end of the last run, so Current-Previous is the change made on the connection since then.
+type ConnectionStockItem struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty"`
+	ShopifyDomain   string             `bson:"shopify_domain"`
+	ConnectionID    string             `bson:"connection_id"`
+	Channel         string             `bson:"channel"`
+	ItemKey         string             `bson:"item_key"`
+	SKU             string             `bson:"sku"`
+	ItemID          string             `bson:"item_id"`
+	ParentID        string             `bson:"parent_id,omitempty"`
+	LocationID      string             `bson:"location_id,omitempty"`
+	InventoryItemID string             `bson:"inventory_item_id,omitempty"`
+	Title           string             `bson:"title,omitempty"`
+	Current         int                `bson:"curr_stock"`
+	Previous        int                `bson:"prev_stock"`
+	// the snapshot the item was read from, for channels whose changes come from comparing snapshots
+	Source    string    `bson:"source,omitempty"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+func (i ConnectionStockItem) delta() int {
+	return i.Current - i.Previous
+}
+
+// A ConnectionLevel is the stock level a run intends to write for an item on a connection
+type ConnectionLevel struct {
+	PlannedLevel    `bson:",inline"`
+	ItemKey         string `bson:"item_key"`
+	ItemID          string `bson:"item_id"`
+	ParentID        string `bson:"parent_id,omitempty"`
+	LocationID      string `bson:"location_id,omitempty"`
+	InventoryItemID string `bson:"inventory_item_id,omitempty"`
+}
+
+func newConnectionLevel(item ConnectionStockItem, quantity int, override bool) ConnectionLevel {
+	return ConnectionLevel{
+		PlannedLevel: PlannedLevel{
+			SKU:      item.SKU,
+			Previous: item.Current,
+			Quantity: quantity,
+			Override: override,
+		},
+		ItemKey:         item.ItemKey,
+		ItemID:          item.ItemID,
+		ParentID:        item.ParentID,
+		LocationID:      item.LocationID,
+		InventoryItemID: item.InventoryItemID,
+	}
+}
+
+// A ConnectionWrite is a single api request setting the stock of one or more items on a connection.
+// Target and Payload are specific to the channel, eg. the listing id and inventory PUT body for etsy.
+type ConnectionWrite struct {
+	ConnectionID string            `bson:"connection_id"`
+	Channel      string            `bson:"channel"`
+	Target       string            `bson:"target,omitempty"`
+	Payload      string            `bson:"payload,omitempty"`
+	Levels       []ConnectionLevel `bson:"levels"`
+}
+
+// A channelAdapter reads and writes the stock of a single connection
+type channelAdapter interface {
+	// fetch reads the live stock of every item on the connection
+	fetch() ([]ConnectionStockItem, error)
+	// planWrites groups levels into the requests needed to set them, it may rely on the last fetch
+	planWrites(levels []ConnectionLevel) ([]ConnectionWrite, error)
+	// applyWrite sends a single write to the channel and returns the levels the channel accepted. A
+	// channel that reports the outcome per item may accept some of the levels and still return an error.
+	applyWrite(write ConnectionWrite) ([]ConnectionLevel, error)
+}
+
+func newChannelAdapter(config Config, storename string, conn ChannelConnection, client *mongo.Client) (channelAdapter, error) {
+	switch conn.Channel {
+	case channelShopify:
+		return newShopifyConnection(conn, client)
+	case channelEtsy:
+		return newEtsyConnection(config, conn, client)
+	case channelWooCommerce:
+		return newWooCommerceConnection(conn, client)
+	case channelEbay:
+		return newEbayConnection(config, conn, client)
+	case channelFile:
+		return newFileConnection(storename, conn, client)
+	}
+	return nil, fmt.Errorf("connection %s has unknown channel %s", conn.ID, conn.Channel)
+}
+
+func getConnections(storename string, client *mongo.Client) ([]ChannelConnection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var shop struct {
+		Connections []ChannelConnection `bson:"connections"`
+	}
+	shopCollection := client.Database("etsync").Collection("shops")
+	if err := shopCollection.FindOne(ctx, bson.M{"shopify_domain": storename}).Decode(&shop); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "connection_ops",
+			"Caller": "GetConnections",
+		}).Warnf("Unable to read shop record %v", err)
+		return nil, err
+	}
+	return shop.Connections, nil
+}
+
+func getConnection(storename, id string, client *mongo.Client) (ChannelConnection, error) {
+	conns, err := getConnections(storename, client)
+	if err != nil {
+		return ChannelConnection{}, err
+	}
+	for _, c := range conns {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return ChannelConnection{}, fmt.Errorf("shop %s has no connection %s", storename, id)
+}
+
+// saveConnection adds the connection to the shop, replacing any connection with the same id
+func saveConnection(storename string, conn ChannelConnection, client *mongo.Client) error {
+	if err := removeConnection(storename, conn.ID, client); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	_, err := shopCollection.UpdateOne(ctx, bson.M{"shopify_domain": storename}, bson.M{"$push": bson.M{"connections": conn}})
+	return err
+}
+
+func removeConnection(storename, id string, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	if _, err := shopCollection.UpdateOne(ctx, bson.M{"shopify_domain": storename}, bson.M{"$pull": bson.M{"connections": bson.M{"id": id}}}); err != nil {
+		return err
+	}
+	// the changes the connection missed would otherwise be replayed on a new connection with its id
+	backlogCollection := client.Database("etsync").Collection("connection_backlog")
+	_, err := backlogCollection.DeleteMany(ctx, bson.M{"shopify_domain": storename, "connection_id": id})
+	return err
+}
+
+// getConnectionStock reads the recorded stock of every item on the connection, by item key
+func getConnectionStock(storename, connectionid string, client *mongo.Client) (map[string]ConnectionStockItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("connection_stock")
+	cursor, err := stockCollection.Find(ctx, bson.M{"shopify_domain": storename, "connection_id": connectionid})
+	if err != nil {
+		return nil, err
+	}
+	var items []ConnectionStockItem
+	if err := cursor.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	stored := make(map[string]ConnectionStockItem)
+	for _, item := range items {
+		stored[item.ItemKey] = item
+	}
+	return stored, nil
+}
+
+// reconcileConnectionStock works out the levels of the live stock read from a connection against the
+// recorded stock. Items seen before keep the level recorded at the end of the last run as their previous
+// level, new items start with no change. Items read from a snapshot carry the change between the snapshot
+// and the one before it, which is applied to the recorded level once per snapshot. The items are returned
+// with their levels set, nothing is recorded until the plan they are part of is applied.
+func reconcileConnectionStock(storename string, conn ChannelConnection, items []ConnectionStockItem, client *mongo.Client) ([]ConnectionStockItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("connection_stock")
+	now := time.Now()
+	for i, item := range items {
+		var existing ConnectionStockItem
+		filter := bson.M{"shopify_domain": storename, "connection_id": conn.ID, "item_key": item.ItemKey}
+		err := stockCollection.FindOne(ctx, filter).Decode(&existing)
+		switch {
+		case err != nil && err != mongo.ErrNoDocuments:
+			return items, err
+		case item.Source != "" && err == mongo.ErrNoDocuments:
+			// a snapshot item seen for the first time keeps the change between the last two snapshots
+		case item.Source != "" && existing.Source == item.Source:
+			// the snapshot was taken into account by an earlier run
+			item.Current = existing.Current
+			item.Previous = existing.Current
+		case item.Source != "":
+			item.Current = existing.Current + item.delta()
+			item.Previous = existing.Current
+		case err == nil:
+			item.Previous = existing.Current
+		default:
+			item.Previous = item.Current
+		}
+		item.ShopifyDomain = storename
+		item.ConnectionID = conn.ID
+		item.Channel = conn.Channel
+		item.UpdatedAt = now
+		item.ID = existing.ID
+		items[i] = item
+	}
+	return items, nil
+}
+
+// commitConnectionStock records the reconciled stock of the connections, moving their baselines on to
+// the levels read by the run
+func commitConnectionStock(items []ConnectionStockItem, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("connection_stock")
+	for _, item := range items {
+		filter := bson.M{"shopify_domain": item.ShopifyDomain, "connection_id": item.ConnectionID, "item_key": item.ItemKey}
+		if _, err := stockCollection.ReplaceOne(ctx, filter, item, options.Replace().SetUpsert(true)); err != nil {
+			log.WithFields(log.Fields{
+				"File":   "connection_ops",
+				"Caller": "CommitConnectionStock",
+			}).Errorf("Unable to record stock for %s on connection %s %v", item.ItemKey, item.ConnectionID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// setConnectionStockLevels records the levels written to a connection as both the current and previous level
+func setConnectionStockLevels(storename, connectionid string, levels []ConnectionLevel, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("connection_stock")
+	for _, l := range levels {
+		filter := bson.M{"shopify_domain": storename, "connection_id": connectionid, "item_key": l.ItemKey}
+		update := bson.M{"$set": bson.M{"curr_stock": l.Quantity, "prev_stock": l.Quantity, "updated_at": time.Now()}}
+		if _, err := stockCollection.UpdateOne(ctx, filter, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A ConnectionBacklogItem is a change to a sku that a connection missed because it could not be read
+// when the change was applied to the other stores. It is added to the connection's next write of the sku,
+// and an override replaces the level of the item as it would have done in the run it was made in.
+type ConnectionBacklogItem struct {
+	ShopifyDomain string `bson:"shopify_domain"`
+	ConnectionID  string `bson:"connection_id"`
+	SKU           string `bson:"sku"`
+	Delta         int    `bson:"delta"`
+	Override      bool   `bson:"override,omitempty"`
+	Level         int    `bson:"level,omitempty"`
+}
+
+// getConnectionBacklog returns the backlog of the shop by connection id and sku
+func getConnectionBacklog(storename string, client *mongo.Client) (map[string]map[string]ConnectionBacklogItem, error) {
+	backlog := make(map[string]map[string]ConnectionBacklogItem)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	backlogCollection := client.Database("etsync").Collection("connection_backlog")
+	cursor, err := backlogCollection.Find(ctx, bson.M{"shopify_domain": storename})
+	if err != nil {
+		return backlog, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var item ConnectionBacklogItem
+		if err := cursor.Decode(&item); err != nil {
+			return backlog, err
+		}
+		if backlog[item.ConnectionID] == nil {
+			backlog[item.ConnectionID] = make(map[string]ConnectionBacklogItem)
+		}
+		backlog[item.ConnectionID][item.SKU] = item
+	}
+	return backlog, cursor.Err()
+}
+
+// commitConnectionBacklog removes the backlog the plan's writes took up and adds the changes it leaves
+// for the connections that could not be read. A change adds to the delta already waiting for the sku and
+// an override replaces it.
+func commitConnectionBacklog(plan SyncPlan, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	backlogCollection := client.Database("etsync").Collection("connection_backlog")
+	for _, b := range plan.BacklogTaken {
+		filter := bson.M{"shopify_domain": b.ShopifyDomain, "connection_id": b.ConnectionID, "sku": b.SKU}
+		if _, err := backlogCollection.DeleteOne(ctx, filter); err != nil {
+			return err
+		}
+	}
+	for _, b := range plan.ConnectionBacklog {
+		filter := bson.M{"shopify_domain": b.ShopifyDomain, "connection_id": b.ConnectionID, "sku": b.SKU}
+		update := bson.M{"$inc": bson.M{"delta": b.Delta}}
+		if b.Override {
+			update = bson.M{"$set": bson.M{"delta": 0, "override": true, "level": b.Level}}
+		}
+		if _, err := backlogCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+			log.WithFields(log.Fields{
+				"File":       "connection_ops",
+				"Caller":     "CommitConnectionBacklog",
+				"Connection": b.ConnectionID,
+			}).Errorf("Unable to record the backlog of sku %s %v", b.SKU, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// clearConnectionBacklog drops the backlog of the skus on every connection of the shop
+func clearConnectionBacklog(storename string, skus []string, client *mongo.Client) error {
+	if len(skus) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	backlogCollection := client.Database("etsync").Collection("connection_backlog")
+	_, err := backlogCollection.DeleteMany(ctx, bson.M{"shopify_domain": storename, "sku": bson.M{"$in": skus}})
+	return err
+}
+
+// commitPlanConnections records what an applied plan read from the connections and the backlog it took
+// up or left for them
+func commitPlanConnections(plan SyncPlan, client *mongo.Client) error {
+	if err := commitConnectionStock(plan.ConnectionStock, client); err != nil {
+		return err
+	}
+	return commitConnectionBacklog(plan, client)
+}
+
+// A connectionLeg is a connection taking part in a run, with the stock read from it
+type connectionLeg struct {
+	conn    ChannelConnection
+	adapter channelAdapter
+	items   []ConnectionStockItem
+}
+
+// fetchConnectionLegs reads the stock of every enabled connection of the shop. A connection that cannot
+// be read is left out of the run, recorded as a run error and returned as missing; its own changes are
+// picked up by a later run and the changes it misses are kept in its backlog. With requireall set the
+// run stops instead, before the stock of any connection is recorded, so that no changes are lost when
+// one side of a pair is unavailable.
+func fetchConnectionLegs(config Config, run *SyncRun, storename string, requireall bool, client *mongo.Client) ([]*connectionLeg, []ChannelConnection, error) {
+	var fetched []*connectionLeg
+	var missing []ChannelConnection
+	conns, err := getConnections(storename, client)
+	if err != nil {
+		run.recordError("GetConnections", err)
+		return nil, nil, err
+	}
+	for _, conn := range conns {
+		if conn.Disabled {
+			continue
+		}
+		leg, err := fetchConnectionLeg(config, storename, conn, client)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"File":       "connection_ops",
+				"Caller":     "FetchConnectionLegs",
+				"Connection": conn.ID,
+			}).Errorf("Unable to read stock from connection %v", err)
+			err = fmt.Errorf("%s: %v", conn.ID, err)
+			if requireall {
+				return nil, nil, err
+			}
+			run.recordError("FetchConnection", err)
+			missing = append(missing, conn)
+			continue
+		}
+		fetched = append(fetched, leg)
+	}
+
+	var legs []*connectionLeg
+	for _, leg := range fetched {
+		if err := saveSkuConflicts(storename, "connection/"+leg.conn.ID, connectionSkuConflicts(storename, leg.conn, leg.items), client); err != nil {
+			run.recordError("SaveSkuConflicts", err)
+			return nil, nil, err
+		}
+		leg.items, err = reconcileConnectionStock(storename, leg.conn, leg.items, client)
+		if err != nil {
+			run.recordError("ReconcileConnectionStock", fmt.Errorf("%s: %v", leg.conn.ID, err))
+			if requireall {
+				return nil, nil, err
+			}
+			missing = append(missing, leg.conn)
+			continue
+		}
+		legs = append(legs, leg)
+	}
+	return legs, missing, nil
+}
+
+func fetchConnectionLeg(config Config, storename string, conn ChannelConnection, client *mongo.Client) (*connectionLeg, error) {
+	adapter, err := newChannelAdapter(config, storename, conn, client)
+	if err != nil {
+		return nil, err
+	}
+	items, err := adapter.fetch()
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"File":       "connection_ops",
+		"Caller":     "FetchConnectionLeg",
+		"Connection": conn.ID,
+	}).Infof("Read %d items from %s connection", len(items), conn.Channel)
+	return &connectionLeg{conn: conn, adapter: adapter, items: items}, nil
+}
+
+// planConnectionBacklog adds the changes the missing connections did not receive to the plan: every
+// change seen on the primary stores and the legs, and the levels set through the app
+func planConnectionBacklog(plan *SyncPlan, storename string, missing []ChannelConnection, legs []*connectionLeg, others map[string]int, overrideStock map[string]int, quarantined map[string]bool) {
+	total := legDeltas(legs)
+	for sku, d := range others {
+		total[sku] += d
+	}
+	for _, conn := range missing {
+		for sku, d := range total {
+			if _, ok := overrideStock[sku]; ok || d == 0 || sku == "" || quarantined[sku] {
+				continue
+			}
+			plan.ConnectionBacklog = append(plan.ConnectionBacklog, ConnectionBacklogItem{ShopifyDomain: storename, ConnectionID: conn.ID, SKU: sku, Delta: d})
+		}
+		for sku, level := range overrideStock {
+			if quarantined[sku] {
+				continue
+			}
+			plan.ConnectionBacklog = append(plan.ConnectionBacklog, ConnectionBacklogItem{ShopifyDomain: storename, ConnectionID: conn.ID, SKU: sku, Override: true, Level: level})
+		}
+	}
+}
+
+// legDeltas sums the stock changes made on the legs since the last run by sku
+func legDeltas(legs []*connectionLeg) map[string]int {
+	deltas := make(map[string]int)
+	for _, leg := range legs {
+		for _, item := range leg.items {
+			if item.SKU != "" && item.delta() != 0 {
+				deltas[item.SKU] += item.delta()
+			}
+		}
+	}
+	return deltas
+}
+
+// planConnectionWrites adds the writes for every leg to the plan. Each item is set to its current level
+// plus the changes made to the sku everywhere else: on the other legs and in the changes passed in, which
+// are the changes seen on the stores that are not legs (the primary shopify store and etsy shop), plus
+// the backlog of changes the leg missed in earlier runs. The backlog of every leg is taken up by the plan.
+func planConnectionWrites(plan *SyncPlan, legs []*connectionLeg, others map[string]int, overrideStock map[string]int, quarantined map[string]bool, backlog map[string]map[string]ConnectionBacklogItem) error {
+	total := legDeltas(legs)
+	for sku, d := range others {
+		total[sku] += d
+	}
+	if plan.ConnectionItems == nil {
+		plan.ConnectionItems = make(map[string]int)
+	}
+	if plan.ConnectionStocked == nil {
+		plan.ConnectionStocked = make(map[string]int)
+	}
+	for _, leg := range legs {
+		plan.ConnectionStock = append(plan.ConnectionStock, leg.items...)
+		missed := backlog[leg.conn.ID]
+		for _, b := range missed {
+			plan.BacklogTaken = append(plan.BacklogTaken, b)
+		}
+		var levels []ConnectionLevel
+		for _, item := range leg.items {
+			if item.SKU == "" || quarantined[item.SKU] {
+				continue
+			}
+			plan.ConnectionItems[leg.conn.ID]++
+			if stockset, ok := overrideStock[item.SKU]; ok {
+				levels = append(levels, newConnectionLevel(item, stockset, true))
+				continue
+			}
+			d := total[item.SKU] - item.delta()
+			base := item.Current
+			b, hasbacklog := missed[item.SKU]
+			if hasbacklog {
+				d += b.Delta
+				if b.Override {
+					// the level set through the app while the connection could not be read
+					base = b.Level
+				}
+			}
+			if d == 0 && !hasbacklog {
+				if item.Current > 0 {
+					plan.ConnectionStocked[leg.conn.ID]++
+				}
+				continue
+			}
+			quantity := base + d
+			if quantity < 0 {
+				quantity = 0
+			}
+			if quantity != item.Current {
+				levels = append(levels, newConnectionLevel(item, quantity, hasbacklog && b.Override))
+			} else if item.Current > 0 {
+				plan.ConnectionStocked[leg.conn.ID]++
+			}
+		}
+		if len(levels) == 0 {
+			continue
+		}
+		writes, err := leg.adapter.planWrites(levels)
+		if err != nil {
+			return fmt.Errorf("connection %s: %v", leg.conn.ID, err)
+		}
+		for i := range writes {
+			writes[i].ConnectionID = leg.conn.ID
+			writes[i].Channel = leg.conn.Channel
+		}
+		plan.ConnectionWrites = append(plan.ConnectionWrites, writes...)
+	}
+	return nil
+}
+
+// applyConnectionWrite sends a write to its connection and records the new stock levels
+func applyConnectionWrite(adapter channelAdapter, storename string, run *SyncRun, write ConnectionWrite, client *mongo.Client) error {
+	accepted, err := adapter.applyWrite(write)
+	if len(accepted) == 0 {
+		return err
+	}
+	// the levels the channel accepted are recorded even when it rejected others in the same write,
+	// otherwise the next run would read them back as changes made on the connection
+	applied := write
+	applied.Levels = accepted
+	log.WithFields(log.Fields{
+		"File":       "connection_ops",
+		"Caller":     "ApplyConnectionWrite",
+		"Connection": write.ConnectionID,
+	}).Infof("Set stock for %d of %d items on %s connection", len(accepted), len(write.Levels), write.Channel)
+	if err := recordRunChanges(run, connectionRunChanges(storename, run.ID, applied), client); err != nil {
+		log.WithFields(log.Fields{
+			"File":    "connection_ops",
+			"Caller":  "ApplyConnectionWrite",
+			"Calling": "RecordRunChanges",
+		}).Errorf("failed to record connection changes for run %v", err)
+	}
+	if seterr := setConnectionStockLevels(storename, write.ConnectionID, accepted, client); seterr != nil {
+		return seterr
+	}
+	return err
+}
+
+// connectionAdapters creates the adapter for each connection once per run
+type connectionAdapters struct {
+	config    Config
+	storename string
+	client    *mongo.Client
+	adapters  map[string]channelAdapter
+}
+
+func newConnectionAdapters(config Config, storename string, client *mongo.Client) *connectionAdapters {
+	return &connectionAdapters{config: config, storename: storename, client: client, adapters: make(map[string]channelAdapter)}
+}
+
+func (c *connectionAdapters) get(id string) (channelAdapter, error) {
+	if adapter, ok := c.adapters[id]; ok {
+		return adapter, nil
+	}
+	conn, err := getConnection(c.storename, id, c.client)
+	if err != nil {
+		return nil, err
+	}
+	adapter, err := newChannelAdapter(c.config, c.storename, conn, c.client)
+	if err != nil {
+		return nil, err
+	}
+	c.adapters[id] = adapter
+	return adapter, nil
+}
+
+// A snapshotAdapter is a channel read from snapshots, whose items carry the change between two snapshots
+// rather than a level of their own. Their level is the one reconciled with the recorded stock.
+type snapshotAdapter interface {
+	reconcile(items []ConnectionStockItem) ([]ConnectionStockItem, error)
+}
+
+// liveConnectionLevels reads the live level of every item on the connection keyed by item key. For a
+// snapshot channel it is the level a run would reconcile the latest snapshot to, which is what the plans
+// and run changes of the connection hold.
+func liveConnectionLevels(adapter channelAdapter) (map[string]int, error) {
+	items, err := adapter.fetch()
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := adapter.(snapshotAdapter); ok {
+		if items, err = s.reconcile(items); err != nil {
+			return nil, err
+		}
+	}
+	live := make(map[string]int)
+	for _, item := range items {
+		live[item.ItemKey] = item.Current
+	}
+	return live, nil
+}
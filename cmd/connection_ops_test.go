@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+// stubAdapter plans a single write holding every level
+type stubAdapter struct{}
+
+func (stubAdapter) fetch() ([]ConnectionStockItem, error) { return nil, nil }
+
+func (stubAdapter) planWrites(levels []ConnectionLevel) ([]ConnectionWrite, error) {
+	return []ConnectionWrite{{Levels: levels}}, nil
+}
+
+func (stubAdapter) applyWrite(write ConnectionWrite) ([]ConnectionLevel, error) {
+	return write.Levels, nil
+}
+
+func TestConnectionBacklog(t *testing.T) {
+	woo := ChannelConnection{ID: "woo", Channel: channelWooCommerce}
+	ebay := ChannelConnection{ID: "ebay", Channel: channelEbay}
+	leg := &connectionLeg{conn: ebay, adapter: stubAdapter{}, items: []ConnectionStockItem{
+		{ItemKey: "1", SKU: "MUG", Current: 4, Previous: 5},
+		{ItemKey: "2", SKU: "BOWL", Current: 8, Previous: 8},
+	}}
+	primary := map[string]int{"MUG": -2, "BOWL": 0, "TILE": 3, "CUP": -1}
+	overrides := map[string]int{"PLATE": 6}
+
+	// the woocommerce store cannot be read, so it is left every change the run applies elsewhere
+	var plan SyncPlan
+	planConnectionBacklog(&plan, "shop", []ChannelConnection{woo}, []*connectionLeg{leg}, primary, overrides, map[string]bool{"CUP": true})
+	got := make(map[string]ConnectionBacklogItem)
+	for _, b := range plan.ConnectionBacklog {
+		if b.ConnectionID != "woo" || b.ShopifyDomain != "shop" {
+			t.Errorf("backlog for the wrong connection %+v", b)
+		}
+		got[b.SKU] = b
+	}
+	if len(got) != 3 || got["MUG"].Delta != -3 || got["TILE"].Delta != 3 || !got["PLATE"].Override || got["PLATE"].Level != 6 {
+		t.Errorf("unexpected backlog %+v", got)
+	}
+
+	// once it can be read again the backlog is added to the changes of that run
+	wooleg := &connectionLeg{conn: woo, adapter: stubAdapter{}, items: []ConnectionStockItem{
+		{ItemKey: "10", SKU: "MUG", Current: 9, Previous: 10},
+		{ItemKey: "11", SKU: "TILE", Current: 2, Previous: 2},
+		{ItemKey: "12", SKU: "PLATE", Current: 1, Previous: 1},
+		{ItemKey: "13", SKU: "BOWL", Current: 5, Previous: 5},
+	}}
+	backlog := map[string]map[string]ConnectionBacklogItem{"woo": got}
+	plan = SyncPlan{}
+	if err := planConnectionWrites(&plan, []*connectionLeg{wooleg}, map[string]int{"BOWL": -1}, nil, nil, backlog); err != nil {
+		t.Fatal(err)
+	}
+	levels := make(map[string]ConnectionLevel)
+	for _, w := range plan.ConnectionWrites {
+		for _, l := range w.Levels {
+			levels[l.SKU] = l
+		}
+	}
+	for sku, want := range map[string]int{"MUG": 6, "TILE": 5, "PLATE": 6, "BOWL": 4} {
+		if levels[sku].Quantity != want {
+			t.Errorf("%s set to %d, want %d", sku, levels[sku].Quantity, want)
+		}
+	}
+	if !levels["PLATE"].Override || levels["MUG"].Override {
+		t.Errorf("only the level set through the app should count as an override, got %+v", levels)
+	}
+	if len(plan.BacklogTaken) != 3 {
+		t.Errorf("expected the plan to take up the 3 backlog items, got %+v", plan.BacklogTaken)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Tokens are stored using envelope encryption: each value is sealed with its own random data key using
+// AES-GCM, and the data key is sealed with a key encryption key from the keyring. The stored value is
+//
+//	enc:v2:<key id>:<sealed data key>:<sealed value>
+//
+// so that keys can be rotated by adding a new key, making it active and running encrypt-tokens. Both seals
+// take the shop and field the value is stored in as additional data, so a value copied to another shop
+// record or field does not decrypt. v1 values were sealed without it and are still read.
+// Values without a prefix are plain text written before encryption was enabled and are returned as-is.
+const (
+	encryptedTokenPrefix   = "enc:v2:"
+	encryptedTokenPrefixV1 = "enc:v1:"
+)
+
+// the shop record fields holding tokens that are encrypted at rest
+var encryptedTokenFields = []string{"accessToken", "etsy_access_token", "etsy_refresh_token", "woo_consumer_secret", "ebay_access_token", "ebay_refresh_token"}
+
+type tokenKeyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// tokenKeys is the keyring used to encrypt and decrypt tokens, when it is empty tokens are stored in plain text
+var tokenKeys = &tokenKeyring{keys: map[string][]byte{}}
+
+// initTokenEncryption loads the keyring from TOKEN_ENCRYPTION_KEYS and TOKEN_ENCRYPTION_KEY_FILE. Both hold
+// one or more key id:base64 key pairs (comma or newline separated), TOKEN_ENCRYPTION_ACTIVE_KEY selects the
+// key used for new values and defaults to the first key listed.
+func initTokenEncryption(config Config) error {
+	keyring, err := loadTokenKeyring(config)
+	if err != nil {
+		return err
+	}
+	tokenKeys = keyring
+	return nil
+}
+
+func loadTokenKeyring(config Config) (*tokenKeyring, error) {
+	keyring := &tokenKeyring{keys: map[string][]byte{}}
+	specs := config.TOKEN_ENCRYPTION_KEYS
+	if config.TOKEN_ENCRYPTION_KEY_FILE != "" {
+		contents, err := ioutil.ReadFile(config.TOKEN_ENCRYPTION_KEY_FILE)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token key file: %v", err)
+		}
+		specs = specs + "\n" + string(contents)
+	}
+	var order []string
+	for _, spec := range strings.FieldsFunc(specs, func(r rune) bool { return r == ',' || r == '\n' }) {
+		spec = strings.TrimSpace(spec)
+		if spec == "" || strings.HasPrefix(spec, "#") {
+			continue
+		}
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("token key must be given as <key id>:<base64 key>")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("token key %s is not valid base64: %v", parts[0], err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("token key %s must be 32 bytes, got %d", parts[0], len(key))
+		}
+		keyring.keys[parts[0]] = key
+		order = append(order, parts[0])
+	}
+	if len(order) == 0 {
+		return keyring, nil
+	}
+	keyring.active = order[0]
+	if config.TOKEN_ENCRYPTION_ACTIVE_KEY != "" {
+		if _, ok := keyring.keys[config.TOKEN_ENCRYPTION_ACTIVE_KEY]; !ok {
+			return nil, fmt.Errorf("active token key %s is not in the keyring", config.TOKEN_ENCRYPTION_ACTIVE_KEY)
+		}
+		keyring.active = config.TOKEN_ENCRYPTION_ACTIVE_KEY
+	}
+	return keyring, nil
+}
+
+func (k *tokenKeyring) enabled() bool {
+	return k.active != ""
+}
+
+// tokenAAD is the additional data binding a value to the shop record and field it is stored in
+func tokenAAD(storename, field string) []byte {
+	return []byte(storename + "\x00" + field)
+}
+
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func unseal(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed value is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+// encrypt seals the value with the active key, bound to the shop and field it is stored in. Empty values
+// and values when no keys are configured are returned unchanged.
+func (k *tokenKeyring) encrypt(storename, field, value string) (string, error) {
+	if value == "" || !k.enabled() {
+		return value, nil
+	}
+	aad := tokenAAD(storename, field)
+	datakey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, datakey); err != nil {
+		return "", err
+	}
+	sealedkey, err := seal(k.keys[k.active], datakey, aad)
+	if err != nil {
+		return "", err
+	}
+	sealedvalue, err := seal(datakey, []byte(value), aad)
+	if err != nil {
+		return "", err
+	}
+	return encryptedTokenPrefix + k.active + ":" +
+		base64.StdEncoding.EncodeToString(sealedkey) + ":" +
+		base64.StdEncoding.EncodeToString(sealedvalue), nil
+}
+
+// decrypt opens a value sealed by encrypt with whichever key it was sealed with, for the shop and field
+// it was read from. Plain text values are returned unchanged.
+func (k *tokenKeyring) decrypt(storename, field, value string) (string, error) {
+	token, err := parseEncryptedToken(value)
+	if err != nil || token.kid == "" {
+		return value, err
+	}
+	kek, ok := k.keys[token.kid]
+	if !ok {
+		return "", fmt.Errorf("token was encrypted with key %s which is not in the keyring", token.kid)
+	}
+	var aad []byte
+	if token.bound {
+		aad = tokenAAD(storename, field)
+	}
+	datakey, err := unseal(kek, token.sealedkey, aad)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt data key with key %s: %v", token.kid, err)
+	}
+	plaintext, err := unseal(datakey, token.sealedvalue, aad)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt token: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// An encryptedToken is a stored value split into its parts, the key id is empty for a plain text value.
+// bound is set for values sealed with the shop and field as additional data.
+type encryptedToken struct {
+	kid         string
+	bound       bool
+	sealedkey   []byte
+	sealedvalue []byte
+}
+
+func parseEncryptedToken(value string) (encryptedToken, error) {
+	var token encryptedToken
+	switch {
+	case strings.HasPrefix(value, encryptedTokenPrefix):
+		token.bound = true
+		value = strings.TrimPrefix(value, encryptedTokenPrefix)
+	case strings.HasPrefix(value, encryptedTokenPrefixV1):
+		value = strings.TrimPrefix(value, encryptedTokenPrefixV1)
+	default:
+		return token, nil
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return token, fmt.Errorf("malformed encrypted token")
+	}
+	var err error
+	if token.sealedkey, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return token, fmt.Errorf("malformed encrypted token: %v", err)
+	}
+	if token.sealedvalue, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return token, fmt.Errorf("malformed encrypted token: %v", err)
+	}
+	token.kid = parts[0]
+	return token, nil
+}
+
+// needsReencrypt reports whether a stored value is plain text, sealed with a key other than the active one
+// or sealed without being bound to its shop and field
+func (k *tokenKeyring) needsReencrypt(value string) bool {
+	if value == "" || !k.enabled() {
+		return false
+	}
+	token, err := parseEncryptedToken(value)
+	return err == nil && (token.kid != k.active || !token.bound)
+}
+
+// encryptToken seals a token to be stored in field of the shop record
+func encryptToken(storename, field, value string) (string, error) {
+	return tokenKeys.encrypt(storename, field, value)
+}
+
+// decryptToken opens a token read from field of the shop record
+func decryptToken(storename, field, value string) (string, error) {
+	return tokenKeys.decrypt(storename, field, value)
+}
+
+// migrateTokenEncryption encrypts the plain text tokens in every shop record and re-encrypts those sealed
+// with a key that is no longer the active key. Each record is only updated while its tokens still hold
+// the values read, and the etsy tokens under the refresh lock, so a token refreshed in the meantime is
+// never overwritten with the old one. It returns the number of shop records updated.
+func migrateTokenEncryption(config Config, dryrun bool, client *mongo.Client) (int, error) {
+	if !tokenKeys.enabled() {
+		return 0, fmt.Errorf("no token encryption keys are configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	cursor, err := shopCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	tokens := newEtsyTokenManager(config, client)
+	updated := 0
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return updated, err
+		}
+		storename, _ := doc["shopify_domain"].(string)
+		if storename == "" {
+			continue
+		}
+		if dryrun {
+			if len(tokenFieldsToReencrypt(doc)) > 0 {
+				updated++
+			}
+			continue
+		}
+		migrated, err := migrateShopTokens(storename, tokens, client)
+		if err != nil {
+			return updated, fmt.Errorf("shop %s: %v", storename, err)
+		}
+		if migrated {
+			updated++
+		}
+	}
+	return updated, cursor.Err()
+}
+
+// tokenFieldsToReencrypt returns the token fields of a shop record that need encrypting with the active key
+func tokenFieldsToReencrypt(doc bson.M) []string {
+	var fields []string
+	for _, field := range encryptedTokenFields {
+		if value, ok := doc[field].(string); ok && tokenKeys.needsReencrypt(value) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// migrateShopTokens re-encrypts the tokens of one shop record, holding its etsy refresh lock and only
+// updating the record if the tokens have not changed since they were read
+func migrateShopTokens(storename string, tokens *etsyTokenManager, client *mongo.Client) (bool, error) {
+	acquired, err := tokens.acquireRefreshLock(storename)
+	if err != nil {
+		return false, err
+	}
+	if !acquired {
+		log.WithFields(log.Fields{
+			"File":   "crypto_ops",
+			"Caller": "MigrateShopTokens",
+			"Shop":   storename,
+		}).Warn("Etsy token refresh in progress, skipping the shop, run encrypt-tokens again to encrypt it")
+		return false, nil
+	}
+	defer tokens.releaseRefreshLock(storename)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	var doc bson.M
+	if err := shopCollection.FindOne(ctx, bson.M{"shopify_domain": storename}).Decode(&doc); err != nil {
+		return false, err
+	}
+	fields := tokenFieldsToReencrypt(doc)
+	if len(fields) == 0 {
+		return false, nil
+	}
+	filter := bson.M{"_id": doc["_id"]}
+	set := bson.M{}
+	for _, field := range fields {
+		value := doc[field].(string)
+		plaintext, err := tokenKeys.decrypt(storename, field, value)
+		if err != nil {
+			return false, fmt.Errorf("field %s: %v", field, err)
+		}
+		if set[field], err = tokenKeys.encrypt(storename, field, plaintext); err != nil {
+			return false, err
+		}
+		filter[field] = value
+	}
+	log.WithFields(log.Fields{
+		"File":   "crypto_ops",
+		"Caller": "MigrateShopTokens",
+		"Shop":   storename,
+	}).Infof("Encrypting %d token fields with key %s", len(set), tokenKeys.active)
+	result, err := shopCollection.UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		return false, err
+	}
+	if result.MatchedCount == 0 {
+		log.WithFields(log.Fields{
+			"File":   "crypto_ops",
+			"Caller": "MigrateShopTokens",
+			"Shop":   storename,
+		}).Warn("Tokens changed while they were being encrypted, run encrypt-tokens again to encrypt them")
+		return false, nil
+	}
+	return true, nil
+}
@@ -36,13 +36,22 @@ type StockItem struct {
 	EtsyItemInitialised    bool               `bson:"e_item_initialised"`
 	OverrideStockRequested bool               `bson:"override_stock_requested"`
 	OverrideStockLevel     int                `bson:"override_stock_level"`
+	EtsySkuSyncRequested   bool               `bson:"e_sku_sync_requested"`
+	SkuQuarantined         bool               `bson:"sku_quarantined"`
+	ShopifyPrice           string             `bson:"s_price,omitempty"`
+	ShopifyCompareAtPrice  string             `bson:"s_compare_at_price,omitempty"`
+	EtsyPrice              string             `bson:"e_price,omitempty"`
+	EtsyCurrency           string             `bson:"e_currency,omitempty"`
 }
 
 type StockReconciliationDelta struct {
 	EtsyDelta         map[int64]int  `json:"etsy_delta"`
 	ShopifyDelta      map[string]int `json:"shopify_delta"`
+	EtsySkuDelta      map[string]int `json:"etsy_sku_delta"` // the etsy stock changes by sku, for the further connections
 	EstyHasChanges    bool           `json:"etsyhaschanges"`
 	ShopifyHasChanges bool           `json:"shopifyhaschanges"`
+	// the etsy prices a price sync sets, by product id
+	EtsyPrice map[int64]etsyMoney `json:"-"`
 }
 
 func createKeyValuePairs(m primitive.M) string {
@@ -83,58 +92,51 @@ func getstoretoken(storename string, client *mongo.Client) string {
 		"File":   "db_ops",
 		"Caller": "GetStoreToken",
 	}).Info("Got shop record from database for shopify token")
-	return fmt.Sprintf("%v", doc["accessToken"])
+	token, err := decryptToken(storename, "accessToken", fmt.Sprintf("%v", doc["accessToken"]))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "db_ops",
+			"Caller": "GetStoreToken",
+		}).Error(err)
+		return ""
+	}
+	return token
 }
 
-func getetsytoken(config Config, client *mongo.Client) (etsytoken, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
+// getetsytoken returns a usable etsy token for the shop, refreshing it through the token manager
+// if it is close to expiry
+func getetsytoken(storename string, config Config, client *mongo.Client) (etsytoken, error) {
+	return etsyTokens(config, client).Token(storename)
+}
+
+func readEtsyToken(storename string, client *mongo.Client) (etsytoken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
 	var token etsytoken
 	collection := client.Database("etsync").Collection("shops")
-	filter := bson.D{{"shopify_domain", *shopname}}
+	filter := bson.M{"shopify_domain": storename}
 	if err := collection.FindOne(ctx, filter).Decode(&token); err != nil {
 		log.WithFields(log.Fields{
 			"File":   "db_ops",
-			"Caller": "GetEtsyToken",
+			"Caller": "ReadEtsyToken",
 		}).Warn(err)
 		return etsytoken{}, err
 	}
 	log.WithFields(log.Fields{
 		"File":   "db_ops",
-		"Caller": "GetEtsyToken",
-	}).Info("Got shop record from database for etsy token")
-
-	if token.EtsyOnBoarded && (time.Now().Add(10 * time.Minute).Before(token.EtsyTokenExpires)) {
-		// etsy has been onboarded & the etsy accesscode has not expired
-		log.Info("Etsy token has greater than 10 minutes ttl, reusing current token")
-		return token, nil
-	} else {
-		log.WithFields(log.Fields{
-			"File":   "db_ops",
-			"Caller": "GetEtsyToken",
-		}).Info("New Etsy token required, sending request to etsy API")
-		rtoken, err := getEtsyTokenFromAPI(config.ETSY_CLIENT_ID, config.ETSY_REDIRECT_URI, token)
-		if err != nil {
-			return etsytoken{}, err
-		}
-		rtoken.EtsyOnBoarded = true
-		rtoken.ShopifyDomain = *shopname // if this is a new token from etsy API then it won't have the shop
-		log.WithFields(log.Fields{
-			"File":   "db_ops",
-			"Caller": "GetEtsyToken",
-		}).Infof("Token retrieved from etsy api for %s with expiration %v", rtoken.ShopifyDomain, rtoken.EtsyTokenExpires)
-
-		if err := writeEtsyToken(*shopname, rtoken, client); err != nil {
-			log.WithFields(log.Fields{
-				"File":   "db_ops",
-				"Caller": "GetEtsyToken",
-			}).Errorf("Unable to store the etsy token in database! %v", err)
-			return etsytoken{}, err
-		}
-		token = rtoken
+		"Caller": "ReadEtsyToken",
+	}).Debug("Got shop record from database for etsy token")
+	token.storedRefreshToken = token.EtsyRefreshToken
+	var err error
+	if token.EtsyAccessToken, err = decryptToken(storename, "etsy_access_token", token.EtsyAccessToken); err != nil {
+		return etsytoken{}, err
+	}
+	if token.EtsyRefreshToken, err = decryptToken(storename, "etsy_refresh_token", token.EtsyRefreshToken); err != nil {
+		return etsytoken{}, err
 	}
 	return token, nil
-
 }
+
 func getOverrides(storename string, client *mongo.Client) (map[string]int, error) {
 
 	overrides := make(map[string]int)
@@ -226,19 +228,35 @@ func getShopifyStockItem(storename, VariantId string, client *mongo.Client) (Sto
 }
 
 func getShopifyStockItemBySku(storename, Sku string, client *mongo.Client) (StockItem, error) {
-	var item StockItem
+	var items []StockItem
 	ctx, _ := context.WithTimeout(context.Background(), 300*time.Second)
 	stockCollection := client.Database("etsync").Collection("stock")
 	filter := bson.D{{"shopify_domain", storename}, {"sku", Sku}}
 
-	if err := stockCollection.FindOne(ctx, filter).Decode(&item); err != nil {
+	// fetch up to two records so that a sku shared by more than one variant is reported rather than
+	// picking an arbitrary item to write stock to
+	cursor, err := stockCollection.Find(ctx, filter, options.Find().SetLimit(2))
+	if err != nil {
 		log.WithFields(log.Fields{
 			"File":   "db_ops",
 			"Caller": "GetShopifyStockItemBySku",
-		}).Infof("Error writing Etsy shop details %v", err)
+		}).Infof("Error getting stock item by sku %v", err)
 		return StockItem{}, err
 	}
-	return item, nil
+	if err := cursor.All(ctx, &items); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "db_ops",
+			"Caller": "GetShopifyStockItemBySku",
+		}).Infof("Error decoding stock item by sku %v", err)
+		return StockItem{}, err
+	}
+	if len(items) == 0 {
+		return StockItem{}, mongo.ErrNoDocuments
+	}
+	if len(items) > 1 {
+		return StockItem{}, fmt.Errorf("sku %s is shared by more than one stock item", Sku)
+	}
+	return items[0], nil
 
 }
 
@@ -247,14 +265,22 @@ func writeEtsyToken(storename string, token etsytoken, client *mongo.Client) err
 		"File":   "db_ops",
 		"Caller": "WriteEtsyToken",
 	}).Debug("Writing the etsy token to DB")
+	accesstoken, err := encryptToken(storename, "etsy_access_token", token.EtsyAccessToken)
+	if err != nil {
+		return err
+	}
+	refreshtoken, err := encryptToken(storename, "etsy_refresh_token", token.EtsyRefreshToken)
+	if err != nil {
+		return err
+	}
 	ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
 	shop_collection := client.Database("etsync").Collection("shops")
 	filter := bson.D{{"shopify_domain", storename}}
 	update := bson.M{
 		"$set": bson.M{
 			"etsyOnBoarded":      token.EtsyOnBoarded,
-			"etsy_access_token":  token.EtsyAccessToken,
-			"etsy_refresh_token": token.EtsyRefreshToken,
+			"etsy_access_token":  accesstoken,
+			"etsy_refresh_token": refreshtoken,
 			"etsy_token_expires": token.EtsyTokenExpires,
 		},
 	}
@@ -306,7 +332,7 @@ func saveEtsyShop(storename string, etsy_shop etsyShop, client *mongo.Client) er
 // This should be returned as a struct with two independent sets of actions:
 // 1. a map of productid -> delta which gets applied to the Etsy API
 // 2. a map of shopify variant Ids -> delta which gets applied to Shopify API
-func saveEtsyProducts(storename string, products []etsyProduct, eSkusToSet map[int]string, overrideStock map[string]int, client *mongo.Client) (StockReconciliationDelta, error) {
+func saveEtsyProducts(storename string, products []etsyProduct, eSkusToSet map[int]string, overrideStock map[string]int, quarantined map[string]bool, client *mongo.Client) (StockReconciliationDelta, error) {
 	ctx, _ := context.WithTimeout(context.Background(), 300*time.Second)
 	var stockdelta StockReconciliationDelta
 	if len(overrideStock) > 0 {
@@ -319,9 +345,18 @@ func saveEtsyProducts(storename string, products []etsyProduct, eSkusToSet map[i
 	}
 	etsyDelta := make(map[int64]int)
 	shopifyDelta := make(map[string]int)
+	etsySkuDelta := make(map[string]int)
 	var existingRecord StockItem
 	stockCollection := client.Database("etsync").Collection("stock")
 	for _, p := range products {
+		if len(p.Offerings) == 0 {
+			// the product has no quantity to record, every read of its offering below needs one
+			log.WithFields(log.Fields{
+				"File":   "db_ops",
+				"Caller": "SaveEtsyProducts",
+			}).Warnf("Skipping product %d of listing %d as it has no offerings", p.ProductID, p.ListingID)
+			continue
+		}
 		var vdesc []string
 		for _, pv := range p.PropertyValues {
 			vstring := fmt.Sprintf("%s: %s", pv.PropertyName, strings.Join(pv.Values, "-"))
@@ -356,6 +391,15 @@ func saveEtsyProducts(storename string, products []etsyProduct, eSkusToSet map[i
 				"Caller": "SaveEtsyProducts",
 			}).Debugf("Sku for %d should be %s", p.ProductID, skutoset)
 		}
+		if quarantined[skutoset] {
+			// the sku is shared by more than one item so we can't tell which record this product belongs to
+			log.WithFields(log.Fields{
+				"File":   "db_ops",
+				"Caller": "SaveEtsyProducts",
+				"Sku":    skutoset,
+			}).Warnf("Skipping product %d as its sku is quarantined", p.ProductID)
+			continue
+		}
 		log.WithFields(log.Fields{
 			"File":   "db_ops",
 			"Caller": "SaveEtsyProducts",
@@ -370,6 +414,10 @@ func saveEtsyProducts(storename string, products []etsyProduct, eSkusToSet map[i
 			"e_product_id":            p.ProductID,
 			"e_variation_description": strings.Join(vdesc, ", "),
 		}
+		if price, err := p.Offerings[0].Price.decimal(); err == nil {
+			updateRecord["e_price"] = price
+			updateRecord["e_currency"] = p.Offerings[0].Price.CurrencyCode
+		}
 		log.WithFields(log.Fields{
 			"File":       "db_ops",
 			"Caller":     "SaveEtsyProducts",
@@ -443,6 +491,7 @@ func saveEtsyProducts(storename string, products []etsyProduct, eSkusToSet map[i
 				}).Debugf("Record has changes in etsy current %d previous %d", p.Offerings[0].Quantity, existingRecord.EtsyQuantity)
 				stockdelta.ShopifyHasChanges = true
 				shopifyDelta[existingRecord.VariantID] = (p.Offerings[0].Quantity - existingRecord.EtsyQuantity)
+				etsySkuDelta[skutoset] += (p.Offerings[0].Quantity - existingRecord.EtsyQuantity)
 			}
 		}
 		update := bson.M{
@@ -458,6 +507,7 @@ func saveEtsyProducts(storename string, products []etsyProduct, eSkusToSet map[i
 	}
 	stockdelta.EtsyDelta = etsyDelta
 	stockdelta.ShopifyDelta = shopifyDelta
+	stockdelta.EtsySkuDelta = etsySkuDelta
 
 	log.WithFields(log.Fields{
 		"File":   "db_ops",
@@ -466,15 +516,18 @@ func saveEtsyProducts(storename string, products []etsyProduct, eSkusToSet map[i
 	return stockdelta, nil
 }
 
-func setEtsyStockLevelForProducts(storename string, products []EtsyProductUpdate, client *mongo.Client) error {
+func setEtsyStockLevelForProducts(storename string, levels []PlannedLevel, client *mongo.Client) error {
 	ctx, _ := context.WithTimeout(context.Background(), 300*time.Second)
 	stockCollection := client.Database("etsync").Collection("stock")
-	for _, item := range products {
-		filter := bson.M{"sku": item.Sku, "shopify_domain": storename}
+	for _, item := range levels {
+		filter := bson.M{"sku": item.SKU, "shopify_domain": storename}
+		if item.SKU == "" {
+			filter = bson.M{"e_product_id": item.ProductID, "shopify_domain": storename}
+		}
 		update := bson.M{
 			"$set": bson.M{
-				"e_curr_stock": item.Offerings[0].Quantity,
-				"e_prev_stock": item.Offerings[0].Quantity,
+				"e_curr_stock": item.Quantity,
+				"e_prev_stock": item.Quantity,
 			},
 		}
 		opts := options.FindOneAndUpdate().SetUpsert(false)
@@ -561,6 +614,8 @@ func setshopstock(storename string, items []StockItem, client *mongo.Client) err
 					"sku":                 item.SKU,
 					"s_variant_id":        item.VariantID,
 					"s_variant_name":      item.VariantName,
+					"s_price":             item.ShopifyPrice,
+					"s_compare_at_price":  item.ShopifyCompareAtPrice,
 				},
 			}
 		}
@@ -596,3 +651,33 @@ func setshopstock(storename string, items []StockItem, client *mongo.Client) err
 
 	return nil
 }
+
+// getShopifyStockDeltas returns the shopify stock changes since the last run by sku
+func getShopifyStockDeltas(storename string, client *mongo.Client) (map[string]int, error) {
+	deltas := make(map[string]int)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	filter := bson.M{
+		"shopify_domain": storename,
+		"sku":            bson.M{"$exists": true, "$ne": ""},
+		"$expr":          bson.M{"$ne": bson.A{"$s_curr_stock", "$s_prev_stock"}},
+	}
+	cursor, err := stockCollection.Find(ctx, filter)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "db_ops",
+			"Caller": "GetShopifyStockDeltas",
+		}).Errorf("Error getting shopify stock changes %v", err)
+		return deltas, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var item StockItem
+		if err := cursor.Decode(&item); err != nil {
+			return deltas, err
+		}
+		deltas[item.SKU] += item.Available - item.PriorAvailable
+	}
+	return deltas, cursor.Err()
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const channelEbay = "ebay"
+
+const ebayScope = "https://api.ebay.com/oauth/api_scope/sell.inventory"
+
+// the largest page of inventory items and the most skus bulk_update_price_quantity accepts
+const ebayPageSize = 100
+const ebayBatchSize = 25
+
+// ebaytoken is the ebay user token stored on a shop record, encrypted like the etsy token. Unlike etsy,
+// ebay refresh tokens are long lived and are not replaced when the access token is refreshed.
+type ebaytoken struct {
+	ShopifyDomain    string    `bson:"shopify_domain"`
+	EbayAccessToken  string    `bson:"ebay_access_token,omitempty"`
+	EbayRefreshToken string    `bson:"ebay_refresh_token,omitempty"`
+	EbayTokenExpires time.Time `bson:"ebay_token_expires,omitempty"`
+}
+
+type ebayTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+type ebayInventoryItem struct {
+	SKU          string `json:"sku"`
+	Availability struct {
+		ShipToLocationAvailability struct {
+			Quantity int `json:"quantity"`
+		} `json:"shipToLocationAvailability"`
+	} `json:"availability"`
+	Product struct {
+		Title string `json:"title"`
+	} `json:"product"`
+}
+
+type ebayInventoryPage struct {
+	Total          int                 `json:"total"`
+	Next           string              `json:"next"`
+	InventoryItems []ebayInventoryItem `json:"inventoryItems"`
+}
+
+type ebayQuantityUpdate struct {
+	SKU                        string `json:"sku"`
+	ShipToLocationAvailability struct {
+		Quantity int `json:"quantity"`
+	} `json:"shipToLocationAvailability"`
+}
+
+type ebayBulkUpdateRequest struct {
+	Requests []ebayQuantityUpdate `json:"requests"`
+}
+
+type ebayBulkUpdateResponse struct {
+	Responses []struct {
+		StatusCode int    `json:"statusCode"`
+		SKU        string `json:"sku"`
+		Errors     []struct {
+			ErrorID int    `json:"errorId"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"responses"`
+}
+
+func readEbayToken(storename string, client *mongo.Client) (ebaytoken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var token ebaytoken
+	shopCollection := client.Database("etsync").Collection("shops")
+	if err := shopCollection.FindOne(ctx, bson.M{"shopify_domain": storename}).Decode(&token); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "ebay_ops",
+			"Caller": "ReadEbayToken",
+		}).Warnf("Unable to read shop record %v", err)
+		return token, err
+	}
+	if token.EbayRefreshToken == "" {
+		return token, fmt.Errorf("no ebay token stored for %s", storename)
+	}
+	var err error
+	if token.EbayAccessToken, err = decryptToken(storename, "ebay_access_token", token.EbayAccessToken); err != nil {
+		return token, err
+	}
+	if token.EbayRefreshToken, err = decryptToken(storename, "ebay_refresh_token", token.EbayRefreshToken); err != nil {
+		return token, err
+	}
+	return token, nil
+}
+
+func writeEbayToken(storename string, token ebaytoken, client *mongo.Client) error {
+	accesstoken, err := encryptToken(storename, "ebay_access_token", token.EbayAccessToken)
+	if err != nil {
+		return err
+	}
+	refreshtoken, err := encryptToken(storename, "ebay_refresh_token", token.EbayRefreshToken)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	update := bson.M{"$set": bson.M{
+		"ebay_access_token":  accesstoken,
+		"ebay_refresh_token": refreshtoken,
+		"ebay_token_expires": token.EbayTokenExpires,
+	}}
+	if _, err := shopCollection.UpdateOne(ctx, bson.M{"shopify_domain": storename}, update, options.Update().SetUpsert(true)); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "ebay_ops",
+			"Caller": "WriteEbayToken",
+		}).Errorf("Unable to write the ebay token %v", err)
+		return err
+	}
+	return nil
+}
+
+// refreshEbayToken exchanges the refresh token for a new access token
+func refreshEbayToken(config Config, token ebaytoken) (ebaytoken, error) {
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", token.EbayRefreshToken)
+	data.Set("scope", ebayScope)
+
+	httpclient := apiHTTP
+	req, err := http.NewRequest("POST", apiURLs.EbayAPI+"/identity/v1/oauth2/token", strings.NewReader(data.Encode()))
+	if err != nil {
+		return token, err
+	}
+	req.SetBasicAuth(config.EBAY_CLIENT_ID, config.EBAY_CLIENT_SECRET)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	res, err := httpclient.Do(req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "ebay_ops",
+			"Caller": "RefreshEbayToken",
+			"Action": "http request",
+		}).Error(err)
+		return token, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return token, err
+	}
+	if res.StatusCode != 200 {
+		log.WithFields(log.Fields{
+			"File":   "ebay_ops",
+			"Caller": "RefreshEbayToken",
+			"Action": "http response",
+		}).Errorf("Unable to refresh the ebay token, got response %d: %s", res.StatusCode, string(body))
+		return token, fmt.Errorf("ebay token refresh failed with status %d", res.StatusCode)
+	}
+	var tr ebayTokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return token, err
+	}
+	token.EbayAccessToken = tr.AccessToken
+	token.EbayTokenExpires = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	return token, nil
+}
+
+// getEbayToken returns a usable access token for the shop record, refreshing it once it has less than
+// EBAY_TOKEN_REFRESH_MINUTES left. Concurrent refreshes are harmless as the refresh token is unchanged.
+func getEbayToken(storename string, config Config, client *mongo.Client) (ebaytoken, error) {
+	token, err := readEbayToken(storename, client)
+	if err != nil {
+		return token, err
+	}
+	if token.EbayAccessToken != "" && time.Until(token.EbayTokenExpires) > time.Duration(config.EBAY_TOKEN_REFRESH_MINUTES)*time.Minute {
+		return token, nil
+	}
+	if token, err = refreshEbayToken(config, token); err != nil {
+		return token, err
+	}
+	log.WithFields(log.Fields{
+		"File":   "ebay_ops",
+		"Caller": "GetEbayToken",
+	}).Infof("Refreshed ebay token for %s, expires %v", storename, token.EbayTokenExpires)
+	return token, writeEbayToken(storename, token, client)
+}
+
+func ebayTokenCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("ebay-token", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop record to store the token on")
+	refresh := fs.String("refresh-token", "", "the ebay user refresh token granted for the sell.inventory scope")
+	fs.Parse(args)
+	if *shop == "" || *refresh == "" {
+		return fmt.Errorf("usage: %s", commands["ebay-token"].Usage)
+	}
+	token, err := refreshEbayToken(config, ebaytoken{ShopifyDomain: *shop, EbayRefreshToken: *refresh})
+	if err != nil {
+		return err
+	}
+	if err := writeEbayToken(*shop, token, client); err != nil {
+		return err
+	}
+	fmt.Printf("ebay token stored for %s, expires %v\n", *shop, token.EbayTokenExpires)
+	return nil
+}
+
+// ebayConnection is the channel adapter for an ebay seller account, using the sell inventory api where
+// each inventory item is identified by its sku
+type ebayConnection struct {
+	conn  ChannelConnection
+	token string
+}
+
+func newEbayConnection(config Config, conn ChannelConnection, client *mongo.Client) (*ebayConnection, error) {
+	if conn.TokenFrom == "" {
+		return nil, fmt.Errorf("ebay connection %s has no token_from shop", conn.ID)
+	}
+	token, err := getEbayToken(conn.TokenFrom, config, client)
+	if err != nil {
+		return nil, err
+	}
+	return &ebayConnection{conn: conn, token: token.EbayAccessToken}, nil
+}
+
+func (e *ebayConnection) ebayRequest(method, path string, body []byte) ([]byte, error) {
+	httpclient := apiHTTP
+	req, err := http.NewRequest(method, apiURLs.EbayAPI+path, strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+e.token)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Language", "en-US")
+	res, err := httpclient.Do(req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "ebay_ops",
+			"Caller": "EbayRequest",
+			"Action": "http request",
+		}).Error(err)
+		return nil, err
+	}
+	defer res.Body.Close()
+	resbody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	// bulk_update_price_quantity answers 207 when the outcome differs between skus
+	if res.StatusCode != 200 && res.StatusCode != 207 {
+		log.WithFields(log.Fields{
+			"File":   "ebay_ops",
+			"Caller": "EbayRequest",
+			"Action": "http response",
+		}).Errorf("%s %s got response %d: %s", method, path, res.StatusCode, string(resbody))
+		return resbody, fmt.Errorf("ebay %s %s failed with status %d", method, path, res.StatusCode)
+	}
+	return resbody, nil
+}
+
+// fetch reads every page of inventory items, the quantity synced is the ship to location availability
+func (e *ebayConnection) fetch() ([]ConnectionStockItem, error) {
+	var items []ConnectionStockItem
+	for offset := 0; ; offset += ebayPageSize {
+		body, err := e.ebayRequest("GET", fmt.Sprintf("/sell/inventory/v1/inventory_item?limit=%d&offset=%d", ebayPageSize, offset), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page ebayInventoryPage
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("unable to read ebay inventory items: %v", err)
+		}
+		for _, i := range page.InventoryItems {
+			items = append(items, ConnectionStockItem{
+				ItemKey: i.SKU,
+				SKU:     i.SKU,
+				ItemID:  i.SKU,
+				Title:   i.Product.Title,
+				Current: i.Availability.ShipToLocationAvailability.Quantity,
+			})
+		}
+		if page.Next == "" || len(page.InventoryItems) == 0 {
+			return items, nil
+		}
+	}
+}
+
+// planWrites groups the levels into bulk_update_price_quantity requests of at most ebayBatchSize skus,
+// sending only the quantity so that prices are left alone
+func (e *ebayConnection) planWrites(levels []ConnectionLevel) ([]ConnectionWrite, error) {
+	var writes []ConnectionWrite
+	for start := 0; start < len(levels); start += ebayBatchSize {
+		end := start + ebayBatchSize
+		if end > len(levels) {
+			end = len(levels)
+		}
+		var batch ebayBulkUpdateRequest
+		for _, l := range levels[start:end] {
+			var u ebayQuantityUpdate
+			u.SKU = l.ItemID
+			u.ShipToLocationAvailability.Quantity = l.Quantity
+			batch.Requests = append(batch.Requests, u)
+		}
+		payload, err := json.Marshal(batch)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, ConnectionWrite{Target: "bulk_update_price_quantity", Payload: string(payload), Levels: levels[start:end]})
+	}
+	return writes, nil
+}
+
+// applyWrite sends a bulk update, ebay answers 207 when some skus were updated and others were not so
+// the skus it updated are returned along with an error for the rest
+func (e *ebayConnection) applyWrite(write ConnectionWrite) ([]ConnectionLevel, error) {
+	body, err := e.ebayRequest("POST", "/sell/inventory/v1/bulk_update_price_quantity", []byte(write.Payload))
+	if err != nil {
+		return nil, err
+	}
+	var result ebayBulkUpdateResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("unable to read ebay bulk update response: %v", err)
+	}
+	updated := make(map[string]bool)
+	var failed []string
+	for _, r := range result.Responses {
+		if r.StatusCode != 200 {
+			msg := fmt.Sprintf("status %d", r.StatusCode)
+			if len(r.Errors) > 0 {
+				msg = r.Errors[0].Message
+			}
+			failed = append(failed, fmt.Sprintf("%s: %s", r.SKU, msg))
+			continue
+		}
+		updated[r.SKU] = true
+	}
+	var accepted []ConnectionLevel
+	for _, l := range write.Levels {
+		if updated[l.ItemID] {
+			accepted = append(accepted, l)
+		}
+	}
+	if len(accepted) < len(write.Levels) {
+		if len(failed) == 0 {
+			failed = append(failed, "no result returned")
+		}
+		return accepted, fmt.Errorf("ebay rejected %d stock updates: %s", len(write.Levels)-len(accepted), strings.Join(failed, "; "))
+	}
+	return accepted, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeEbay serves the oauth token and sell inventory endpoints the ebay connection uses. Bulk updates of
+// the skus in reject are answered per sku with a 207, as ebay does when the outcome differs between skus.
+type fakeEbay struct {
+	items   []ebayInventoryItem
+	reject  map[string]bool
+	updates []ebayBulkUpdateRequest
+}
+
+func (f *fakeEbay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/identity/v1/oauth2/token" {
+		r.ParseForm()
+		if id, secret, ok := r.BasicAuth(); !ok || id != "app" || secret != "shh" || r.Form.Get("refresh_token") != "refresh" || r.Form.Get("scope") != ebayScope {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(ebayTokenResponse{AccessToken: "access", ExpiresIn: 7200, TokenType: "User Access Token"})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer access" {
+		http.Error(w, `{"errors":[{"errorId":1001}]}`, http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/sell/inventory/v1/inventory_item":
+		var limit, offset int
+		fmt.Sscanf(r.URL.Query().Get("limit"), "%d", &limit)
+		fmt.Sscanf(r.URL.Query().Get("offset"), "%d", &offset)
+		page := ebayInventoryPage{Total: len(f.items)}
+		if offset < len(f.items) {
+			end := offset + limit
+			if end > len(f.items) {
+				end = len(f.items)
+			}
+			page.InventoryItems = f.items[offset:end]
+			if end < len(f.items) {
+				page.Next = fmt.Sprintf("/sell/inventory/v1/inventory_item?limit=%d&offset=%d", limit, end)
+			}
+		}
+		json.NewEncoder(w).Encode(page)
+	case r.Method == "POST" && r.URL.Path == "/sell/inventory/v1/bulk_update_price_quantity":
+		var req ebayBulkUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.updates = append(f.updates, req)
+		var responses []map[string]interface{}
+		status := http.StatusOK
+		for _, u := range req.Requests {
+			res := map[string]interface{}{"sku": u.SKU, "statusCode": http.StatusOK}
+			if f.reject[u.SKU] {
+				res["statusCode"] = http.StatusBadRequest
+				res["errors"] = []map[string]interface{}{{"errorId": 25702, "message": "The SKU could not be found"}}
+				status = http.StatusMultiStatus
+			}
+			responses = append(responses, res)
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"responses": responses})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func useFakeEbay(t *testing.T, f *fakeEbay) {
+	server := httptest.NewServer(f)
+	saved := apiURLs
+	apiURLs.EbayAPI = server.URL
+	t.Cleanup(func() {
+		apiURLs = saved
+		server.Close()
+	})
+}
+
+func newEbayItem(sku string, quantity int) ebayInventoryItem {
+	var item ebayInventoryItem
+	item.SKU = sku
+	item.Product.Title = "Item " + sku
+	item.Availability.ShipToLocationAvailability.Quantity = quantity
+	return item
+}
+
+func TestEbayRefreshToken(t *testing.T) {
+	useFakeEbay(t, &fakeEbay{})
+	config := Config{EBAY_CLIENT_ID: "app", EBAY_CLIENT_SECRET: "shh"}
+	token, err := refreshEbayToken(config, ebaytoken{EbayRefreshToken: "refresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.EbayAccessToken != "access" || token.EbayRefreshToken != "refresh" || token.EbayTokenExpires.IsZero() {
+		t.Errorf("unexpected token %+v", token)
+	}
+	if _, err := refreshEbayToken(config, ebaytoken{EbayRefreshToken: "revoked"}); err == nil {
+		t.Errorf("a rejected refresh token should fail")
+	}
+}
+
+func TestEbayFetch(t *testing.T) {
+	f := &fakeEbay{}
+	for i := 0; i < ebayPageSize+5; i++ {
+		f.items = append(f.items, newEbayItem(fmt.Sprintf("SKU-%d", i), i))
+	}
+	useFakeEbay(t, f)
+	items, err := (&ebayConnection{token: "access"}).fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(f.items) {
+		t.Fatalf("got %d items over two pages, want %d", len(items), len(f.items))
+	}
+	last := items[len(items)-1]
+	if last.ItemKey != "SKU-104" || last.SKU != "SKU-104" || last.ItemID != "SKU-104" || last.Current != 104 || last.Title != "Item SKU-104" {
+		t.Errorf("unexpected item %+v", last)
+	}
+}
+
+func TestEbayPlanWrites(t *testing.T) {
+	var levels []ConnectionLevel
+	for i := 0; i < ebayBatchSize+1; i++ {
+		levels = append(levels, ConnectionLevel{PlannedLevel: PlannedLevel{SKU: fmt.Sprintf("S%d", i), Quantity: i}, ItemID: fmt.Sprintf("S%d", i)})
+	}
+	writes, err := (&ebayConnection{}).planWrites(levels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != 2 || len(writes[0].Levels) != ebayBatchSize || len(writes[1].Levels) != 1 {
+		t.Fatalf("levels were not split into requests of %d skus: %+v", ebayBatchSize, writes)
+	}
+	if writes[1].Payload != fmt.Sprintf(`{"requests":[{"sku":"S%d","shipToLocationAvailability":{"quantity":%d}}]}`, ebayBatchSize, ebayBatchSize) {
+		t.Errorf("unexpected payload %s", writes[1].Payload)
+	}
+}
+
+func TestEbayApplyWrite(t *testing.T) {
+	levels := []ConnectionLevel{
+		{PlannedLevel: PlannedLevel{SKU: "MUG", Previous: 4, Quantity: 3}, ItemKey: "MUG", ItemID: "MUG"},
+		{PlannedLevel: PlannedLevel{SKU: "PLATE", Previous: 2, Quantity: 1}, ItemKey: "PLATE", ItemID: "PLATE"},
+		{PlannedLevel: PlannedLevel{SKU: "CUP", Previous: 9, Quantity: 8}, ItemKey: "CUP", ItemID: "CUP"},
+	}
+	for _, tc := range []struct {
+		name     string
+		reject   map[string]bool
+		token    string
+		accepted []string
+		fails    bool
+	}{
+		{name: "all accepted", token: "access", accepted: []string{"MUG", "PLATE", "CUP"}},
+		{name: "207 with one rejected", token: "access", reject: map[string]bool{"PLATE": true}, accepted: []string{"MUG", "CUP"}, fails: true},
+		{name: "207 with all rejected", token: "access", reject: map[string]bool{"MUG": true, "PLATE": true, "CUP": true}, fails: true},
+		{name: "request rejected", token: "expired", fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useFakeEbay(t, &fakeEbay{reject: tc.reject})
+			e := &ebayConnection{token: tc.token}
+			writes, err := e.planWrites(levels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			accepted, err := e.applyWrite(writes[0])
+			if (err != nil) != tc.fails {
+				t.Errorf("got error %v, want an error %v", err, tc.fails)
+			}
+			var skus []string
+			for _, l := range accepted {
+				skus = append(skus, l.SKU)
+			}
+			if strings.Join(skus, ",") != strings.Join(tc.accepted, ",") {
+				t.Errorf("accepted %v, want %v", skus, tc.accepted)
+			}
+		})
+	}
+}
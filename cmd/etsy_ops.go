@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -36,6 +38,9 @@ type etsytoken struct {
 	EtsyExpiresIn        int                `bson:"etsy_expires_in"`
 	EtsyTokenExpires     time.Time          `bson:"etsy_token_expires"`
 	EtsyRefreshToken     string             `bson:"etsy_refresh_token"`
+	ShopState            string             `bson:"state"`
+	// the refresh token as stored on the shop record, which is encrypted when token encryption is enabled
+	storedRefreshToken string
 }
 
 type etsyTokenResponse struct {
@@ -46,6 +51,24 @@ type etsyTokenResponse struct {
 	RefreshToken string    `json:"refresh_token"`
 }
 
+// etsyOAuthError is the error body returned by the etsy token endpoint
+type etsyOAuthError struct {
+	StatusCode  int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+	URI         string `json:"error_uri"`
+}
+
+func (e *etsyOAuthError) Error() string {
+	return fmt.Sprintf("etsy token request failed with status %d: %s %s", e.StatusCode, e.Code, e.Description)
+}
+
+// refreshTokenRejected reports whether etsy has refused the refresh token itself (it has expired or been
+// revoked) in which case the shop has to be authorised again
+func (e *etsyOAuthError) refreshTokenRejected() bool {
+	return e.Code == "invalid_grant"
+}
+
 type etsyShopListingResult struct {
 	ListingID                 int    `json:"listing_id"`
 	ShopID                    int    `json:"shop_id"`
@@ -66,69 +89,80 @@ type etsyShopListings struct {
 }
 
 type etsyOffering struct {
-	OfferingID int64 `json:"offering_id"`
-	Quantity   int   `json:"quantity"`
-	IsEnabled  bool  `json:"is_enabled"`
-	IsDeleted  bool  `json:"is_deleted"`
-	Price      struct {
-		Amount       int    `json:"amount"`
-		Divisor      int    `json:"divisor"`
-		CurrencyCode string `json:"currency_code"`
-	} `json:"price"`
+	OfferingID int64     `json:"offering_id"`
+	Quantity   int       `json:"quantity"`
+	IsEnabled  bool      `json:"is_enabled"`
+	IsDeleted  bool      `json:"is_deleted"`
+	Price      etsyMoney `json:"price"`
+	// the fields etsy returns that are not modelled above, sent back unchanged
+	Extra map[string]json.RawMessage `json:"-" bson:"-"`
+}
+
+type etsyPropertyValue struct {
+	PropertyID   int                        `json:"property_id"`
+	PropertyName string                     `json:"property_name"`
+	ScaleID      interface{}                `json:"scale_id"`
+	ScaleName    interface{}                `json:"scale_name"`
+	ValueIds     []int                      `json:"value_ids"`
+	Values       []string                   `json:"values"`
+	Extra        map[string]json.RawMessage `json:"-" bson:"-"`
 }
 
 type etsyProduct struct {
-	ListingID      int            `json:"listing_id"`
-	ShopID         int            `json:"shop_id"`
-	ShopifyDomain  string         `json:"shopify_domain"`
-	Title          string         `json:"title"`
-	Description    string         `json:"description"`
-	ProductID      int64          `json:"product_id"`
-	Sku            string         `json:"sku"`
-	IsDeleted      bool           `json:"is_deleted"`
-	Offerings      []etsyOffering `json:"offerings"`
-	PropertyValues []struct {
-		PropertyID   int         `json:"property_id"`
-		PropertyName string      `json:"property_name"`
-		ScaleID      interface{} `json:"scale_id"`
-		ScaleName    interface{} `json:"scale_name"`
-		ValueIds     []int       `json:"value_ids"`
-		Values       []string    `json:"values"`
-	} `json:"property_values"`
+	ListingID      int                        `json:"listing_id"`
+	ShopID         int                        `json:"shop_id"`
+	ShopifyDomain  string                     `json:"shopify_domain"`
+	Title          string                     `json:"title"`
+	Description    string                     `json:"description"`
+	ProductID      int64                      `json:"product_id"`
+	Sku            string                     `json:"sku"`
+	IsDeleted      bool                       `json:"is_deleted"`
+	Offerings      []etsyOffering             `json:"offerings"`
+	PropertyValues []etsyPropertyValue        `json:"property_values"`
+	Extra          map[string]json.RawMessage `json:"-" bson:"-"`
 }
 
 type etsyListing struct {
-	Products           []etsyProduct `json:"products"`
-	PriceOnProperty    []interface{} `json:"price_on_property"`
-	QuantityOnProperty []int         `json:"quantity_on_property"`
-	SkuOnProperty      []int         `json:"sku_on_property"`
+	Products           []etsyProduct              `json:"products"`
+	PriceOnProperty    []interface{}              `json:"price_on_property"`
+	QuantityOnProperty []int                      `json:"quantity_on_property"`
+	SkuOnProperty      []int                      `json:"sku_on_property"`
+	Extra              map[string]json.RawMessage `json:"-" bson:"-"`
 }
 
+// The inventory update types carry the unmodelled fields of the inventory they were built from in
+// Extra, so that a stock update leaves settings etsy has added since (eg. readiness_state_id) as they were
+
 type EtsyAPIUpdate struct {
-	Products           []EtsyProductUpdate `json:"products"`
-	PriceOnProperty    []interface{}       `json:"price_on_property"`
-	QuantityOnProperty []int               `json:"quantity_on_property"`
-	SkuOnProperty      []int               `json:"sku_on_property"`
-	Listing            interface{}         `json:"listing"`
+	Products           []EtsyProductUpdate        `json:"products"`
+	PriceOnProperty    []interface{}              `json:"price_on_property"`
+	QuantityOnProperty []int                      `json:"quantity_on_property"`
+	SkuOnProperty      []int                      `json:"sku_on_property"`
+	Listing            interface{}                `json:"listing"`
+	Extra              map[string]json.RawMessage `json:"-"`
 }
 
 type EtsyProductUpdate struct {
 	Sku            string                            `json:"sku"`
 	Offerings      []EtsyProductUpdateOffering       `json:"offerings"`
 	PropertyValues []EtsyProductUpdatePropertyValues `json:"property_values"`
+	Extra          map[string]json.RawMessage        `json:"-"`
 }
 
 type EtsyProductUpdateOffering struct {
-	Quantity  int     `json:"quantity"`
-	IsEnabled bool    `json:"is_enabled"`
-	Price     float64 `json:"price"`
+	Quantity  int                        `json:"quantity"`
+	IsEnabled bool                       `json:"is_enabled"`
+	Price     etsyPrice                  `json:"price"`
+	Extra     map[string]json.RawMessage `json:"-"`
 }
 
 type EtsyProductUpdatePropertyValues struct {
-	PropertyID   int      `json:"property_id"`
-	PropertyName string   `json:"property_name"`
-	ValueIds     []int    `json:"value_ids"`
-	Values       []string `json:"values"`
+	PropertyID   int                        `json:"property_id"`
+	PropertyName string                     `json:"property_name"`
+	ScaleID      interface{}                `json:"scale_id"`
+	ValueIds     []int                      `json:"value_ids"`
+	Values       []string                   `json:"values"`
+	Extra        map[string]json.RawMessage `json:"-"`
 }
 
 type etsyListingUpdate struct {
@@ -161,7 +195,7 @@ type etsyDelta struct {
 func getEtsyTokenFromAPI(clientid, redirecturi string, etoken etsytoken) (etsytoken, error) {
 	var response etsyTokenResponse
 	var payloadstr string
-	url := "https://api.etsy.com/v3/public/oauth/token"
+	url := apiURLs.EtsyOAuth + "/v3/public/oauth/token"
 
 	method := "POST"
 	log.WithFields(log.Fields{
@@ -176,7 +210,7 @@ func getEtsyTokenFromAPI(clientid, redirecturi string, etoken etsytoken) (etsyto
 
 	payload := strings.NewReader(payloadstr)
 
-	client := &http.Client{}
+	client := apiHTTP
 	req, err := http.NewRequest(method, url, payload)
 
 	if err != nil {
@@ -205,12 +239,20 @@ func getEtsyTokenFromAPI(clientid, redirecturi string, etoken etsytoken) (etsyto
 			"File":   "etsy_ops",
 			"Caller": "GetEtsyTokenFromAPI",
 		}).Debug(string(body))
-		return etsytoken{}, fmt.Errorf("Response unsuccessful: %s", res.Status)
+		oautherr := &etsyOAuthError{StatusCode: res.StatusCode}
+		if err := json.Unmarshal(body, oautherr); err != nil || oautherr.Code == "" {
+			return etsytoken{}, fmt.Errorf("Response unsuccessful: %s", res.Status)
+		}
+		return etsytoken{}, oautherr
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		fmt.Println(err)
+		log.WithFields(log.Fields{
+			"File":   "etsy_ops",
+			"Caller": "GetEtsyTokenFromAPI",
+			"Action": "Read Body",
+		}).Errorf("Error reading response: %v", err)
 		return etsytoken{}, err
 	}
 	if err := json.Unmarshal(body, &response); err != nil {
@@ -229,14 +271,18 @@ func getEtsyTokenFromAPI(clientid, redirecturi string, etoken etsytoken) (etsyto
 	return etoken, nil
 }
 
-func getUsersEtsyShops(storename, clientid, token string, client *mongo.Client) (string, error) {
+func getUsersEtsyShops(storename, clientid string, token etsyAccess, client *mongo.Client) (string, error) {
 	var etsy_shop etsyShop
-	user := strings.Split(token, ".")[0]
+	accesstoken, err := token()
+	if err != nil {
+		return "", err
+	}
+	user := strings.Split(accesstoken, ".")[0]
 	log.Debugf("Getting shops for user id %s", user)
-	url := fmt.Sprintf("https://openapi.etsy.com/v3/application/users/%s/shops", user)
+	url := fmt.Sprintf("%s/v3/application/users/%s/shops", apiURLs.EtsyAPI, user)
 	method := "GET"
 
-	httpclient := &http.Client{}
+	httpclient := apiHTTP
 	req, err := http.NewRequest(method, url, nil)
 
 	if err != nil {
@@ -244,7 +290,7 @@ func getUsersEtsyShops(storename, clientid, token string, client *mongo.Client)
 		return "", err
 	}
 	req.Header.Add("x-api-key", clientid)
-	req.Header.Add("authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Add("authorization", fmt.Sprintf("Bearer %s", accesstoken))
 
 	res, err := httpclient.Do(req)
 	if err != nil {
@@ -285,25 +331,29 @@ func getUsersEtsyShops(storename, clientid, token string, client *mongo.Client)
 	return fmt.Sprintf("%d", etsy_shop.ShopID), nil
 }
 
-func getAndSetEtsyShopListings(storename, etsy_shopid, clientid, token string, eSkusToSet map[int]string, overrideStock map[string]int, client *mongo.Client) error {
+func getEtsyShopListings(etsy_shopid, clientid string, token etsyAccess) ([]etsyShopListingResult, error) {
 	var shoplistings etsyShopListings
-	url := fmt.Sprintf("https://openapi.etsy.com/v3/application/shops/%s/listings", etsy_shopid)
+	accesstoken, err := token()
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/v3/application/shops/%s/listings", apiURLs.EtsyAPI, etsy_shopid)
 	method := "GET"
 
-	httpclient := &http.Client{}
+	httpclient := apiHTTP
 	req, err := http.NewRequest(method, url, nil)
 
 	if err != nil {
 		log.Error(err)
-		return err
+		return nil, err
 	}
 	req.Header.Add("x-api-key", clientid)
-	req.Header.Add("authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Add("authorization", fmt.Sprintf("Bearer %s", accesstoken))
 
 	res, err := httpclient.Do(req)
 	if err != nil {
-		fmt.Println(err)
-		return err
+		log.Error(err)
+		return nil, err
 	}
 	defer res.Body.Close()
 
@@ -311,41 +361,103 @@ func getAndSetEtsyShopListings(storename, etsy_shopid, clientid, token string, e
 	if err != nil {
 		log.WithFields(log.Fields{
 			"File":   "etsy_ops",
-			"Caller": "GetAndSetEtsyShopListings",
+			"Caller": "GetEtsyShopListings",
 			"Action": "Read Body",
 		}).Error(err)
-		return err
+		return nil, err
 	}
 
 	if err := json.Unmarshal(body, &shoplistings); err != nil {
 		log.WithFields(log.Fields{
 			"File":   "etsy_ops",
-			"Caller": "GetAndSetEtsyShopListings",
+			"Caller": "GetEtsyShopListings",
 			"Action": "unmarshall",
 		}).Errorf("Error with response unmarshall: %v", err)
-		return err
+		return nil, err
 	}
 	log.WithFields(log.Fields{
 		"File":   "etsy_ops",
-		"Caller": "GetAndSetEtsyShopListings",
+		"Caller": "GetEtsyShopListings",
 	}).Debugf("Got %d shop listings back from Etsy", shoplistings.Count)
-	if err = reconcileInventoryListings(storename, etsy_shopid, clientid, token, shoplistings.Results, eSkusToSet, overrideStock, client); err != nil {
+	return shoplistings.Results, nil
+}
+
+// getAndSetEtsyShopListings builds the plan of stock changes for both stores and the shop's further
+// connections and submits it to be applied or held for approval. The stock baselines are put back to
+// before when the plan cannot be built.
+func getAndSetEtsyShopListings(config Config, run *SyncRun, storename, etsy_shopid string, token etsyAccess, eSkusToSet map[int]string, overrideStock map[string]int, before map[primitive.ObjectID]bson.M, client *mongo.Client) error {
+	listings, err := getEtsyShopListings(etsy_shopid, config.ETSY_CLIENT_ID, token)
+	if err != nil {
+		return err
+	}
+	run.Listings = len(listings)
+	// the further connections are read first so that their changes are applied to the primary stores
+	legs, missing, err := fetchConnectionLegs(config, run, storename, false, client)
+	if err != nil {
+		restoreRunBaselines(storename, before, client)
+		return err
+	}
+	plan, etsychanges, err := reconcileInventoryListings(storename, etsy_shopid, config.ETSY_CLIENT_ID, token, listings, eSkusToSet, overrideStock, legDeltas(legs), client)
+	if err != nil {
 		log.WithFields(log.Fields{
 			"File":   "etsy_ops",
 			"Caller": "GetAndSetEtsyShopListings",
 			"Action": "reconcile listings",
 		}).Errorf("Error with reconcile of etsy inventory: %v", err)
+		run.recordError("ReconcileInventoryListings", err)
+		restoreRunBaselines(storename, before, client)
+		return nil
+	}
+	run.Products = plan.ItemsChecked
+	if len(legs) > 0 || len(missing) > 0 {
+		// and the changes on the primary stores are applied to the further connections, or kept for those
+		// that could not be read
+		primarychanges, err := getShopifyStockDeltas(storename, client)
+		if err != nil {
+			run.recordError("GetShopifyStockDeltas", err)
+			restoreRunBaselines(storename, before, client)
+			return nil
+		}
+		for sku, d := range etsychanges {
+			primarychanges[sku] += d
+		}
+		quarantined, err := getQuarantinedSkus(storename, client)
+		if err != nil {
+			run.recordError("GetQuarantinedSkus", err)
+			restoreRunBaselines(storename, before, client)
+			return nil
+		}
+		backlog, err := getConnectionBacklog(storename, client)
+		if err != nil {
+			run.recordError("GetConnectionBacklog", err)
+			restoreRunBaselines(storename, before, client)
+			return nil
+		}
+		if err := planConnectionWrites(&plan, legs, primarychanges, overrideStock, quarantined, backlog); err != nil {
+			run.recordError("PlanConnectionWrites", err)
+			restoreRunBaselines(storename, before, client)
+			return nil
+		}
+		planConnectionBacklog(&plan, storename, missing, legs, primarychanges, overrideStock, quarantined)
+	}
+	if err := submitSyncPlan(config, run, plan, before, token, getstoretoken(storename, client), client); err != nil {
+		restoreRunBaselines(storename, before, client)
+		return err
 	}
 	return nil
 }
 
-func updateEtsyShopListing(listing_id int, payloadstr, clientid, token string) error {
-	url := fmt.Sprintf("https://openapi.etsy.com/v3/application/listings/%d/inventory", listing_id)
+func updateEtsyShopListing(listing_id int, payloadstr, clientid string, token etsyAccess) error {
+	accesstoken, err := token()
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/v3/application/listings/%d/inventory", apiURLs.EtsyAPI, listing_id)
 	method := "PUT"
 
 	payload := strings.NewReader(payloadstr)
 
-	httpclient := &http.Client{}
+	httpclient := apiHTTP
 	req, err := http.NewRequest(method, url, payload)
 
 	if err != nil {
@@ -354,13 +466,18 @@ func updateEtsyShopListing(listing_id int, payloadstr, clientid, token string) e
 	}
 	req.Header.Add("x-api-key", clientid)
 	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Add("authorization", fmt.Sprintf("Bearer %s", accesstoken))
 
 	res, err := httpclient.Do(req)
 	if err != nil {
-		fmt.Println(err)
+		log.WithFields(log.Fields{
+			"File":      "etsy_ops",
+			"Caller":    "UpdateEtsyShopListing",
+			"ListingID": listing_id,
+		}).Errorf("Error with http request: %v", err)
 		return err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		log.WithFields(log.Fields{
@@ -372,44 +489,107 @@ func updateEtsyShopListing(listing_id int, payloadstr, clientid, token string) e
 	return nil
 }
 
-func reconcileInventoryListings(storename, etsy_shopid, clientid, token string, listings []etsyShopListingResult, eSkusToSet map[int]string, overrideStock map[string]int, client *mongo.Client) error {
-
+func getListingInventory(listing_id int, clientid string, token etsyAccess) (etsyListing, error) {
+	var etsy_listing etsyListing
+	accesstoken, err := token()
+	if err != nil {
+		return etsy_listing, err
+	}
+	url := fmt.Sprintf("%s/v3/application/listings/%d/inventory", apiURLs.EtsyAPI, listing_id)
 	method := "GET"
-	httpclient := &http.Client{}
+
+	httpclient := apiHTTP
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		log.Error(err)
+		return etsy_listing, err
+	}
+	req.Header.Add("x-api-key", clientid)
+	req.Header.Add("authorization", fmt.Sprintf("Bearer %s", accesstoken))
+	res, err := httpclient.Do(req)
+	if err != nil {
+		log.Error(err)
+		return etsy_listing, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "etsy_ops",
+			"Caller": "GetListingInventory",
+			"Action": "Read Listing Body",
+		}).Error(err)
+		return etsy_listing, err
+	}
+	if err := json.Unmarshal(body, &etsy_listing); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "etsy_ops",
+			"Caller": "GetListingInventory",
+			"Action": "unmarshall",
+		}).Errorf("Error with response unmarshall: %v", err)
+		return etsy_listing, err
+	}
+	return etsy_listing, nil
+}
+
+// reconcileInventoryListings records the current etsy stock for every listing and works out the stock
+// changes needed on both stores, including the changes made on any further connections (by sku).
+// Nothing is written to either store, the changes are returned as a plan along with the etsy stock
+// changes by sku.
+func reconcileInventoryListings(storename, etsy_shopid, clientid string, token etsyAccess, listings []etsyShopListingResult, eSkusToSet map[int]string, overrideStock map[string]int, connectionDelta map[string]int, client *mongo.Client) (SyncPlan, map[string]int, error) {
+	plan := SyncPlan{
+		ShopifyDomain: storename,
+		CreatedAt:     time.Now(),
+	}
+
+	// All the listing inventories are fetched before anything is written so that skus shared by
+	// products in different listings can be found and quarantined
+	inventories := make(map[int]etsyListing)
 	for _, l := range listings {
-		var etsyproducts []etsyProduct
-		var etsy_listing etsyListing
-		url := fmt.Sprintf("https://openapi.etsy.com/v3/application/listings/%d/inventory", l.ListingID)
-		req, err := http.NewRequest(method, url, nil)
-		if err != nil {
-			log.Error(err)
-			return err
-		}
-		req.Header.Add("x-api-key", clientid)
-		req.Header.Add("authorization", fmt.Sprintf("Bearer %s", token))
-		res, err := httpclient.Do(req)
+		etsy_listing, err := getListingInventory(l.ListingID, clientid, token)
 		if err != nil {
-			fmt.Println(err)
-			return err
-		}
-		defer res.Body.Close()
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"File":   "etsy_ops",
-				"Caller": "ReconcileInventoryListings",
-				"Action": "Read Listing Body",
-			}).Error(err)
-			return err
+			return plan, nil, err
 		}
-		if err := json.Unmarshal(body, &etsy_listing); err != nil {
-			log.WithFields(log.Fields{
-				"File":   "etsy_ops",
-				"Caller": "ReconcileInventoryListings",
-				"Action": "unmarshall",
-			}).Errorf("Error with response unmarshall: %v", err)
-			return err
+		inventories[l.ListingID] = etsy_listing
+	}
+	if err := saveSkuConflicts(storename, "etsy", etsySkuConflicts(storename, inventories, eSkusToSet), client); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "etsy_ops",
+			"Caller": "ReconcileInventoryListings",
+			"Action": "save sku conflicts",
+		}).Errorf("Error recording sku conflicts: %v", err)
+		return plan, nil, err
+	}
+	quarantined, err := getQuarantinedSkus(storename, client)
+	if err != nil {
+		return plan, nil, err
+	}
+	// the price sync is off unless a direction is set on the shop record
+	pricesync, err := getPriceSync(storename, client)
+	if err != nil {
+		return plan, nil, err
+	}
+	if err := pricesync.validate(); err != nil {
+		// settings stored before a check was added are not applied until they are set again
+		log.WithFields(log.Fields{
+			"File":   "etsy_ops",
+			"Caller": "ReconcileInventoryListings",
+		}).Warnf("Skipping the price sync: %v", err)
+		pricesync.Direction = ""
+	}
+	var priceditems map[string]StockItem
+	if pricesync.Direction != "" {
+		if priceditems, err = getPricedStockItems(storename, client); err != nil {
+			return plan, nil, err
 		}
+	}
+
+	shopifyDelta := make(map[string]int)
+	etsychanges := make(map[string]int)
+	shopifyHasChanges := false
+	for _, l := range listings {
+		var etsyproducts []etsyProduct
+		etsy_listing := inventories[l.ListingID]
 		log.WithFields(log.Fields{
 			"File":   "etsy_ops",
 			"Caller": "ReconcileInventoryListings",
@@ -422,6 +602,15 @@ func reconcileInventoryListings(storename, etsy_shopid, clientid, token string,
 			"File":   "etsy_ops",
 			"Caller": "ReconcileInventoryListings",
 		}).Debugf("Products in listing: %s", productlist)
+		if productid, ok := productWithoutOfferings(etsy_listing); ok {
+			// nothing is recorded for the listing, so its changes are picked up once etsy returns it whole
+			log.WithFields(log.Fields{
+				"File":      "etsy_ops",
+				"Caller":    "ReconcileInventoryListings",
+				"ListingID": l.ListingID,
+			}).Warnf("Skipping the listing as product %d has no offerings", productid)
+			continue
+		}
 		for _, p := range etsy_listing.Products {
 
 			p.ShopifyDomain = storename
@@ -431,10 +620,25 @@ func reconcileInventoryListings(storename, etsy_shopid, clientid, token string,
 			p.Description = l.Description
 			etsyproducts = append(etsyproducts, p)
 		}
-		delta, err := saveEtsyProducts(storename, etsyproducts, eSkusToSet, overrideStock, client)
+		delta, err := saveEtsyProducts(storename, etsyproducts, eSkusToSet, overrideStock, quarantined, client)
 		if err != nil {
 			log.Errorf("Error saving products to DB: %v", err)
-			return err
+			return plan, nil, err
+		}
+		for k, v := range delta.EtsySkuDelta {
+			etsychanges[k] += v
+		}
+		for _, p := range etsy_listing.Products {
+			sku := p.Sku
+			if s, ok := eSkusToSet[int(p.ProductID)]; ok {
+				sku = s
+			}
+			if _, ok := overrideStock[sku]; ok || quarantined[sku] || p.IsDeleted {
+				continue
+			}
+			if d := connectionDelta[sku]; d != 0 {
+				delta.EtsyDelta[p.ProductID] += d
+			}
 		}
 
 		log.WithFields(log.Fields{
@@ -445,107 +649,384 @@ func reconcileInventoryListings(storename, etsy_shopid, clientid, token string,
 		// To get the product array, call getListingInventory for the listing.
 		// From the getListingInventory response, remove the following fields: product_id, offering_id, scale_name and is_deleted.
 		// Also change the price array in offerings to be a decimal value instead of an array.
-		if delta.EstyHasChanges {
-			if err = reconcileEtsyStockLevel(storename, clientid, token, l.ListingID, etsy_listing, delta, eSkusToSet, overrideStock, client); err != nil {
-				log.Error(err)
+		if pricesync.Direction == priceSyncShopifyToEtsy {
+			delta.EtsyPrice = planEtsyPrices(pricesync, etsy_listing, eSkusToSet, quarantined, priceditems)
+		}
+		write, haschanges, err := buildEtsyListingWrite(l.ListingID, etsy_listing, delta, eSkusToSet, overrideStock, quarantined)
+		if err != nil {
+			return plan, nil, err
+		}
+		plan.ItemsChecked += len(write.Levels)
+		if haschanges {
+			plan.EtsyWrites = append(plan.EtsyWrites, write)
+		} else {
+			for _, level := range write.Levels {
+				if level.Quantity > 0 {
+					plan.EtsyStocked++
+				}
 			}
 		}
 		if delta.ShopifyHasChanges {
-			stoken := getstoretoken(storename, client)
-			if err = reconcileShopifyStockLevel(storename, clientid, stoken, delta, overrideStock, client); err != nil {
-				log.Error(err)
+			shopifyHasChanges = true
+			for k, v := range delta.ShopifyDelta {
+				shopifyDelta[k] += v
 			}
 		}
-
 	}
-	return nil
+	for sku, d := range connectionDelta {
+		if _, ok := overrideStock[sku]; ok || quarantined[sku] || d == 0 {
+			continue
+		}
+		item, err := getShopifyStockItemBySku(storename, sku, client)
+		if err != nil {
+			// the sku is not sold on the shopify store
+			continue
+		}
+		shopifyDelta[item.VariantID] += d
+		shopifyHasChanges = true
+	}
+	if shopifyHasChanges {
+		plan.ShopifySets = planShopifyStockLevel(storename, shopifyDelta, overrideStock, quarantined, client)
+	}
+	if plan.ShopifyStocked, err = shopifyStockedVariants(storename, plan.ShopifySets, quarantined, client); err != nil {
+		return plan, nil, err
+	}
+	if pricesync.Direction == priceSyncEtsyToShopify {
+		plan.ShopifyPrices = planShopifyPrices(pricesync, listings, inventories, eSkusToSet, quarantined, priceditems)
+	}
+	return plan, etsychanges, nil
 }
 
-func reconcileEtsyStockLevel(storename, clientid, token string, ListingID int, etsy_listing etsyListing, delta StockReconciliationDelta, eSkusToSet map[int]string, overrideStock map[string]int, client *mongo.Client) error {
-	var apiUpdate EtsyAPIUpdate
-	apiUpdate.PriceOnProperty = etsy_listing.PriceOnProperty
-	apiUpdate.QuantityOnProperty = etsy_listing.QuantityOnProperty
-	apiUpdate.SkuOnProperty = etsy_listing.SkuOnProperty
+// buildEtsyListingWrite prepares the listing inventory update for a single listing. The returned bool
+// reports whether the update changes the quantity, sku or price of any product in the listing. A listing
+// with a product that has no offerings cannot be sent back, so it is left out with no levels and no
+// changes rather than failing the run for every other listing.
+func buildEtsyListingWrite(ListingID int, etsy_listing etsyListing, delta StockReconciliationDelta, eSkusToSet map[int]string, overrideStock map[string]int, quarantined map[string]bool) (EtsyListingWrite, bool, error) {
+	write := EtsyListingWrite{ListingID: ListingID}
+	haschanges := false
+	levels := make(map[int64]etsyProductLevel)
 	log.WithFields(log.Fields{
 		"File":   "etsy_ops",
-		"Caller": "ReconcileEtsyStockLevel",
-	}).Infof("Preparing to send update to Etsy for listing %d",ListingID)
+		"Caller": "BuildEtsyListingWrite",
+	}).Debugf("Preparing update to Etsy for listing %d", ListingID)
+	if productid, ok := productWithoutOfferings(etsy_listing); ok {
+		log.WithFields(log.Fields{
+			"File":      "etsy_ops",
+			"Caller":    "BuildEtsyListingWrite",
+			"ListingID": ListingID,
+		}).Warnf("Skipping the listing as product %d has no offerings", productid)
+		return write, false, nil
+	}
 	for _, p := range etsy_listing.Products {
 		log.WithFields(log.Fields{
 			"File":   "etsy_ops",
-			"Caller": "ReconcileEtsyStockLevel",
+			"Caller": "BuildEtsyListingWrite",
 		}).Debugf("Preparing update for %d %s", p.ProductID, p.Title)
-		var epu EtsyProductUpdate
+		var level etsyProductLevel
 		if skutoset, ok := eSkusToSet[int(p.ProductID)]; ok {
-			epu.Sku = skutoset
+			level.Sku = skutoset
 		} else {
-			epu.Sku = p.Sku
+			level.Sku = p.Sku
 		}
-		var epuo EtsyProductUpdateOffering
+		override := false
 		if stockdelta, ok := delta.EtsyDelta[p.ProductID]; ok {
 			log.WithFields(log.Fields{
 				"File":   "etsy_ops",
-				"Caller": "ReconcileEtsyStockLevel",
+				"Caller": "BuildEtsyListingWrite",
 				"Action": "Read from etsy delta stock map",
 			}).Infof("Product has stock level change required %d", stockdelta)
-			epuo.Quantity = p.Offerings[0].Quantity + stockdelta
-			if epuo.Quantity < 0 {
-				epuo.Quantity = 0
+			level.Quantity = p.Offerings[0].Quantity + stockdelta
+			if level.Quantity < 0 {
+				level.Quantity = 0
 			}
-		} else if stockset, ok := overrideStock[p.Sku]; ok {
+		} else if stockset, ok := overrideStock[p.Sku]; ok && !quarantined[p.Sku] {
 			log.WithFields(log.Fields{
 				"File":   "etsy_ops",
-				"Caller": "ReconcileEtsyStockLevel",
+				"Caller": "BuildEtsyListingWrite",
 				"Action": "Read from override stock map",
 			}).Infof("Product has stock level change required (set via app) %d", stockset)
-			epuo.Quantity = stockset
+			level.Quantity = stockset
+			override = true
 		} else {
-			epuo.Quantity = p.Offerings[0].Quantity
+			level.Quantity = p.Offerings[0].Quantity
+		}
+		if price, ok := delta.EtsyPrice[p.ProductID]; ok && !p.IsDeleted && !quarantined[level.Sku] {
+			previous, err := p.Offerings[0].Price.decimal()
+			if err != nil {
+				return write, false, err
+			}
+			newprice, err := price.decimal()
+			if err != nil {
+				return write, false, err
+			}
+			level.Price = &price
+			if newprice != previous {
+				haschanges = true
+			}
+			write.Prices = append(write.Prices, PlannedPrice{
+				SKU:       level.Sku,
+				ProductID: p.ProductID,
+				Previous:  previous,
+				Price:     newprice,
+				Currency:  price.CurrencyCode,
+			})
+		}
+		levels[p.ProductID] = level
+		if level.Sku != p.Sku || level.Quantity != p.Offerings[0].Quantity {
+			haschanges = true
+		}
+		if p.IsDeleted || quarantined[level.Sku] {
+			continue
+		}
+		write.Levels = append(write.Levels, PlannedLevel{
+			SKU:       level.Sku,
+			ProductID: p.ProductID,
+			Previous:  p.Offerings[0].Quantity,
+			Quantity:  level.Quantity,
+			Override:  override,
+		})
+	}
+	apiUpdate, err := buildEtsyInventoryUpdate(etsy_listing, levels)
+	if err != nil {
+		return write, false, err
+	}
+	payload, err := json.Marshal(apiUpdate)
+	if err != nil {
+		return write, false, err
+	}
+	write.Payload = string(payload)
+	return write, haschanges, nil
+}
+
+// productWithoutOfferings returns the first product of the listing that has no offerings
+func productWithoutOfferings(etsy_listing etsyListing) (int64, bool) {
+	for _, p := range etsy_listing.Products {
+		if len(p.Offerings) == 0 {
+			return p.ProductID, true
+		}
+	}
+	return 0, false
+}
+
+// etsyProductLevel is the sku and quantity an inventory update gives a product, and its price when a
+// price sync changes it
+type etsyProductLevel struct {
+	Sku      string
+	Quantity int
+	Price    *etsyMoney
+}
+
+// buildEtsyInventoryUpdate builds the listing inventory PUT from the inventory as read, giving each
+// product the sku, quantity and price in levels and keeping everything else. The PUT replaces the whole
+// inventory, so every product is sent, without the product and offering ids etsy assigns, and with the
+// price as a decimal rather than an amount and divisor.
+func buildEtsyInventoryUpdate(etsy_listing etsyListing, levels map[int64]etsyProductLevel) (EtsyAPIUpdate, error) {
+	var apiUpdate EtsyAPIUpdate
+	apiUpdate.PriceOnProperty = etsy_listing.PriceOnProperty
+	apiUpdate.QuantityOnProperty = etsy_listing.QuantityOnProperty
+	apiUpdate.SkuOnProperty = etsy_listing.SkuOnProperty
+	apiUpdate.Extra = etsy_listing.Extra
+	for _, p := range etsy_listing.Products {
+		if len(p.Offerings) == 0 {
+			return apiUpdate, fmt.Errorf("product %d has no offerings", p.ProductID)
 		}
+		level, ok := levels[p.ProductID]
+		if !ok {
+			level = etsyProductLevel{Sku: p.Sku, Quantity: p.Offerings[0].Quantity}
+		}
+		var epu EtsyProductUpdate
+		epu.Sku = level.Sku
+		epu.Extra = p.Extra
+		var epuo EtsyProductUpdateOffering
+		epuo.Extra = p.Offerings[0].Extra
+		epuo.Quantity = level.Quantity
 		epuo.IsEnabled = p.Offerings[0].IsEnabled
-		epuo.Price = (float64(p.Offerings[0].Price.Amount) / float64(p.Offerings[0].Price.Divisor))
+		epuo.Price = etsyPrice(p.Offerings[0].Price)
+		if level.Price != nil {
+			epuo.Price = etsyPrice(*level.Price)
+		}
 		epu.Offerings = append(epu.Offerings, epuo)
 		for _, pv := range p.PropertyValues {
 			log.WithFields(log.Fields{
 				"File":   "etsy_ops",
-				"Caller": "ReconcileEtsyStockLevel",
+				"Caller": "BuildEtsyInventoryUpdate",
 				"Action": "Prepare update",
 			}).Debugf("Adding property value %s", pv.PropertyName)
 			var epupv EtsyProductUpdatePropertyValues
 			epupv.PropertyID = pv.PropertyID
 			epupv.PropertyName = pv.PropertyName
+			epupv.ScaleID = pv.ScaleID
+			epupv.Extra = pv.Extra
 			epupv.ValueIds = pv.ValueIds
 			epupv.Values = pv.Values
 			epu.PropertyValues = append(epu.PropertyValues, epupv)
 		}
 		apiUpdate.Products = append(apiUpdate.Products, epu)
 	}
-	payload, err := json.Marshal(apiUpdate)
-	if err != nil {
-		panic(err)
-	}
+	return apiUpdate, nil
+}
+
+// applyEtsyListingWrite sends the listing inventory update to etsy and records the new stock levels
+func applyEtsyListingWrite(storename, clientid string, token etsyAccess, run *SyncRun, write EtsyListingWrite, client *mongo.Client) error {
 	log.WithFields(log.Fields{
 		"File":   "etsy_ops",
-		"Caller": "ReconcileEtsyStockLevel",
-	}).Debugf("Sending update to Etsy: %s", string(payload))
-	if err = updateEtsyShopListing(ListingID, string(payload), clientid, token); err != nil {
+		"Caller": "ApplyEtsyListingWrite",
+	}).Debugf("Sending update to Etsy: %s", write.Payload)
+	if err := updateEtsyShopListing(write.ListingID, write.Payload, clientid, token); err != nil {
 		log.WithFields(log.Fields{
 			"File":    "etsy_ops",
-			"Caller":  "ReconcileEtsyStockLevel",
+			"Caller":  "ApplyEtsyListingWrite",
 			"Calling": "UpdateEtsyShopListing",
 		}).Errorf("Could not update etsy : %v", err)
 		return err
 	}
 	log.WithFields(log.Fields{
 		"File":   "etsy_ops",
-		"Caller": "ReconcileEtsyStockLevel",
-	}).Infof("Successfully updated Etsy listing stock level for %d", ListingID)
-	if err = setEtsyStockLevelForProducts(storename, apiUpdate.Products, client); err != nil {
+		"Caller": "ApplyEtsyListingWrite",
+	}).Infof("Successfully updated Etsy listing stock level for %d", write.ListingID)
+	if err := recordRunChanges(run, etsyRunChanges(storename, run.ID, write), client); err != nil {
 		log.WithFields(log.Fields{
 			"File":    "etsy_ops",
-			"Caller":  "ReconcileEtsyStockLevel",
+			"Caller":  "ApplyEtsyListingWrite",
+			"Calling": "RecordRunChanges",
+		}).Errorf("failed to record Etsy changes for run %v", err)
+	}
+	if err := setEtsyStockLevelForProducts(storename, write.Levels, client); err != nil {
+		log.WithFields(log.Fields{
+			"File":    "etsy_ops",
+			"Caller":  "ApplyEtsyListingWrite",
 			"Calling": "SetEtsyStockLevelForProducts",
 		}).Errorf("failed to write Etsy Product stock to DB %v", err)
 	}
+	if err := setEtsyPrices(storename, write.Prices, client); err != nil {
+		log.WithFields(log.Fields{
+			"File":    "etsy_ops",
+			"Caller":  "ApplyEtsyListingWrite",
+			"Calling": "SetEtsyPrices",
+		}).Errorf("failed to write Etsy Product prices to DB %v", err)
+	}
 	return nil
 }
+
+// etsyConnection is the channel adapter for a further etsy shop, using the token stored on another shop record
+type etsyConnection struct {
+	conn     ChannelConnection
+	clientid string
+	token    etsyAccess
+	shopid   string
+	listings map[int]etsyListing
+}
+
+func newEtsyConnection(config Config, conn ChannelConnection, client *mongo.Client) (*etsyConnection, error) {
+	if conn.TokenFrom == "" {
+		return nil, fmt.Errorf("etsy connection %s has no token_from shop", conn.ID)
+	}
+	tokens := etsyTokens(config, client)
+	if _, err := tokens.Token(conn.TokenFrom); err != nil {
+		return nil, err
+	}
+	token := tokens.Access(conn.TokenFrom)
+	shopid := conn.Account
+	if shopid == "" {
+		var err error
+		if shopid, err = getUsersEtsyShops(conn.TokenFrom, config.ETSY_CLIENT_ID, token, client); err != nil {
+			return nil, err
+		}
+	}
+	return &etsyConnection{
+		conn:     conn,
+		clientid: config.ETSY_CLIENT_ID,
+		token:    token,
+		shopid:   shopid,
+		listings: make(map[int]etsyListing),
+	}, nil
+}
+
+// etsyItemKey identifies a product within a listing by sku, as etsy issues new product ids whenever the
+// listing inventory is updated
+func etsyItemKey(listingid int, p etsyProduct) string {
+	if p.Sku != "" {
+		return fmt.Sprintf("%d/%s", listingid, p.Sku)
+	}
+	return fmt.Sprintf("%d/%d", listingid, p.ProductID)
+}
+
+func (e *etsyConnection) fetch() ([]ConnectionStockItem, error) {
+	var items []ConnectionStockItem
+	listings, err := getEtsyShopListings(e.shopid, e.clientid, e.token)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range listings {
+		listing, err := getListingInventory(l.ListingID, e.clientid, e.token)
+		if err != nil {
+			return nil, err
+		}
+		e.listings[l.ListingID] = listing
+		for _, p := range listing.Products {
+			if p.IsDeleted || len(p.Offerings) == 0 {
+				continue
+			}
+			items = append(items, ConnectionStockItem{
+				ItemKey:  etsyItemKey(l.ListingID, p),
+				SKU:      p.Sku,
+				ItemID:   strconv.FormatInt(p.ProductID, 10),
+				ParentID: strconv.Itoa(l.ListingID),
+				Title:    l.Title,
+				Current:  p.Offerings[0].Quantity,
+			})
+		}
+	}
+	return items, nil
+}
+
+// planWrites builds one listing inventory update per listing from the inventory read by the last fetch
+func (e *etsyConnection) planWrites(levels []ConnectionLevel) ([]ConnectionWrite, error) {
+	var writes []ConnectionWrite
+	bylisting := make(map[string][]ConnectionLevel)
+	var order []string
+	for _, l := range levels {
+		if _, ok := bylisting[l.ParentID]; !ok {
+			order = append(order, l.ParentID)
+		}
+		bylisting[l.ParentID] = append(bylisting[l.ParentID], l)
+	}
+	for _, parent := range order {
+		listingid, err := strconv.Atoi(parent)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listing id %s", parent)
+		}
+		listing, ok := e.listings[listingid]
+		if !ok {
+			return nil, fmt.Errorf("listing %d has not been read", listingid)
+		}
+		delta := StockReconciliationDelta{EtsyDelta: make(map[int64]int)}
+		for _, l := range bylisting[parent] {
+			productid, _ := strconv.ParseInt(l.ItemID, 10, 64)
+			product, ok := findEtsyProduct(listing, productid, l.SKU)
+			if !ok {
+				return nil, fmt.Errorf("product %s is no longer in listing %d", l.ItemID, listingid)
+			}
+			delta.EtsyDelta[product.ProductID] = l.Quantity - product.Offerings[0].Quantity
+		}
+		write, haschanges, err := buildEtsyListingWrite(listingid, listing, delta, nil, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if haschanges {
+			writes = append(writes, ConnectionWrite{Target: parent, Payload: write.Payload, Levels: bylisting[parent]})
+		}
+	}
+	return writes, nil
+}
+
+func (e *etsyConnection) applyWrite(write ConnectionWrite) ([]ConnectionLevel, error) {
+	listingid, err := strconv.Atoi(write.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listing id %s", write.Target)
+	}
+	if err := updateEtsyShopListing(listingid, write.Payload, e.clientid, e.token); err != nil {
+		return nil, err
+	}
+	return write.Levels, nil
+}
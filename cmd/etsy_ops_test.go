@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var updateGoldens = flag.Bool("update", false, "rewrite the golden files of the etsy payload cases from the payloads built now")
+
+// A payloadCase is an etsy listing inventory as read from the api and the changes a run would make to
+// it. Its golden file holds the inventory update built for it, which is what etsy would be sent.
+type payloadCase struct {
+	Description string `json:"description"`
+	ListingID   int    `json:"listing_id"`
+	// the response of the listing inventory GET
+	Inventory     json.RawMessage   `json:"inventory"`
+	EtsyDelta     map[string]int    `json:"etsy_delta,omitempty"`
+	SkusToSet     map[string]string `json:"skus_to_set,omitempty"`
+	OverrideStock map[string]int    `json:"override_stock,omitempty"`
+	Quarantined   []string          `json:"quarantined,omitempty"`
+	// the prices a price sync sets, by product id, in the currency of the offering
+	EtsyPrices map[string]string `json:"etsy_prices,omitempty"`
+}
+
+type payloadGolden struct {
+	Error   string          `json:"error,omitempty"`
+	Changed bool            `json:"changed"`
+	Levels  []PlannedLevel  `json:"levels"`
+	Prices  []PlannedPrice  `json:"prices,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// TestEtsyPayloadGoldens builds the inventory update of every case in testdata/etsy_payloads and compares
+// it with the case's golden file. After an intended change to the payload, go test -run
+// TestEtsyPayloadGoldens -update rewrites the golden files, and their diff shows what etsy will be sent.
+func TestEtsyPayloadGoldens(t *testing.T) {
+	cases, err := filepath.Glob("testdata/etsy_payloads/*.case.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("no payload cases in testdata/etsy_payloads")
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(strings.TrimSuffix(filepath.Base(c), ".case.json"), func(t *testing.T) {
+			goldenfile := strings.TrimSuffix(c, ".case.json") + ".golden.json"
+			built, err := buildPayloadCase(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *updateGoldens {
+				if err := ioutil.WriteFile(goldenfile, built, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			golden, err := ioutil.ReadFile(goldenfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			same, err := sameJSON(built, golden)
+			if err != nil {
+				t.Fatalf("unable to compare with the golden file: %v", err)
+			}
+			if !same {
+				t.Errorf("the payload differs from the golden file\n  want %s\n  got  %s", compactJSON(golden), compactJSON(built))
+			}
+		})
+	}
+}
+
+// readPayloadCase reads a case and the listing inventory in it
+func readPayloadCase(filename string) (payloadCase, etsyListing, error) {
+	var pc payloadCase
+	var inventory etsyListing
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return pc, inventory, err
+	}
+	if err := json.Unmarshal(b, &pc); err != nil {
+		return pc, inventory, fmt.Errorf("unable to read payload case %s: %v", filename, err)
+	}
+	if err := json.Unmarshal(pc.Inventory, &inventory); err != nil {
+		return pc, inventory, fmt.Errorf("unable to read the inventory of %s: %v", filename, err)
+	}
+	return pc, inventory, nil
+}
+
+// buildPayloadCase builds the inventory update for a case through buildEtsyListingWrite, as a run would
+func buildPayloadCase(filename string) ([]byte, error) {
+	pc, inventory, err := readPayloadCase(filename)
+	if err != nil {
+		return nil, err
+	}
+	delta := StockReconciliationDelta{EtsyDelta: make(map[int64]int)}
+	for id, d := range pc.EtsyDelta {
+		productid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid product id %s in %s", id, filename)
+		}
+		delta.EtsyDelta[productid] = d
+	}
+	skus := make(map[int]string)
+	for id, sku := range pc.SkusToSet {
+		productid, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid product id %s in %s", id, filename)
+		}
+		skus[productid] = sku
+	}
+	quarantined := make(map[string]bool)
+	for _, sku := range pc.Quarantined {
+		quarantined[sku] = true
+	}
+	if len(pc.EtsyPrices) > 0 {
+		delta.EtsyPrice = make(map[int64]etsyMoney)
+	}
+	for id, price := range pc.EtsyPrices {
+		productid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid product id %s in %s", id, filename)
+		}
+		currency := ""
+		for _, p := range inventory.Products {
+			if p.ProductID == productid && len(p.Offerings) > 0 {
+				currency = p.Offerings[0].Price.CurrencyCode
+			}
+		}
+		if delta.EtsyPrice[productid], err = parseEtsyMoney(price, currency); err != nil {
+			return nil, fmt.Errorf("%v in %s", err, filename)
+		}
+	}
+
+	var golden payloadGolden
+	write, changed, err := buildEtsyListingWrite(pc.ListingID, inventory, delta, skus, pc.OverrideStock, quarantined)
+	if err != nil {
+		golden.Error = err.Error()
+	} else {
+		golden.Changed = changed
+		golden.Levels = write.Levels
+		golden.Prices = write.Prices
+		golden.Payload = json.RawMessage(write.Payload)
+	}
+	out, err := json.MarshalIndent(golden, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// TestEtsyPayloadPrices checks for every case that a stock update sends the price of every product
+// exactly as it was read, whatever the golden file says, as a stock update must never move a price
+func TestEtsyPayloadPrices(t *testing.T) {
+	cases, err := filepath.Glob("testdata/etsy_payloads/*.case.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(strings.TrimSuffix(filepath.Base(c), ".case.json"), func(t *testing.T) {
+			if err := checkPayloadPrices(c); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// propertyKey identifies a product of a listing by its property values, which the payload sends back
+// without the product id
+func propertyKey(pvs []etsyPropertyValue) string {
+	var parts []string
+	for _, pv := range pvs {
+		parts = append(parts, fmt.Sprintf("%d:%v", pv.PropertyID, pv.ValueIds))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// checkPayloadPrices builds a stock update with no changes for a case and matches every product of the
+// payload with the product of the inventory that has the same property values
+func checkPayloadPrices(filename string) error {
+	pc, inventory, err := readPayloadCase(filename)
+	if err != nil {
+		return err
+	}
+	if _, ok := productWithoutOfferings(inventory); ok {
+		// the listing is skipped, which its golden file records
+		return nil
+	}
+	write, _, err := buildEtsyListingWrite(pc.ListingID, inventory, StockReconciliationDelta{}, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to build the payload: %v", err)
+	}
+	var payload struct {
+		Products []struct {
+			PropertyValues []etsyPropertyValue `json:"property_values"`
+			Offerings      []struct {
+				Price json.Number `json:"price"`
+			} `json:"offerings"`
+		} `json:"products"`
+	}
+	dec := json.NewDecoder(strings.NewReader(write.Payload))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		return err
+	}
+	sent := make(map[string]string)
+	for _, p := range payload.Products {
+		key := propertyKey(p.PropertyValues)
+		if _, ok := sent[key]; ok {
+			return fmt.Errorf("more than one product with property values [%s] is sent", key)
+		}
+		if len(p.Offerings) != 1 {
+			return fmt.Errorf("product with property values [%s] is sent with %d offerings, want 1", key, len(p.Offerings))
+		}
+		sent[key] = p.Offerings[0].Price.String()
+	}
+	if len(sent) != len(inventory.Products) {
+		return fmt.Errorf("%d products are sent for the %d of the listing", len(sent), len(inventory.Products))
+	}
+	for _, p := range inventory.Products {
+		key := propertyKey(p.PropertyValues)
+		got, ok := sent[key]
+		if !ok {
+			return fmt.Errorf("product %d with property values [%s] is not sent", p.ProductID, key)
+		}
+		price := p.Offerings[0].Price
+		want, err := price.decimal()
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("product %d price %s (%d/%d) sent as %s", p.ProductID, want, price.Amount, price.Divisor, got)
+		}
+	}
+	return nil
+}
+
+// sameJSON compares two json documents ignoring formatting and the order of object keys. Numbers are
+// compared as written, so 12.5 and 12.50 differ.
+func sameJSON(a, b []byte) (bool, error) {
+	var da, db interface{}
+	deca := json.NewDecoder(bytes.NewReader(a))
+	deca.UseNumber()
+	if err := deca.Decode(&da); err != nil {
+		return false, err
+	}
+	decb := json.NewDecoder(bytes.NewReader(b))
+	decb.UseNumber()
+	if err := decb.Decode(&db); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(da, db), nil
+}
+
+func compactJSON(b []byte) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		return string(b)
+	}
+	return buf.String()
+}
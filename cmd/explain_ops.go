@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func explainCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop the sku belongs to")
+	sku := fs.String("sku", "", "the sku to explain")
+	limit := fs.Int64("n", 10, "the number of recent run changes to show")
+	offline := fs.Bool("offline", false, "explain from the stock collection only, without reading the live levels")
+	fs.Parse(args)
+	if *shop == "" || *sku == "" {
+		return fmt.Errorf("usage: %s", commands["explain"].Usage)
+	}
+	return explainSku(config, *shop, *sku, *limit, *offline, client)
+}
+
+// explainSku prints everything the sync knows about a sku and the changes the next run would make to it,
+// with the reason for each decision
+func explainSku(config Config, storename, sku string, limit int64, offline bool, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	cursor, err := stockCollection.Find(ctx, bson.M{"shopify_domain": storename, "sku": sku})
+	if err != nil {
+		return err
+	}
+	var items []StockItem
+	if err := cursor.All(ctx, &items); err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("no stock record for sku %s in %s", sku, storename)
+	}
+
+	fmt.Printf("Stock records for sku %s:\n", sku)
+	for _, i := range items {
+		fmt.Printf("  %s\n", i.ID.Hex())
+		fmt.Printf("    shopify variant %s (%s / %s), inventory item %s at location %s\n", i.VariantID, i.Parent, i.VariantName, i.InventoryID, i.LocationID)
+		fmt.Printf("    shopify stock previous %d current %d\n", i.PriorAvailable, i.Available)
+		fmt.Printf("    etsy product %d (%s) in shop %d, initialised %v\n", i.EtsyProductID, i.EtsyProductTitle, i.EtsyShopID, i.EtsyItemInitialised)
+		fmt.Printf("    etsy stock previous %d current %d\n", i.EtsyPriorQuantity, i.EtsyQuantity)
+		fmt.Printf("    override requested %v (level %d), sku link requested %v, quarantined %v\n", i.OverrideStockRequested, i.OverrideStockLevel, i.EtsySkuSyncRequested, i.SkuQuarantined)
+	}
+	conflicts, err := getSkuConflicts(storename, client)
+	if err != nil {
+		return err
+	}
+	for _, c := range conflicts {
+		if c.SKU == sku {
+			fmt.Printf("  conflict on %s: %v\n", c.Channel, c.IDs)
+		}
+	}
+	connstock, err := connectionStockForSku(storename, sku, client)
+	if err != nil {
+		return err
+	}
+	for _, c := range connstock {
+		fmt.Printf("  connection %s (%s) item %s: previous %d current %d, read %s\n", c.ConnectionID, c.Channel, c.ItemKey, c.Previous, c.Current, c.UpdatedAt.Format("2006-01-02 15:04"))
+	}
+
+	changes, err := getRunChangesForSku(storename, sku, limit, client)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nLast %d changes written for sku %s:\n", len(changes), sku)
+	for _, c := range changes {
+		target := c.Channel
+		if c.ConnectionID != "" {
+			target = "connection " + c.ConnectionID
+		}
+		rolledback := ""
+		if c.RolledBack {
+			rolledback = " (rolled back)"
+		}
+		fmt.Printf("  %s run %s %s %d -> %d%s\n", c.ChangedAt.Format("2006-01-02 15:04"), c.RunID.Hex(), target, c.Before, c.After, rolledback)
+	}
+
+	fmt.Printf("\nNext run:\n")
+	if len(items) > 1 {
+		fmt.Printf("  %d stock records share the sku, the run matches etsy products to one of them only\n", len(items))
+	}
+	item := items[0]
+	if item.SkuQuarantined {
+		fmt.Println("  no change: the sku is quarantined as it is shared by more than one item on a store")
+		return nil
+	}
+	if item.OverrideStockRequested {
+		fmt.Printf("  both stores set to %d: a stock level was requested via the app, changes on either store are ignored\n", item.OverrideStockLevel)
+		return nil
+	}
+
+	shopifylive, etsylive := item.Available, item.EtsyQuantity
+	hasetsy := item.EtsyProductID != 0
+	if !offline {
+		if item.InventoryID != "" {
+			shopifylive, err = getShopifyInventoryLevel(storename, getstoretoken(storename, client), shopifyNumericID(item.InventoryID), shopifyNumericID(item.LocationID))
+			if err != nil {
+				return err
+			}
+		}
+		bysku, byproduct, conflicts, err := liveEtsyLevels(config, storename, client)
+		if err != nil {
+			return err
+		}
+		for _, c := range conflicts {
+			if c.SKU == sku {
+				fmt.Printf("  the sku is on etsy products %s, only product %d is read\n", strings.Join(c.IDs, ", "), item.EtsyProductID)
+			}
+		}
+		if q, ok := bysku[sku]; ok {
+			etsylive, hasetsy = q, true
+		} else if q, ok := byproduct[item.EtsyProductID]; ok {
+			etsylive, hasetsy = q, true
+		} else {
+			hasetsy = false
+		}
+		fmt.Printf("  live levels: shopify %d, etsy %d\n", shopifylive, etsylive)
+	} else {
+		fmt.Println("  using the recorded current levels as the live levels, so only the connections can show a change")
+	}
+
+	// the run records the live level as current and the recorded current level as previous
+	shopifychange := shopifylive - item.Available
+	etsychange := etsylive - item.EtsyQuantity
+	fmt.Printf("  shopify changed by %d since the last run\n", shopifychange)
+	if !hasetsy {
+		fmt.Println("  no etsy product has the sku, so nothing is written to etsy and shopify only changes with the connections")
+		etsychange = 0
+	} else if !item.EtsyItemInitialised {
+		fmt.Printf("  etsy change ignored: the etsy product has not been initialised, its level %d becomes the baseline\n", etsylive)
+		etsychange = 0
+	} else {
+		fmt.Printf("  etsy changed by %d since the last run\n", etsychange)
+	}
+	connectionchange := 0
+	for _, c := range connstock {
+		connectionchange += c.delta()
+	}
+	if connectionchange != 0 {
+		fmt.Printf("  connections changed by %d (recorded, not read live)\n", connectionchange)
+	}
+
+	if hasetsy && shopifychange+connectionchange != 0 {
+		fmt.Printf("  etsy set to %d: its live level plus the shopify and connection changes\n", clampStock(etsylive+shopifychange+connectionchange))
+	} else if hasetsy {
+		fmt.Println("  etsy left alone: nothing changed elsewhere")
+	}
+	if etsychange+connectionchange != 0 {
+		fmt.Printf("  shopify set to %d: its live level plus the etsy and connection changes\n", clampStock(shopifylive+etsychange+connectionchange))
+	} else {
+		fmt.Println("  shopify left alone: nothing changed elsewhere")
+	}
+	fmt.Println("  the plan is subject to the guardrails and may be held for approval")
+	return nil
+}
+
+func clampStock(quantity int) int {
+	if quantity < 0 {
+		return 0
+	}
+	return quantity
+}
+
+func connectionStockForSku(storename, sku string, client *mongo.Client) ([]ConnectionStockItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var items []ConnectionStockItem
+	stockCollection := client.Database("etsync").Collection("connection_stock")
+	cursor, err := stockCollection.Find(ctx, bson.M{"shopify_domain": storename, "sku": sku})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &items)
+	return items, err
+}
+
+func getRunChangesForSku(storename, sku string, limit int64, client *mongo.Client) ([]RunChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var changes []RunChange
+	changeCollection := client.Database("etsync").Collection("run_changes")
+	opts := options.Find().SetSort(bson.M{"changed_at": -1}).SetLimit(limit)
+	cursor, err := changeCollection.Find(ctx, bson.M{"shopify_domain": storename, "sku": sku}, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &changes)
+	return changes, err
+}
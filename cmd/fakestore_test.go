@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The fake stores emulate the parts of the shopify and etsy apis used by the worker, keeping the stock
+// levels in memory so that full sync cycles can be run against them. Shopify is served under
+// /{shop}/admin/api/... and etsy under /v3/..., the tests change the levels between runs directly.
+
+type fakeShopifyVariant struct {
+	ID              int64  `json:"id"`
+	SKU             string `json:"sku"`
+	Name            string `json:"name"`
+	InventoryItemID int64  `json:"inventory_item"`
+	Available       int    `json:"available"`
+	Price           string `json:"price,omitempty"`
+	CompareAtPrice  string `json:"compare_at_price,omitempty"`
+	// untracked variants are listed without shopify inventory management, so the worker skips them
+	Untracked bool `json:"untracked,omitempty"`
+}
+
+type fakeShopifyProduct struct {
+	ID       int64                 `json:"id"`
+	Title    string                `json:"title"`
+	Variants []*fakeShopifyVariant `json:"variants"`
+}
+
+type fakeShopifyStore struct {
+	Shop       string                `json:"shop"`
+	LocationID int64                 `json:"location"`
+	Products   []*fakeShopifyProduct `json:"products"`
+	bulk       map[string][]byte
+	current    string
+}
+
+type fakeEtsyProduct struct {
+	ProductID int64     `json:"product_id"`
+	SKU       string    `json:"sku"`
+	Quantity  int       `json:"quantity"`
+	Price     etsyPrice `json:"price"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	// the value of the colour variation, for listings whose products vary by colour
+	Colour string `json:"colour,omitempty"`
+	// the product is returned without offerings, as etsy does for some listings with broken variations
+	NoOfferings bool `json:"no_offerings,omitempty"`
+}
+
+type fakeEtsyListing struct {
+	ListingID int                `json:"listing_id"`
+	Title     string             `json:"title"`
+	Products  []*fakeEtsyProduct `json:"products"`
+}
+
+type fakeEtsyShop struct {
+	UserID   int                `json:"user_id"`
+	ShopID   int                `json:"shop_id"`
+	ShopName string             `json:"shop_name"`
+	Listings []*fakeEtsyListing `json:"listings"`
+}
+
+// fakeStoreFixture is the catalogue the fake stores start with
+type fakeStoreFixture struct {
+	Shopify []*fakeShopifyStore `json:"shopify"`
+	Etsy    []*fakeEtsyShop     `json:"etsy"`
+}
+
+type fakeStores struct {
+	mu       sync.Mutex
+	fixture  fakeStoreFixture
+	baseURL  string
+	sequence int64
+}
+
+var defaultFakeFixture = fakeStoreFixture{
+	Shopify: []*fakeShopifyStore{{
+		Shop:       "fake-shop.myshopify.com",
+		LocationID: 1,
+		Products: []*fakeShopifyProduct{
+			{ID: 10, Title: "Mug", Variants: []*fakeShopifyVariant{
+				{ID: 101, SKU: "MUG-BLUE", Name: "Mug - Blue", InventoryItemID: 1001, Available: 5, Price: "12.50"},
+				{ID: 102, SKU: "MUG-RED", Name: "Mug - Red", InventoryItemID: 1002, Available: 3, Price: "12.50"},
+			}},
+			{ID: 20, Title: "Bowl", Variants: []*fakeShopifyVariant{
+				{ID: 201, SKU: "BOWL", Name: "Bowl - Default Title", InventoryItemID: 2001, Available: 8, Price: "20.00"},
+			}},
+			{ID: 30, Title: "Plate", Variants: []*fakeShopifyVariant{
+				{ID: 301, SKU: "PLATE", Name: "Plate - Default Title", InventoryItemID: 3001, Available: 4, Price: "15.00"},
+			}},
+		},
+	}},
+	Etsy: []*fakeEtsyShop{{
+		UserID:   12345,
+		ShopID:   67890,
+		ShopName: "FakeShop",
+		Listings: []*fakeEtsyListing{
+			{ListingID: 1, Title: "Mug", Products: []*fakeEtsyProduct{
+				{ProductID: 11, SKU: "MUG-BLUE", Quantity: 5, Price: etsyPrice{Amount: 1250, Divisor: 100}, Colour: "Blue"},
+				{ProductID: 12, SKU: "MUG-RED", Quantity: 3, Price: etsyPrice{Amount: 1250, Divisor: 100}, Colour: "Red"},
+			}},
+			{ListingID: 2, Title: "Bowl", Products: []*fakeEtsyProduct{
+				{ProductID: 21, SKU: "BOWL", Quantity: 8, Price: etsyPrice{Amount: 2000, Divisor: 100}},
+			}},
+			// the plate is listed on etsy without a sku, to be linked to the shopify variant
+			{ListingID: 3, Title: "Plate", Products: []*fakeEtsyProduct{
+				{ProductID: 31, Quantity: 4, Price: etsyPrice{Amount: 1500, Divisor: 100}},
+			}},
+		},
+	}},
+}
+
+// newFakeStores copies the fixture so that the same fixture can seed several fake stores
+func newFakeStores(fixture fakeStoreFixture) *fakeStores {
+	f := &fakeStores{sequence: 1000000}
+	b, _ := json.Marshal(fixture)
+	json.Unmarshal(b, &f.fixture)
+	for _, s := range f.fixture.Shopify {
+		s.bulk = make(map[string][]byte)
+	}
+	return f
+}
+
+// startFakeStores serves the fake stores on a local test server and points the api urls of the worker at
+// it until the test ends
+func startFakeStores(t *testing.T, fixture fakeStoreFixture) *fakeStores {
+	f := newFakeStores(fixture)
+	server := httptest.NewServer(f)
+	f.baseURL = server.URL
+	previous := apiURLs
+	apiURLs = apiEndpoints{
+		EtsyAPI:   server.URL,
+		EtsyOAuth: server.URL,
+		Shopify:   server.URL + "/{shop}",
+		EbayAPI:   previous.EbayAPI,
+	}
+	t.Cleanup(func() {
+		apiURLs = previous
+		server.Close()
+	})
+	return f
+}
+
+func (f *fakeStores) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.baseURL == "" {
+		f.baseURL = "http://" + r.Host
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case parts[0] == "v3":
+		f.serveEtsy(w, r, parts[1:])
+	case len(parts) > 1:
+		store := f.shopifyStore(parts[0])
+		if store == nil {
+			http.Error(w, `{"errors":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		f.serveShopify(w, r, store, parts[1:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeStores) nextID() int64 {
+	f.sequence++
+	return f.sequence
+}
+
+func (f *fakeStores) shopifyStore(shop string) *fakeShopifyStore {
+	for _, s := range f.fixture.Shopify {
+		if s.Shop == shop {
+			return s
+		}
+	}
+	return nil
+}
+
+func writeFakeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeStores) serveShopify(w http.ResponseWriter, r *http.Request, store *fakeShopifyStore, parts []string) {
+	if parts[0] == "bulk" && len(parts) == 2 {
+		// the bulk results are downloaded without the access token, like the signed urls shopify returns
+		body, ok := store.bulk[strings.TrimSuffix(parts[1], ".jsonl")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/jsonl")
+		w.Write(body)
+		return
+	}
+	if r.Header.Get("X-Shopify-Access-Token") == "" {
+		writeFakeJSON(w, http.StatusUnauthorized, map[string]string{"errors": "[API] Invalid API key or access token"})
+		return
+	}
+	if len(parts) < 4 || parts[0] != "admin" || parts[1] != "api" {
+		http.NotFound(w, r)
+		return
+	}
+	switch strings.Join(parts[3:], "/") {
+	case "graphql.json":
+		f.serveShopifyGraphQL(w, r, store)
+	case "inventory_levels/set.json":
+		r.ParseForm()
+		location, _ := strconv.ParseInt(r.PostForm.Get("location_id"), 10, 64)
+		item, _ := strconv.ParseInt(r.PostForm.Get("inventory_item_id"), 10, 64)
+		available, err := strconv.Atoi(r.PostForm.Get("available"))
+		v := store.variantByInventoryItem(item)
+		if location != store.LocationID || v == nil || err != nil {
+			writeFakeJSON(w, http.StatusUnprocessableEntity, map[string]string{"errors": "Inventory item or location not found"})
+			return
+		}
+		v.Available = available
+		writeFakeJSON(w, http.StatusOK, map[string]interface{}{"inventory_level": store.inventoryLevel(v)})
+	case "inventory_levels.json":
+		var levels []interface{}
+		for _, id := range strings.Split(r.URL.Query().Get("inventory_item_ids"), ",") {
+			item, _ := strconv.ParseInt(id, 10, 64)
+			if v := store.variantByInventoryItem(item); v != nil {
+				levels = append(levels, store.inventoryLevel(v))
+			}
+		}
+		writeFakeJSON(w, http.StatusOK, map[string]interface{}{"inventory_levels": levels})
+	default:
+		id, ok := fakeVariantPath(parts[3:])
+		if !ok || r.Method != http.MethodPut {
+			http.NotFound(w, r)
+			return
+		}
+		var update struct {
+			Variant struct {
+				Price string `json:"price"`
+			} `json:"variant"`
+		}
+		v := store.variant(id)
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil || v == nil || update.Variant.Price == "" {
+			writeFakeJSON(w, http.StatusUnprocessableEntity, map[string]string{"errors": "Variant not found or price missing"})
+			return
+		}
+		v.Price = update.Variant.Price
+		writeFakeJSON(w, http.StatusOK, map[string]interface{}{"variant": map[string]interface{}{"id": v.ID, "sku": v.SKU, "price": v.Price}})
+	}
+}
+
+// fakeVariantPath reads the variant id from a variants/{id}.json path
+func fakeVariantPath(parts []string) (int64, bool) {
+	if len(parts) != 2 || parts[0] != "variants" || !strings.HasSuffix(parts[1], ".json") {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.TrimSuffix(parts[1], ".json"), 10, 64)
+	return id, err == nil
+}
+
+// serveShopifyGraphQL handles the two bulk queries and the currentBulkOperation poll. Each bulk query
+// completes at once, its results being a snapshot of the levels at the time it was run.
+func (f *fakeStores) serveShopifyGraphQL(w http.ResponseWriter, r *http.Request, store *fakeShopifyStore) {
+	body, _ := ioutil.ReadAll(r.Body)
+	query := string(body)
+	now := time.Now().UTC()
+	switch {
+	case strings.Contains(query, "bulkOperationRunQuery"):
+		var results []byte
+		if strings.Contains(query, "inventoryItems") {
+			results = store.inventoryLevelsJSONL(now)
+		} else {
+			results = store.productVariantsJSONL()
+		}
+		id := fmt.Sprintf("%d", f.nextID())
+		store.bulk[id] = results
+		store.current = id
+		writeFakeJSON(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{
+				"bulkOperationRunQuery": map[string]interface{}{
+					"bulkOperation": map[string]string{"id": "gid://shopify/BulkOperation/" + id, "status": "CREATED"},
+					"userErrors":    []string{},
+				},
+			},
+		})
+	case strings.Contains(query, "currentBulkOperation"):
+		if store.current == "" {
+			writeFakeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"currentBulkOperation": nil}})
+			return
+		}
+		writeFakeJSON(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{
+				"currentBulkOperation": map[string]interface{}{
+					"id":             "gid://shopify/BulkOperation/" + store.current,
+					"status":         "COMPLETED",
+					"errorCode":      nil,
+					"createdAt":      now,
+					"completedAt":    now,
+					"objectCount":    strconv.Itoa(bytes.Count(store.bulk[store.current], []byte("\n"))),
+					"fileSize":       strconv.Itoa(len(store.bulk[store.current])),
+					"url":            fmt.Sprintf("%s/%s/bulk/%s.jsonl", f.baseURL, store.Shop, store.current),
+					"partialDataUrl": nil,
+				},
+			},
+		})
+	default:
+		writeFakeJSON(w, http.StatusOK, map[string]interface{}{"errors": []map[string]string{{"message": "unsupported query"}}})
+	}
+}
+
+func (s *fakeShopifyStore) variantByInventoryItem(id int64) *fakeShopifyVariant {
+	for _, p := range s.Products {
+		for _, v := range p.Variants {
+			if v.InventoryItemID == id {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func (s *fakeShopifyStore) variant(id int64) *fakeShopifyVariant {
+	for _, p := range s.Products {
+		for _, v := range p.Variants {
+			if v.ID == id {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func (s *fakeShopifyStore) inventoryLevel(v *fakeShopifyVariant) map[string]interface{} {
+	return map[string]interface{}{
+		"inventory_item_id": v.InventoryItemID,
+		"location_id":       s.LocationID,
+		"available":         v.Available,
+	}
+}
+
+// inventoryLevelsJSONL writes the inventory items followed by their level at the location, with
+// the level lines pointing at their item through __parentId as in the bulk results
+func (s *fakeShopifyStore) inventoryLevelsJSONL(now time.Time) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, p := range s.Products {
+		for _, v := range p.Variants {
+			itemgid := fmt.Sprintf("gid://shopify/InventoryItem/%d", v.InventoryItemID)
+			enc.Encode(map[string]string{"id": itemgid})
+			var level InventoryLevel
+			level.Location.ID = fmt.Sprintf("gid://shopify/Location/%d", s.LocationID)
+			level.Location.Address.Address1 = "1 Fake Street"
+			level.Location.Address.City = "Dublin"
+			level.Location.Address.Country = "Ireland"
+			level.Available = v.Available
+			level.ID = fmt.Sprintf("gid://shopify/InventoryLevel/%d?inventory_item_id=%d", s.LocationID, v.InventoryItemID)
+			level.UpdatedAt = now
+			level.InventoryID = itemgid
+			enc.Encode(level)
+		}
+	}
+	return b.Bytes()
+}
+
+func (s *fakeShopifyStore) productVariantsJSONL() []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, p := range s.Products {
+		productgid := fmt.Sprintf("gid://shopify/Product/%d", p.ID)
+		enc.Encode(map[string]string{"id": productgid})
+		for _, v := range p.Variants {
+			management := interface{}("SHOPIFY")
+			if v.Untracked {
+				management = nil
+			}
+			compareAt := interface{}(nil)
+			if v.CompareAtPrice != "" {
+				compareAt = v.CompareAtPrice
+			}
+			enc.Encode(map[string]interface{}{
+				"displayName":         v.Name,
+				"id":                  fmt.Sprintf("gid://shopify/ProductVariant/%d", v.ID),
+				"inventoryManagement": management,
+				"inventoryItem":       map[string]string{"id": fmt.Sprintf("gid://shopify/InventoryItem/%d", v.InventoryItemID)},
+				"sku":                 v.SKU,
+				"price":               v.Price,
+				"compareAtPrice":      compareAt,
+				"product":             map[string]string{"id": productgid, "title": p.Title},
+				"__parentId":          productgid,
+			})
+		}
+	}
+	return b.Bytes()
+}
+
+func (f *fakeStores) serveEtsy(w http.ResponseWriter, r *http.Request, parts []string) {
+	path := strings.Join(parts, "/")
+	if path == "public/oauth/token" {
+		f.serveEtsyToken(w, r)
+		return
+	}
+	if r.Header.Get("x-api-key") == "" || !strings.HasPrefix(r.Header.Get("authorization"), "Bearer ") {
+		writeFakeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid API key or token"})
+		return
+	}
+	if len(parts) != 4 || parts[0] != "application" {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case parts[1] == "users" && parts[3] == "shops":
+		userid, _ := strconv.Atoi(parts[2])
+		for _, s := range f.fixture.Etsy {
+			if s.UserID == userid {
+				writeFakeJSON(w, http.StatusOK, map[string]interface{}{"shop_id": s.ShopID, "shop_name": s.ShopName})
+				return
+			}
+		}
+		writeFakeJSON(w, http.StatusNotFound, map[string]string{"error": "User does not have a shop"})
+	case parts[1] == "shops" && parts[3] == "listings":
+		shopid, _ := strconv.Atoi(parts[2])
+		for _, s := range f.fixture.Etsy {
+			if s.ShopID == shopid {
+				results := []map[string]interface{}{}
+				for _, l := range s.Listings {
+					results = append(results, l.result(s.UserID, s.ShopID))
+				}
+				writeFakeJSON(w, http.StatusOK, map[string]interface{}{"count": len(results), "results": results})
+				return
+			}
+		}
+		writeFakeJSON(w, http.StatusNotFound, map[string]string{"error": "Shop not found"})
+	case parts[1] == "listings" && parts[3] == "inventory":
+		listingid, _ := strconv.Atoi(parts[2])
+		listing := f.etsyListing(listingid)
+		if listing == nil {
+			writeFakeJSON(w, http.StatusNotFound, map[string]string{"error": "Listing not found"})
+			return
+		}
+		if r.Method == "PUT" {
+			var update EtsyAPIUpdate
+			body, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &update); err != nil {
+				writeFakeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := f.updateEtsyListing(listing, update); err != nil {
+				writeFakeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		writeFakeJSON(w, http.StatusOK, listing.inventory())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveEtsyToken issues tokens prefixed with the user id, as etsy does. Authorisation codes are granted
+// to the first etsy shop.
+func (f *fakeStores) serveEtsyToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	var userid string
+	switch r.PostForm.Get("grant_type") {
+	case "refresh_token":
+		userid = strings.Split(r.PostForm.Get("refresh_token"), ".")[0]
+	case "authorization_code":
+		if len(f.fixture.Etsy) > 0 && r.PostForm.Get("code") != "" {
+			userid = strconv.Itoa(f.fixture.Etsy[0].UserID)
+		}
+	}
+	if userid == "" {
+		writeFakeJSON(w, http.StatusBadRequest, etsyOAuthError{Code: "invalid_grant", Description: "the grant is invalid"})
+		return
+	}
+	id := f.nextID()
+	writeFakeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  fmt.Sprintf("%s.access%d", userid, id),
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+		"refresh_token": fmt.Sprintf("%s.refresh%d", userid, id),
+	})
+}
+
+func (f *fakeStores) etsyListing(listingid int) *fakeEtsyListing {
+	for _, s := range f.fixture.Etsy {
+		for _, l := range s.Listings {
+			if l.ListingID == listingid {
+				return l
+			}
+		}
+	}
+	return nil
+}
+
+// fakeEtsyTimestamp is the time every fake listing was created and last changed, as etsy epoch seconds
+const fakeEtsyTimestamp = 1760000000
+
+// the id etsy gives the primary color property of a listing
+const fakeEtsyColourProperty = 200
+
+// result is the listing as the shop listings endpoint returns it, with the fields etsy sends that the
+// worker does not read
+func (l *fakeEtsyListing) result(userid, shopid int) map[string]interface{} {
+	quantity := 0
+	price := etsyMoney{Amount: 0, Divisor: 100, CurrencyCode: "EUR"}
+	variations := false
+	for i, p := range l.Products {
+		if !p.Deleted {
+			quantity += p.Quantity
+		}
+		if i == 0 {
+			price = l.money(p)
+		}
+		variations = variations || p.Colour != ""
+	}
+	return map[string]interface{}{
+		"listing_id":                  l.ListingID,
+		"user_id":                     userid,
+		"shop_id":                     shopid,
+		"title":                       l.Title,
+		"description":                 l.Title + ", handmade.",
+		"state":                       "active",
+		"creation_timestamp":          fakeEtsyTimestamp,
+		"created_timestamp":           fakeEtsyTimestamp,
+		"ending_timestamp":            fakeEtsyTimestamp + 120*24*3600,
+		"original_creation_timestamp": fakeEtsyTimestamp,
+		"last_modified_timestamp":     fakeEtsyTimestamp,
+		"updated_timestamp":           fakeEtsyTimestamp,
+		"state_timestamp":             fakeEtsyTimestamp,
+		"quantity":                    quantity,
+		"shop_section_id":             nil,
+		"featured_rank":               -1,
+		"url":                         fmt.Sprintf("https://www.etsy.com/listing/%d/%s", l.ListingID, strings.ToLower(strings.ReplaceAll(l.Title, " ", "-"))),
+		"num_favorers":                0,
+		"is_taxable":                  true,
+		"is_customizable":             false,
+		"is_personalizable":           false,
+		"listing_type":                "physical",
+		"tags":                        []string{},
+		"materials":                   []string{},
+		"who_made":                    "i_did",
+		"when_made":                   "made_to_order",
+		"is_supply":                   false,
+		"has_variations":              variations,
+		"should_auto_renew":           true,
+		"language":                    "en-US",
+		"price":                       price,
+		"taxonomy_id":                 1633,
+	}
+}
+
+func (l *fakeEtsyListing) money(p *fakeEtsyProduct) etsyMoney {
+	m := etsyMoney(p.Price)
+	if m.CurrencyCode == "" {
+		m.CurrencyCode = "EUR"
+	}
+	return m
+}
+
+// inventory is the listing inventory as etsy returns it: the products with their offerings and property
+// values, and the properties the price, quantity and sku vary on
+func (l *fakeEtsyListing) inventory() map[string]interface{} {
+	onproperty := []int{}
+	var products []map[string]interface{}
+	for _, p := range l.Products {
+		propertyvalues := []map[string]interface{}{}
+		if p.Colour != "" {
+			onproperty = []int{fakeEtsyColourProperty}
+			propertyvalues = append(propertyvalues, map[string]interface{}{
+				"property_id":   fakeEtsyColourProperty,
+				"property_name": "Primary color",
+				"scale_id":      nil,
+				"scale_name":    nil,
+				"value_ids":     []int64{p.ProductID * 100},
+				"values":        []string{p.Colour},
+			})
+		}
+		offerings := []map[string]interface{}{}
+		if !p.NoOfferings {
+			offerings = append(offerings, map[string]interface{}{
+				"offering_id":        p.ProductID * 10,
+				"quantity":           p.Quantity,
+				"is_enabled":         true,
+				"is_deleted":         p.Deleted,
+				"price":              l.money(p),
+				"readiness_state_id": 1402336022581,
+			})
+		}
+		products = append(products, map[string]interface{}{
+			"product_id":      p.ProductID,
+			"sku":             p.SKU,
+			"is_deleted":      p.Deleted,
+			"offerings":       offerings,
+			"property_values": propertyvalues,
+		})
+	}
+	return map[string]interface{}{
+		"products":             products,
+		"price_on_property":    []int{},
+		"quantity_on_property": onproperty,
+		"sku_on_property":      onproperty,
+		"listing":              nil,
+	}
+}
+
+// updateEtsyListing replaces the products of the listing like the inventory PUT, which must list every
+// product. Products keep their ids, etsy can reissue them but the worker matches on sku first.
+func (f *fakeStores) updateEtsyListing(l *fakeEtsyListing, update EtsyAPIUpdate) error {
+	if len(update.Products) != len(l.Products) {
+		return fmt.Errorf("expected %d products, got %d", len(l.Products), len(update.Products))
+	}
+	for i, p := range update.Products {
+		if len(p.Offerings) != 1 {
+			return fmt.Errorf("product %d must have one offering", i)
+		}
+		if p.Offerings[0].Quantity < 0 || p.Offerings[0].Quantity > 999 {
+			return fmt.Errorf("quantity %d is out of range", p.Offerings[0].Quantity)
+		}
+	}
+	for i, p := range update.Products {
+		l.Products[i].SKU = p.Sku
+		l.Products[i].Quantity = p.Offerings[0].Quantity
+		price := p.Offerings[0].Price
+		price.CurrencyCode = l.Products[i].Price.CurrencyCode
+		l.Products[i].Price = price
+	}
+	return nil
+}
+
+// sell takes quantity off the stock of the sku on the store, shopify or etsy
+func (f *fakeStores) sell(t *testing.T, store, sku string, quantity int) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	levels := f.levelsForSku(store, sku)
+	if len(levels) == 0 {
+		t.Fatalf("no %s item has sku %s", store, sku)
+	}
+	for _, level := range levels {
+		*level -= quantity
+	}
+}
+
+// level returns the stock of the sku on the store, shopify or etsy
+func (f *fakeStores) level(t *testing.T, store, sku string) int {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	levels := f.levelsForSku(store, sku)
+	if len(levels) != 1 {
+		t.Fatalf("%d %s items have sku %s", len(levels), store, sku)
+	}
+	return *levels[0]
+}
+
+func (f *fakeStores) levelsForSku(store, sku string) []*int {
+	var levels []*int
+	switch store {
+	case "shopify":
+		for _, s := range f.fixture.Shopify {
+			for _, p := range s.Products {
+				for _, v := range p.Variants {
+					if v.SKU == sku {
+						levels = append(levels, &v.Available)
+					}
+				}
+			}
+		}
+	case "etsy":
+		for _, s := range f.fixture.Etsy {
+			for _, l := range s.Listings {
+				for _, p := range l.Products {
+					if p.SKU == sku {
+						levels = append(levels, &p.Quantity)
+					}
+				}
+			}
+		}
+	}
+	return levels
+}
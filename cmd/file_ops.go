@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const channelFile = "file"
+
+// fileConnection is the channel adapter for stock kept in a spreadsheet or warehouse system. The account
+// is a directory of sku,quantity snapshots (csv, or jsonl lines of {"sku": ..., "quantity": ...}) where the
+// latest file is the current stock and the one before it the prior stock. When an output file is set the
+// reconciled levels of every item are written to it as csv, otherwise the connection is only read.
+type fileConnection struct {
+	conn      ChannelConnection
+	storename string
+	client    *mongo.Client
+}
+
+type fileSnapshotLine struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+func newFileConnection(storename string, conn ChannelConnection, client *mongo.Client) (*fileConnection, error) {
+	if conn.Account == "" {
+		return nil, fmt.Errorf("file connection %s has no directory", conn.ID)
+	}
+	info, err := os.Stat(conn.Account)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("file connection %s: %s is not a directory", conn.ID, conn.Account)
+	}
+	return &fileConnection{conn: conn, storename: storename, client: client}, nil
+}
+
+// snapshots lists the csv and jsonl files in the directory, oldest first, leaving out the output file
+func (f *fileConnection) snapshots() ([]string, error) {
+	entries, err := ioutil.ReadDir(f.conn.Account)
+	if err != nil {
+		return nil, err
+	}
+	output, _ := filepath.Abs(f.conn.Output)
+	var files []os.FileInfo
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || (ext != ".csv" && ext != ".jsonl") || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if path, _ := filepath.Abs(filepath.Join(f.conn.Account, e.Name())); f.conn.Output != "" && path == output {
+			continue
+		}
+		files = append(files, e)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].ModTime().Equal(files[j].ModTime()) {
+			return files[i].Name() < files[j].Name()
+		}
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	var names []string
+	for _, e := range files {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+// readSnapshot reads the stock levels in a snapshot file, a sku listed more than once is counted in full
+func readSnapshot(path string) (map[string]int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	levels := make(map[string]int)
+	if strings.ToLower(filepath.Ext(path)) == ".jsonl" {
+		scanner := bufio.NewScanner(file)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var l fileSnapshotLine
+			if err := json.Unmarshal([]byte(line), &l); err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", path, n, err)
+			}
+			if l.SKU != "" {
+				levels[l.SKU] += l.Quantity
+			}
+		}
+		return levels, scanner.Err()
+	}
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return levels, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if len(record) < 2 || record[0] == "" {
+			continue
+		}
+		qty, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil {
+			if n == 1 {
+				// header row
+				continue
+			}
+			return nil, fmt.Errorf("%s line %d: invalid quantity %q", path, n, record[1])
+		}
+		levels[strings.TrimSpace(record[0])] += qty
+	}
+}
+
+// fetch reads the latest snapshot, with the prior snapshot's level as each item's previous level. The
+// items carry the name of the snapshot so that the change between the two is only applied once.
+func (f *fileConnection) fetch() ([]ConnectionStockItem, error) {
+	var items []ConnectionStockItem
+	names, err := f.snapshots()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no snapshots in %s", f.conn.Account)
+	}
+	latest := names[len(names)-1]
+	current, err := readSnapshot(filepath.Join(f.conn.Account, latest))
+	if err != nil {
+		return nil, err
+	}
+	prior := current
+	if len(names) > 1 {
+		if prior, err = readSnapshot(filepath.Join(f.conn.Account, names[len(names)-2])); err != nil {
+			return nil, err
+		}
+	}
+	log.WithFields(log.Fields{
+		"File":       "file_ops",
+		"Caller":     "Fetch",
+		"Connection": f.conn.ID,
+	}).Debugf("Read %d skus from snapshot %s", len(current), latest)
+	for sku, qty := range current {
+		previous, ok := prior[sku]
+		if !ok {
+			previous = qty
+		}
+		items = append(items, ConnectionStockItem{
+			ItemKey:  sku,
+			SKU:      sku,
+			ItemID:   sku,
+			Current:  qty,
+			Previous: previous,
+			Source:   latest,
+		})
+	}
+	return items, nil
+}
+
+// reconcile works out the levels of the snapshot items against the stock recorded for the connection
+func (f *fileConnection) reconcile(items []ConnectionStockItem) ([]ConnectionStockItem, error) {
+	return reconcileConnectionStock(f.storename, f.conn, items, f.client)
+}
+
+// planWrites writes every level in a single update of the output file, a connection without an output
+// file is only read
+func (f *fileConnection) planWrites(levels []ConnectionLevel) ([]ConnectionWrite, error) {
+	if f.conn.Output == "" {
+		return nil, nil
+	}
+	return []ConnectionWrite{{Target: f.conn.Output, Levels: levels}}, nil
+}
+
+// applyWrite rewrites the output file, which takes every level in the write or none of them
+func (f *fileConnection) applyWrite(write ConnectionWrite) ([]ConnectionLevel, error) {
+	if err := f.writeOutput(write); err != nil {
+		return nil, err
+	}
+	return write.Levels, nil
+}
+
+// writeOutput rewrites the output file with the recorded level of every item on the connection, using
+// the levels in the write for the items it changes
+func (f *fileConnection) writeOutput(write ConnectionWrite) error {
+	stored, err := getConnectionStock(f.storename, f.conn.ID, f.client)
+	if err != nil {
+		return err
+	}
+	levels := make(map[string]int)
+	for _, item := range stored {
+		levels[item.SKU] = item.Current
+	}
+	for _, l := range write.Levels {
+		levels[l.SKU] = l.Quantity
+	}
+	skus := make([]string, 0, len(levels))
+	for sku := range levels {
+		skus = append(skus, sku)
+	}
+	sort.Strings(skus)
+
+	// write to a temporary file first so that a reader never sees a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(write.Target), ".etsync-*.csv")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := csv.NewWriter(tmp)
+	w.Write([]string{"sku", "quantity"})
+	for _, sku := range skus {
+		w.Write([]string{sku, strconv.Itoa(levels[sku])})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), write.Target)
+}
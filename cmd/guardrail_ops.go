@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// checkGuardrails looks for signs that a plan was computed from bad data (a broken bulk export or an
+// API response reading every level as zero) and returns the reason for each check that trips.
+// Stock levels set explicitly via the app are not counted against the limits. The prices of a price sync
+// are checked the same way, so that a bad currency rate cannot reprice every item at once.
+func checkGuardrails(plan SyncPlan, config Config) []string {
+	var reasons []string
+	changes := plan.changes()
+
+	changedskus := make(map[string]bool)
+	for _, c := range changes {
+		if c.Override {
+			continue
+		}
+		changedskus[c.SKU] = true
+		delta := c.Quantity - c.Previous
+		if delta < 0 {
+			delta = -delta
+		}
+		if config.GUARD_MAX_SKU_DELTA > 0 && delta > config.GUARD_MAX_SKU_DELTA {
+			reasons = append(reasons, fmt.Sprintf("stock for sku %s would change by %d (%d -> %d), limit is %d", c.SKU, delta, c.Previous, c.Quantity, config.GUARD_MAX_SKU_DELTA))
+		}
+	}
+
+	if config.GUARD_MAX_CHANGED_PERCENT > 0 && plan.ItemsChecked >= config.GUARD_MIN_ITEMS && plan.ItemsChecked > 0 {
+		percent := float64(len(changedskus)) * 100 / float64(plan.ItemsChecked)
+		if percent > config.GUARD_MAX_CHANGED_PERCENT {
+			reasons = append(reasons, fmt.Sprintf("%d of %d skus (%.0f%%) would change, limit is %.0f%%", len(changedskus), plan.ItemsChecked, percent, config.GUARD_MAX_CHANGED_PERCENT))
+		}
+	}
+
+	repricedskus := make(map[string]bool)
+	for _, p := range plannedPrices(plan) {
+		repricedskus[p.SKU] = true
+		if config.GUARD_MAX_PRICE_CHANGE_PERCENT <= 0 {
+			continue
+		}
+		percent, ok := priceChangePercent(p)
+		if !ok {
+			reasons = append(reasons, fmt.Sprintf("price for sku %s would change from %s to %s", p.SKU, p.Previous, p.Price))
+		} else if percent > config.GUARD_MAX_PRICE_CHANGE_PERCENT {
+			reasons = append(reasons, fmt.Sprintf("price for sku %s would change by %.0f%% (%s -> %s), limit is %.0f%%", p.SKU, percent, p.Previous, p.Price, config.GUARD_MAX_PRICE_CHANGE_PERCENT))
+		}
+	}
+	if config.GUARD_MAX_CHANGED_PERCENT > 0 && plan.ItemsChecked >= config.GUARD_MIN_ITEMS && plan.ItemsChecked > 0 {
+		percent := float64(len(repricedskus)) * 100 / float64(plan.ItemsChecked)
+		if percent > config.GUARD_MAX_CHANGED_PERCENT {
+			reasons = append(reasons, fmt.Sprintf("%d of %d skus (%.0f%%) would be repriced, limit is %.0f%%", len(repricedskus), plan.ItemsChecked, percent, config.GUARD_MAX_CHANGED_PERCENT))
+		}
+	}
+
+	if config.GUARD_BLOCK_ALL_ZERO {
+		if allDropToZero(etsyPlannedLevels(plan), plan.EtsyStocked) {
+			reasons = append(reasons, "every etsy product would drop to zero stock")
+		}
+		if allDropToZero(shopifyPlannedLevels(plan), plan.ShopifyStocked) {
+			reasons = append(reasons, "every shopify variant would drop to zero stock")
+		}
+		for id := range plan.ConnectionItems {
+			if allDropToZero(connectionPlannedLevels(plan, id), plan.ConnectionStocked[id]) {
+				reasons = append(reasons, fmt.Sprintf("every item on connection %s would drop to zero stock", id))
+			}
+		}
+	}
+	return reasons
+}
+
+// allDropToZero reports whether the plan leaves every tracked item at zero, with at least two of them
+// dropping from a positive level in this plan. Stocked is the number of tracked items the plan leaves
+// alone that hold stock, the levels are those of the items it plans. The shop's size does not matter,
+// so a small shop is covered as well.
+func allDropToZero(levels []PlannedLevel, stocked int) bool {
+	if stocked > 0 {
+		return false
+	}
+	dropped := 0
+	for _, l := range levels {
+		if l.Quantity != 0 {
+			return false
+		}
+		if l.Previous > 0 && !l.Override {
+			dropped++
+		}
+	}
+	return dropped > 1
+}
+
+func etsyPlannedLevels(plan SyncPlan) []PlannedLevel {
+	var levels []PlannedLevel
+	for _, w := range plan.EtsyWrites {
+		levels = append(levels, w.Levels...)
+	}
+	return levels
+}
+
+func shopifyPlannedLevels(plan SyncPlan) []PlannedLevel {
+	var levels []PlannedLevel
+	for _, s := range plan.ShopifySets {
+		levels = append(levels, s.PlannedLevel)
+	}
+	return levels
+}
+
+func connectionPlannedLevels(plan SyncPlan, id string) []PlannedLevel {
+	var levels []PlannedLevel
+	for _, w := range plan.ConnectionWrites {
+		if w.ConnectionID != id {
+			continue
+		}
+		for _, l := range w.Levels {
+			levels = append(levels, l.PlannedLevel)
+		}
+	}
+	return levels
+}
+
+// plannedPrices returns every price the plan sets on either store
+func plannedPrices(plan SyncPlan) []PlannedPrice {
+	var prices []PlannedPrice
+	for _, w := range plan.EtsyWrites {
+		prices = append(prices, w.Prices...)
+	}
+	return append(prices, plan.ShopifyPrices...)
+}
+
+// priceChangePercent returns how far a planned price moves from the previous one as a percentage of it,
+// and false when the previous price cannot be read or is not above zero
+func priceChangePercent(p PlannedPrice) (float64, bool) {
+	previous, ok := new(big.Rat).SetString(p.Previous)
+	if !ok || previous.Sign() <= 0 {
+		return 0, false
+	}
+	price, ok := new(big.Rat).SetString(p.Price)
+	if !ok {
+		return 0, false
+	}
+	change := new(big.Rat).Quo(new(big.Rat).Sub(price, previous), previous)
+	percent, _ := new(big.Rat).Mul(change.Abs(change), big.NewRat(100, 1)).Float64()
+	return percent, true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAllZeroGuardrail(t *testing.T) {
+	config := Config{GUARD_BLOCK_ALL_ZERO: true, GUARD_MIN_ITEMS: 20}
+	etsyzero := []EtsyListingWrite{{ListingID: 1, Levels: []PlannedLevel{
+		{SKU: "MUG-BLUE", ProductID: 11, Previous: 5, Quantity: 0},
+		{SKU: "MUG-RED", ProductID: 12, Previous: 3, Quantity: 0},
+	}}}
+	shopifyzero := []ShopifySetCall{
+		{PlannedLevel: PlannedLevel{SKU: "MUG-BLUE", VariantID: "101", Previous: 5, Quantity: 0}},
+		{PlannedLevel: PlannedLevel{SKU: "MUG-RED", VariantID: "102", Previous: 3, Quantity: 0}},
+	}
+	connectionzero := []ConnectionWrite{{ConnectionID: "woo", Levels: []ConnectionLevel{
+		{PlannedLevel: PlannedLevel{SKU: "MUG-BLUE", Previous: 5, Quantity: 0}},
+		{PlannedLevel: PlannedLevel{SKU: "MUG-RED", Previous: 3, Quantity: 0}},
+	}}}
+	cases := []struct {
+		name string
+		plan SyncPlan
+		want []string
+	}{
+		{
+			name: "a small shop dropping every etsy product to zero is held",
+			plan: SyncPlan{ItemsChecked: 2, EtsyWrites: etsyzero},
+			want: []string{"every etsy product would drop to zero stock"},
+		},
+		{
+			name: "an unchanged listing that holds stock",
+			plan: SyncPlan{ItemsChecked: 3, EtsyWrites: etsyzero, EtsyStocked: 1},
+		},
+		{
+			name: "every shopify variant dropping to zero is held",
+			plan: SyncPlan{ItemsChecked: 5, ShopifySets: shopifyzero},
+			want: []string{"every shopify variant would drop to zero stock"},
+		},
+		{
+			name: "shopify variants the plan leaves alone hold stock",
+			plan: SyncPlan{ItemsChecked: 5, ShopifySets: shopifyzero, ShopifyStocked: 3},
+		},
+		{
+			name: "a single variant selling out",
+			plan: SyncPlan{ItemsChecked: 1, ShopifySets: shopifyzero[:1]},
+		},
+		{
+			name: "every connection item dropping to zero is held",
+			plan: SyncPlan{ConnectionItems: map[string]int{"woo": 2}, ConnectionWrites: connectionzero},
+			want: []string{"every item on connection woo would drop to zero stock"},
+		},
+		{
+			name: "connection items the plan leaves alone hold stock",
+			plan: SyncPlan{ConnectionItems: map[string]int{"woo": 4}, ConnectionStocked: map[string]int{"woo": 2}, ConnectionWrites: connectionzero},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := checkGuardrails(c.plan, config)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
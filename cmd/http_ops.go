@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiEndpoints holds the base urls of the store apis, so that the worker can be pointed at fake servers
+// in tests and staging
+type apiEndpoints struct {
+	EtsyAPI   string
+	EtsyOAuth string
+	// the shopify admin url, {shop} is replaced by the shop's myshopify domain
+	Shopify string
+	EbayAPI string
+}
+
+var defaultEndpoints = apiEndpoints{
+	EtsyAPI:   "https://openapi.etsy.com",
+	EtsyOAuth: "https://api.etsy.com",
+	Shopify:   "https://{shop}",
+	EbayAPI:   "https://api.ebay.com",
+}
+
+var (
+	apiURLs = defaultEndpoints
+	// apiHTTP is shared by every call to the store apis so that connections are reused
+	apiHTTP = newAPIClient(nil, 60*time.Second)
+	// downloadHTTP downloads the results of the shopify bulk queries, which take longer than an api call.
+	// It shares the transport of apiHTTP, so the downloads are recorded and replayed with the api calls.
+	downloadHTTP = &http.Client{Transport: apiHTTP.Transport, Timeout: 30 * time.Minute}
+)
+
+func newAPIClient(transport http.RoundTripper, timeout time.Duration) *http.Client {
+	if transport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.MaxIdleConnsPerHost = 10
+		transport = t
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// initHTTPClient sets the base urls and timeout of the store apis from the config
+func initHTTPClient(config Config) {
+	apiURLs = apiEndpoints{
+		EtsyAPI:   baseURL(config.ETSY_API_URL, defaultEndpoints.EtsyAPI),
+		EtsyOAuth: baseURL(config.ETSY_OAUTH_URL, defaultEndpoints.EtsyOAuth),
+		Shopify:   baseURL(config.SHOPIFY_API_URL, defaultEndpoints.Shopify),
+		EbayAPI:   baseURL(config.EBAY_API_URL, defaultEndpoints.EbayAPI),
+	}
+	if config.HTTP_TIMEOUT_SECONDS > 0 {
+		apiHTTP.Timeout = time.Duration(config.HTTP_TIMEOUT_SECONDS) * time.Second
+	}
+	if config.BULK_DOWNLOAD_TIMEOUT_MINUTES > 0 {
+		downloadHTTP.Timeout = time.Duration(config.BULK_DOWNLOAD_TIMEOUT_MINUTES) * time.Minute
+	}
+}
+
+// setHTTPTransport replaces the transport used for every call to the store apis, eg. to serve them
+// from recorded responses
+func setHTTPTransport(transport http.RoundTripper) {
+	apiHTTP = newAPIClient(transport, apiHTTP.Timeout)
+	downloadHTTP = &http.Client{Transport: apiHTTP.Transport, Timeout: downloadHTTP.Timeout}
+}
+
+func baseURL(configured, fallback string) string {
+	if configured == "" {
+		return fallback
+	}
+	return strings.TrimSuffix(configured, "/")
+}
+
+// shopifyURL returns the url of a shopify admin api path for the shop
+func shopifyURL(storename, path string) string {
+	return strings.Replace(apiURLs.Shopify, "{shop}", storename, 1) + path
+}
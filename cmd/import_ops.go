@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the kinds of csv that can be imported and exported
+const (
+	importOverrides = "overrides"
+	importLinks     = "links"
+	exportStock     = "stock"
+)
+
+// An importRow is a single validated row of an import, ready to be written to the stock collection
+type importRow struct {
+	Line      int
+	SKU       string
+	Quantity  int
+	ProductID int
+}
+
+func importCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to import into")
+	kind := fs.String("kind", "", "overrides (sku,quantity) or links (etsy_product_id,sku), read from the header row when not set")
+	dryrun := fs.Bool("dry-run", false, "validate the file and report what would be set without changing anything")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *shop == "" {
+		return fmt.Errorf("usage: %s", commands["import"].Usage)
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	records, err := readImportCSV(file)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("%s is empty", fs.Arg(0))
+	}
+	start := 0
+	if k := importKindFromHeader(records[0]); k != "" {
+		if *kind == "" {
+			*kind = k
+		}
+		start = 1
+	}
+	var rows []importRow
+	var problems []string
+	switch *kind {
+	case importOverrides:
+		rows, problems, err = validateOverrideRows(*shop, records, start, client)
+	case importLinks:
+		rows, problems, err = validateLinkRows(*shop, records, start, client)
+	default:
+		return fmt.Errorf("unable to tell whether %s holds overrides or links, use -kind", fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%d %s to set, %d rows rejected\n", len(rows), *kind, len(problems))
+	if *dryrun || len(rows) == 0 {
+		return nil
+	}
+	if *kind == importOverrides {
+		return applyOverrideRows(*shop, rows, client)
+	}
+	return applyLinkRows(*shop, rows, client)
+}
+
+func readImportCSV(r io.Reader) ([][]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var nonempty [][]string
+	for _, record := range records {
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+		nonempty = append(nonempty, record)
+	}
+	return nonempty, nil
+}
+
+// importKindFromHeader returns the kind of import named by a header row, or "" if the row is not a header
+func importKindFromHeader(record []string) string {
+	if len(record) < 2 {
+		return ""
+	}
+	switch strings.ToLower(record[0]) + "," + strings.ToLower(record[1]) {
+	case "sku,quantity":
+		return importOverrides
+	case "etsy_product_id,sku":
+		return importLinks
+	}
+	return ""
+}
+
+// stockSkus returns the number of stock records holding each sku of the shop
+func stockSkus(storename string, client *mongo.Client) (map[string]int, map[int]StockItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	cursor, err := stockCollection.Find(ctx, bson.M{"shopify_domain": storename})
+	if err != nil {
+		return nil, nil, err
+	}
+	var items []StockItem
+	if err := cursor.All(ctx, &items); err != nil {
+		return nil, nil, err
+	}
+	skus := make(map[string]int)
+	products := make(map[int]StockItem)
+	for _, item := range items {
+		if item.SKU != "" {
+			skus[item.SKU]++
+		}
+		if item.EtsyProductID != 0 {
+			products[item.EtsyProductID] = item
+		}
+	}
+	return skus, products, nil
+}
+
+// validateOverrideRows checks each sku,quantity row against the stock collection
+func validateOverrideRows(storename string, records [][]string, start int, client *mongo.Client) ([]importRow, []string, error) {
+	var rows []importRow
+	var problems []string
+	skus, _, err := stockSkus(storename, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]int)
+	for i := start; i < len(records); i++ {
+		line, record := i+1, records[i]
+		if len(record) < 2 {
+			problems = append(problems, fmt.Sprintf("line %d: expected sku,quantity", line))
+			continue
+		}
+		qty, err := strconv.Atoi(record[1])
+		if err != nil || qty < 0 {
+			problems = append(problems, fmt.Sprintf("line %d: invalid quantity %q for sku %s", line, record[1], record[0]))
+			continue
+		}
+		if skus[record[0]] == 0 {
+			problems = append(problems, fmt.Sprintf("line %d: unknown sku %s", line, record[0]))
+			continue
+		}
+		if prev, ok := seen[record[0]]; ok {
+			problems = append(problems, fmt.Sprintf("line %d: sku %s is already set on line %d", line, record[0], prev))
+			continue
+		}
+		seen[record[0]] = line
+		rows = append(rows, importRow{Line: line, SKU: record[0], Quantity: qty})
+	}
+	return rows, problems, nil
+}
+
+// validateLinkRows checks each etsy_product_id,sku row against the stock collection, the etsy product
+// has to have been seen by a run and the sku has to be on a shopify variant
+func validateLinkRows(storename string, records [][]string, start int, client *mongo.Client) ([]importRow, []string, error) {
+	var rows []importRow
+	var problems []string
+	skus, products, err := stockSkus(storename, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[int]int)
+	for i := start; i < len(records); i++ {
+		line, record := i+1, records[i]
+		if len(record) < 2 || record[1] == "" {
+			problems = append(problems, fmt.Sprintf("line %d: expected etsy_product_id,sku", line))
+			continue
+		}
+		productid, err := strconv.Atoi(record[0])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: invalid etsy product id %q", line, record[0]))
+			continue
+		}
+		product, ok := products[productid]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("line %d: unknown etsy product %d", line, productid))
+			continue
+		}
+		if skus[record[1]] == 0 {
+			problems = append(problems, fmt.Sprintf("line %d: unknown sku %s", line, record[1]))
+			continue
+		}
+		if product.SKU == record[1] {
+			problems = append(problems, fmt.Sprintf("line %d: etsy product %d already has sku %s", line, productid, record[1]))
+			continue
+		}
+		if prev, ok := seen[productid]; ok {
+			problems = append(problems, fmt.Sprintf("line %d: etsy product %d is already linked on line %d", line, productid, prev))
+			continue
+		}
+		seen[productid] = line
+		rows = append(rows, importRow{Line: line, SKU: record[1], ProductID: productid})
+	}
+	return rows, problems, nil
+}
+
+// applyOverrideRows requests the stock level of each sku, the next run sets it on both stores
+func applyOverrideRows(storename string, rows []importRow, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	var models []mongo.WriteModel
+	for _, r := range rows {
+		models = append(models, mongo.NewUpdateManyModel().
+			SetFilter(bson.M{"shopify_domain": storename, "sku": r.SKU}).
+			SetUpdate(bson.M{"$set": bson.M{"override_stock_requested": true, "override_stock_level": r.Quantity}}))
+	}
+	result, err := stockCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "import_ops",
+			"Caller": "ApplyOverrideRows",
+		}).Errorf("Unable to request stock overrides %v", err)
+		return err
+	}
+	fmt.Printf("Requested stock overrides on %d records\n", result.ModifiedCount)
+	return nil
+}
+
+// applyLinkRows requests the sku of each etsy product, the next run writes it to the etsy listing
+func applyLinkRows(storename string, rows []importRow, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	var models []mongo.WriteModel
+	for _, r := range rows {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"shopify_domain": storename, "e_product_id": r.ProductID}).
+			SetUpdate(bson.M{"$set": bson.M{"sku": r.SKU, "e_sku_sync_requested": true}}))
+	}
+	result, err := stockCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "import_ops",
+			"Caller": "ApplyLinkRows",
+		}).Errorf("Unable to request sku links %v", err)
+		return err
+	}
+	fmt.Printf("Requested sku links on %d records\n", result.ModifiedCount)
+	return nil
+}
+
+func exportCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to export")
+	kind := fs.String("kind", exportStock, "stock (every record), overrides (pending sku,quantity) or links (pending etsy_product_id,sku)")
+	out := fs.String("o", "", "the file to write, defaults to stdout")
+	fs.Parse(args)
+	if *shop == "" {
+		return fmt.Errorf("usage: %s", commands["export"].Usage)
+	}
+	w := os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return exportStockCSV(*shop, *kind, w, client)
+}
+
+// exportStockCSV writes the stock records of the shop as csv, the overrides and links kinds are written
+// in the format import reads
+func exportStockCSV(storename, kind string, w io.Writer, client *mongo.Client) error {
+	filter := bson.M{"shopify_domain": storename}
+	var header []string
+	switch kind {
+	case exportStock:
+		header = []string{"sku", "s_variant_id", "s_curr_stock", "e_product_id", "e_curr_stock", "override_stock_requested", "override_stock_level", "e_sku_sync_requested", "sku_quarantined"}
+	case importOverrides:
+		filter["override_stock_requested"] = true
+		header = []string{"sku", "quantity"}
+	case importLinks:
+		filter["e_sku_sync_requested"] = true
+		header = []string{"etsy_product_id", "sku"}
+	default:
+		return fmt.Errorf("unknown export kind %s", kind)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	cursor, err := stockCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"sku": 1}))
+	if err != nil {
+		return err
+	}
+	var items []StockItem
+	if err := cursor.All(ctx, &items); err != nil {
+		return err
+	}
+	writer := csv.NewWriter(w)
+	writer.Write(header)
+	for _, i := range items {
+		switch kind {
+		case exportStock:
+			writer.Write([]string{
+				i.SKU, i.VariantID, strconv.Itoa(i.Available), strconv.Itoa(i.EtsyProductID), strconv.Itoa(i.EtsyQuantity),
+				strconv.FormatBool(i.OverrideStockRequested), strconv.Itoa(i.OverrideStockLevel),
+				strconv.FormatBool(i.EtsySkuSyncRequested), strconv.FormatBool(i.SkuQuarantined),
+			})
+		case importOverrides:
+			writer.Write([]string{i.SKU, strconv.Itoa(i.OverrideStockLevel)})
+		case importLinks:
+			writer.Write([]string{strconv.Itoa(i.EtsyProductID), i.SKU})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// etsyReadOnlyFields are returned by the listing inventory GET but are not accepted by the PUT
+var etsyReadOnlyFields = []string{"listing", "product_id", "offering_id", "is_deleted"}
+
+// unknownFields returns the fields of a json object that the struct v has no field for, leaving out the
+// read only ones
+func unknownFields(data []byte, v interface{}) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		delete(fields, strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+	}
+	for _, f := range etsyReadOnlyFields {
+		delete(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// marshalWithExtra marshals v and adds the extra fields, the fields of v taking precedence
+func marshalWithExtra(v interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return b, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for k, raw := range extra {
+		if _, ok := fields[k]; !ok {
+			fields[k] = raw
+		}
+	}
+	return json.Marshal(fields)
+}
+
+func (l *etsyListing) UnmarshalJSON(data []byte) error {
+	type plain etsyListing
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	extra, err := unknownFields(data, p)
+	if err != nil {
+		return err
+	}
+	*l = etsyListing(p)
+	l.Extra = extra
+	return nil
+}
+
+func (product *etsyProduct) UnmarshalJSON(data []byte) error {
+	type plain etsyProduct
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	extra, err := unknownFields(data, p)
+	if err != nil {
+		return err
+	}
+	*product = etsyProduct(p)
+	product.Extra = extra
+	return nil
+}
+
+func (o *etsyOffering) UnmarshalJSON(data []byte) error {
+	type plain etsyOffering
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	extra, err := unknownFields(data, p)
+	if err != nil {
+		return err
+	}
+	*o = etsyOffering(p)
+	o.Extra = extra
+	return nil
+}
+
+func (pv *etsyPropertyValue) UnmarshalJSON(data []byte) error {
+	type plain etsyPropertyValue
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	extra, err := unknownFields(data, p)
+	if err != nil {
+		return err
+	}
+	*pv = etsyPropertyValue(p)
+	pv.Extra = extra
+	return nil
+}
+
+func (u EtsyAPIUpdate) MarshalJSON() ([]byte, error) {
+	type plain EtsyAPIUpdate
+	return marshalWithExtra(plain(u), u.Extra)
+}
+
+func (u EtsyProductUpdate) MarshalJSON() ([]byte, error) {
+	type plain EtsyProductUpdate
+	return marshalWithExtra(plain(u), u.Extra)
+}
+
+func (u EtsyProductUpdateOffering) MarshalJSON() ([]byte, error) {
+	type plain EtsyProductUpdateOffering
+	return marshalWithExtra(plain(u), u.Extra)
+}
+
+func (u EtsyProductUpdatePropertyValues) MarshalJSON() ([]byte, error) {
+	type plain EtsyProductUpdatePropertyValues
+	return marshalWithExtra(plain(u), u.Extra)
+}
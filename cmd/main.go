@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"flag"
-	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -13,13 +11,14 @@ import (
 )
 
 var (
-	shopname *string
-	client   *mongo.Client
+	shopname     = flag.String("shop", "", "the shop to run inventory check & set for")
+	debuglogging = flag.Bool("debug", false, "Use Debug log level")
+	holdplans    = flag.Bool("hold", false, "store the computed stock changes for approval instead of applying them")
+	client       *mongo.Client
 )
 
-func init() {
-	shopname = flag.String("shop", "", "the shop to run inventory check & set for")
-	debuglogging := flag.Bool("debug", false, "Use Debug log level")
+func main() {
+	// the flags are parsed here rather than in init so that go test can parse its own
 	flag.Parse()
 	log.Infof("Processing inventory updates for %s", *shopname)
 	if *debuglogging {
@@ -27,14 +26,20 @@ func init() {
 	}
 	log.Debug("Debug Logging Enabled")
 
-}
-
-func main() {
-
 	config, err := LoadConfig(".")
 	if err != nil {
 		log.Fatalf("cannot load config: %v", err)
 	}
+	initHTTPClient(config)
+	if err := initCassette(config); err != nil {
+		log.Fatalf("cannot set up the api cassette: %v", err)
+	}
+	if err := initPriceRates(config); err != nil {
+		log.Fatalf("cannot read the price rates: %v", err)
+	}
+	if err := initTokenEncryption(config); err != nil {
+		log.Fatalf("cannot load token encryption keys: %v", err)
+	}
 	client, err := mongo.NewClient(options.Client().ApplyURI(config.MONGO_URI))
 	if err != nil {
 		log.Fatalf("Cannot instantiate new client: %v", err)
@@ -47,100 +52,15 @@ func main() {
 
 	defer client.Disconnect(ctx)
 
-	// Check if any stock levels are set via the app
-	overridestock, e := getOverrides(*shopname, client)
-	if e != nil {
-		log.Error(e)
-	}
-
-	// Check if any SKUs are set via the app
-	eSkusToSet, e := getItemsToLink(*shopname, client)
-	if e != nil {
-		log.Error(e)
-	}
-	bstock := new(bytes.Buffer)
-	for key, value := range overridestock {
-		fmt.Fprintf(bstock, "%s=%d ", key, value)
-	}
-	bsku := new(bytes.Buffer)
-	for key, value := range eSkusToSet {
-		fmt.Fprintf(bsku, "%d=%s ", key, value)
-	}
-	if len(overridestock) > 0 {
-		log.WithFields(log.Fields{
-			"Caller": "Main",
-		}).Infof("Items for which we need to set stock levels: %v", bstock)
-	}
-	if len(eSkusToSet) > 0 {
-		log.WithFields(log.Fields{
-			"Caller": "Main",
-		}).Infof("Etsy Items for which we need to set the sku: %v", bsku)
-	}
-
-	// Get the Shopify token
-	token := getstoretoken(*shopname, client)
-
-	//Submit the Graphql request for shopify inventory levels at location
-	//returns a url from which to download the results
-	inventoryurl, err := getinventorylevels(*shopname, token)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"Caller":  "Main",
-			"Calling": "GetInventoryLevels",
-		}).Fatalf("Unable to register query for inventory levels: %v", err)
-	}
-	if err = processinventorylevels(inventoryurl, *shopname, client); err != nil {
-		log.WithFields(log.Fields{
-			"Caller":  "Main",
-			"Calling": "ProcessInventoryLevels",
-		}).Fatalf("Unable to process inventory levels: %v", err)
-	}
-
-	//Submit the Graphql request for shopify product variants
-	//returns a url from which to download the results
-	productsurl, err := getproductvariants(*shopname, token)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"Caller":  "Main",
-			"Calling": "ProcessProductLevels",
-		}).Fatalf("Unable to get product variants: %v", err)
-	}
-	log.WithFields(log.Fields{
-		"Caller":  "Main",
-		"Calling": "GetProductVariants",
-	}).Info("Ready to process productvariants")
-	if err = processproductlevels(productsurl, *shopname, client); err != nil {
-		log.WithFields(log.Fields{
-			"Caller":  "Main",
-			"Calling": "ProcessProductLevels",
-		}).Fatalf("Unable to process products: %v", err)
-	}
-
-	// get the etsy stock levels and apply any shopify changes
-	e_token, err := getetsytoken(config, client)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"Caller":  "Main",
-			"Calling": "GetEtsyToken",
-		}).Errorf("Error getting etsy token from db %v", err)
-		log.Fatal("Cannot get Etsy token")
-	}
-	log.WithFields(log.Fields{
-		"Caller":  "Main",
-		"Calling": "GetEtsyToken",
-	}).Infof("Got Token for Etsy (shopify store %s) with expiration time %v", e_token.ShopifyDomain, e_token.EtsyTokenExpires)
-
-	etsyshopid, err := getUsersEtsyShops(*shopname, config.ETSY_CLIENT_ID, e_token.EtsyAccessToken, client)
-	if err != nil {
-	}
-
-	//apply any shopify stock changes to etsy and etsy stock changes to shopify
-	err = getAndSetEtsyShopListings(*shopname, etsyshopid, config.ETSY_CLIENT_ID, e_token.EtsyAccessToken, eSkusToSet, overridestock, client)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"Caller":  "Main",
-			"Calling": "GetAndSetEtsyShopListings",
-		}).Fatalf("Could not retrieve Etsy Listings %v", err)
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args(), config, client); err != nil {
+			log.WithFields(log.Fields{
+				"Caller":  "Main",
+				"Calling": "RunCommand",
+			}).Fatal(err)
+		}
+		return
 	}
 
+	syncShop(config, *shopname, client)
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// etsyMoney is a price as etsy returns it, an amount over a divisor (eg. 1099/100 for 10.99), kept as
+// integers so that it is never rounded
+type etsyMoney struct {
+	Amount       int64  `json:"amount"`
+	Divisor      int64  `json:"divisor"`
+	CurrencyCode string `json:"currency_code"`
+}
+
+// etsyPrice is a price as etsy takes it in a listing inventory update, a decimal number. It is written
+// from the amount and divisor digit for digit, so a price read from etsy is sent back exactly as it was.
+type etsyPrice etsyMoney
+
+// decimal returns the money as a decimal with as many places as the divisor needs, eg. 1250/100 is 12.50
+func (m etsyMoney) decimal() (string, error) {
+	if m.Divisor <= 0 {
+		return "", fmt.Errorf("invalid price divisor %d", m.Divisor)
+	}
+	// the smallest power of ten the divisor divides, which only exists for divisors of the form 2^a5^b
+	scale, places := int64(1), 0
+	for scale%m.Divisor != 0 {
+		if places == 18 {
+			return "", fmt.Errorf("price %d/%d has no exact decimal", m.Amount, m.Divisor)
+		}
+		scale *= 10
+		places++
+	}
+	factor := scale / m.Divisor
+	if m.Amount > math.MaxInt64/factor || m.Amount < -math.MaxInt64/factor {
+		return "", fmt.Errorf("price %d/%d is out of range", m.Amount, m.Divisor)
+	}
+	units := m.Amount * factor
+	sign := ""
+	if units < 0 {
+		sign, units = "-", -units
+	}
+	s := fmt.Sprintf("%0*d", places+1, units)
+	if places > 0 {
+		s = s[:len(s)-places] + "." + s[len(s)-places:]
+	}
+	return sign + s, nil
+}
+
+func (m etsyMoney) String() string {
+	s, err := m.decimal()
+	if err != nil {
+		return fmt.Sprintf("%d/%d %s", m.Amount, m.Divisor, m.CurrencyCode)
+	}
+	return strings.TrimSpace(s + " " + m.CurrencyCode)
+}
+
+// parseEtsyMoney reads a decimal price such as 12.50, the divisor being set by the number of places
+func parseEtsyMoney(decimal, currency string) (etsyMoney, error) {
+	m := etsyMoney{Divisor: 1, CurrencyCode: currency}
+	digits := decimal
+	if i := strings.Index(decimal, "."); i >= 0 {
+		places := len(decimal) - i - 1
+		if places == 0 || places > 18 {
+			return m, fmt.Errorf("invalid price %s", decimal)
+		}
+		for p := 0; p < places; p++ {
+			m.Divisor *= 10
+		}
+		digits = decimal[:i] + decimal[i+1:]
+	}
+	amount, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return m, fmt.Errorf("invalid price %s", decimal)
+	}
+	m.Amount = amount
+	return m, nil
+}
+
+func (p etsyPrice) MarshalJSON() ([]byte, error) {
+	s, err := etsyMoney(p).decimal()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// UnmarshalJSON reads a decimal price, or an amount and divisor as returned by the inventory GET
+func (p *etsyPrice) UnmarshalJSON(data []byte) error {
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		var m etsyMoney
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*p = etsyPrice(m)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	m, err := parseEtsyMoney(n.String(), p.CurrencyCode)
+	if err != nil {
+		return err
+	}
+	*p = etsyPrice(m)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEtsyMoneyDecimal(t *testing.T) {
+	for _, c := range []struct {
+		amount, divisor int64
+		want            string
+	}{
+		{1250, 100, "12.50"},
+		{5, 100, "0.05"},
+		{0, 100, "0.00"},
+		{-1250, 100, "-12.50"},
+		{-5, 100, "-0.05"},
+		{1250, 1, "1250"},
+		{-7, 1, "-7"},
+		{1005, 1000, "1.005"},
+		{1, 8, "0.125"},
+		{3, 20, "0.15"},
+		{-3, 40, "-0.075"},
+		{123456789012345, 100, "1234567890123.45"},
+	} {
+		got, err := etsyMoney{Amount: c.amount, Divisor: c.divisor}.decimal()
+		if err != nil {
+			t.Errorf("%d/%d: %v", c.amount, c.divisor, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%d/%d is %s, want %s", c.amount, c.divisor, got, c.want)
+		}
+	}
+
+	// divisors that are not of the form 2^a5^b have no exact decimal, and a divisor must be positive
+	for _, c := range []struct{ amount, divisor int64 }{
+		{7, 3},
+		{1, 6},
+		{10, 7},
+		{1, 0},
+		{1, -100},
+		{math.MaxInt64, 8},
+		{math.MinInt64, 1},
+	} {
+		if got, err := (etsyMoney{Amount: c.amount, Divisor: c.divisor}).decimal(); err == nil {
+			t.Errorf("%d/%d should not convert, got %s", c.amount, c.divisor, got)
+		}
+	}
+}
+
+func TestParseEtsyMoney(t *testing.T) {
+	for _, c := range []struct {
+		decimal         string
+		amount, divisor int64
+	}{
+		{"12.50", 1250, 100},
+		{"12", 12, 1},
+		{"0.05", 5, 100},
+		{"-12.50", -1250, 100},
+		{"-0.05", -5, 100},
+		{"0.125", 125, 1000},
+	} {
+		m, err := parseEtsyMoney(c.decimal, "GBP")
+		if err != nil {
+			t.Errorf("%s: %v", c.decimal, err)
+			continue
+		}
+		if m.Amount != c.amount || m.Divisor != c.divisor || m.CurrencyCode != "GBP" {
+			t.Errorf("%s read as %+v, want %d/%d GBP", c.decimal, m, c.amount, c.divisor)
+		}
+		// a parsed price is written back digit for digit
+		if back, err := m.decimal(); err != nil || back != c.decimal {
+			t.Errorf("%s written back as %s (%v)", c.decimal, back, err)
+		}
+	}
+
+	for _, s := range []string{"12.", ".", "", "1.2.3", "abc", "1e3", "12,50", "0.1234567890123456789"} {
+		if m, err := parseEtsyMoney(s, "GBP"); err == nil {
+			t.Errorf("%q should not parse, got %+v", s, m)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A pair keeps two stores of the same channel in sync, eg. a wholesale and a retail shopify store or two
+// etsy shops, with no primary store between them. The pair is a shop record of kind pair whose stores are
+// its connections, so it runs through the same delta engine and its stock is kept in connection_stock
+// under the pair's name.
+
+func pairCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("pair", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: %s", commands["pair"].Usage)
+	}
+	return createPair(fs.Arg(0), client)
+}
+
+// createPair adds the shop record for a pair, its stores are then added with connect
+func createPair(name string, client *mongo.Client) error {
+	shop, err := getShopState(name, client)
+	if err == nil && shop.Kind != shopKindPair {
+		return fmt.Errorf("shop %s already exists and is not a pair", name)
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	update := bson.M{"$set": bson.M{"shopify_domain": name, "kind": shopKindPair}}
+	if _, err := shopCollection.UpdateOne(ctx, bson.M{"shopify_domain": name}, update, options.Update().SetUpsert(true)); err != nil {
+		return err
+	}
+	if shop.State == "" {
+		return setShopState(name, shopStateActive, "pair created", client)
+	}
+	return nil
+}
+
+// runPairSync syncs the stores of a pair. Unlike the further connections of a shop, every store of the
+// pair has to be read before anything is recorded, otherwise the changes made on the missing store would
+// be lost.
+func runPairSync(config Config, pairname string, client *mongo.Client) error {
+	run := newSyncRun(pairname, "sync")
+	saveSyncRun(run, client)
+	log.WithFields(log.Fields{
+		"File":   "pair_ops",
+		"Caller": "RunPairSync",
+	}).Infof("Starting run %s for pair %s", run.ID.Hex(), pairname)
+
+	legs, _, err := fetchConnectionLegs(config, run, pairname, true, client)
+	if err != nil {
+		failShop(run, "FetchConnectionLegs", err, client)
+		return err
+	}
+	if len(legs) < 2 {
+		err := fmt.Errorf("pair %s has %d enabled stores, it needs two", pairname, len(legs))
+		failShop(run, "FetchConnectionLegs", err, client)
+		return err
+	}
+	plan := SyncPlan{ShopifyDomain: pairname, CreatedAt: time.Now()}
+	skus := make(map[string]bool)
+	for _, leg := range legs {
+		for _, item := range leg.items {
+			skus[item.SKU] = true
+		}
+	}
+	plan.ItemsChecked = len(skus)
+	run.Products = len(skus)
+	quarantined, err := getQuarantinedSkus(pairname, client)
+	if err != nil {
+		failShop(run, "GetQuarantinedSkus", err, client)
+		return err
+	}
+	if err := planConnectionWrites(&plan, legs, nil, nil, quarantined, nil); err != nil {
+		failShop(run, "PlanConnectionWrites", err, client)
+		return err
+	}
+	if err := submitSyncPlan(config, run, plan, nil, nil, "", client); err != nil {
+		failShop(run, "SubmitSyncPlan", err, client)
+		return err
+	}
+	finishSyncRun(run, client)
+	return updateShopStateAfterRun(run, client)
+}
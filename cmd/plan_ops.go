@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	planStatusApplied       = "applied"
+	planStatusApplying      = "applying"
+	planStatusNeedsApproval = "needs_approval"
+	planStatusParked        = "parked"
+	planStatusRejected      = "rejected"
+	planStatusStale         = "stale"
+)
+
+// planClaimExpiry is how long an approve may hold a plan as applying. A claim older than this was left by
+// an approve that died part way, and the plan can be approved or rejected again.
+const planClaimExpiry = time.Hour
+
+// A PlannedLevel is the stock level a run intends to write for a single etsy product or shopify variant.
+// Previous is the level the item had when the plan was computed.
+type PlannedLevel struct {
+	SKU       string `bson:"sku"`
+	ProductID int64  `bson:"e_product_id,omitempty"`
+	VariantID string `bson:"s_variant_id,omitempty"`
+	Previous  int    `bson:"previous"`
+	Quantity  int    `bson:"quantity"`
+	Override  bool   `bson:"override"`
+}
+
+func (l PlannedLevel) Changed() bool {
+	return l.Previous != l.Quantity
+}
+
+// An EtsyListingWrite is the listing inventory PUT for a single etsy listing. Levels holds every
+// product in the listing that is tracked in the stock collection, whether or not its quantity changes,
+// and Prices the products a price sync reprices.
+type EtsyListingWrite struct {
+	ListingID int            `bson:"listing_id"`
+	Payload   string         `bson:"payload"`
+	Levels    []PlannedLevel `bson:"levels"`
+	Prices    []PlannedPrice `bson:"prices,omitempty"`
+}
+
+// A ShopifySetCall is a single inventory_levels/set.json request
+type ShopifySetCall struct {
+	PlannedLevel    `bson:",inline"`
+	LocationID      string `bson:"s_location_id"`
+	InventoryItemID string `bson:"s_inventory_id"`
+}
+
+// A SyncPlan holds every write a run intends to make to either store. It is computed in full before
+// anything is sent so that it can be checked (and held) as a whole.
+type SyncPlan struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	ShopifyDomain string             `bson:"shopify_domain"`
+	CreatedAt     time.Time          `bson:"created_at"`
+	Status        string             `bson:"status"`
+	HoldReasons   []string           `bson:"hold_reasons,omitempty"`
+	StaleItems    []string           `bson:"stale_items,omitempty"`
+	ResolvedAt    time.Time          `bson:"resolved_at,omitempty"`
+	// when an approve claimed the plan as applying, and the status it had before
+	ClaimedAt    time.Time          `bson:"claimed_at,omitempty"`
+	ClaimedFrom  string             `bson:"claimed_from,omitempty"`
+	ItemsChecked int                `bson:"items_checked"`
+	EtsyWrites   []EtsyListingWrite `bson:"etsy_writes"`
+	ShopifySets  []ShopifySetCall   `bson:"shopify_sets"`
+	// the tracked etsy products and shopify variants the plan leaves alone that hold stock
+	EtsyStocked    int `bson:"etsy_stocked"`
+	ShopifyStocked int `bson:"shopify_stocked"`
+	// the number of items checked on each further connection, how many of them the plan leaves alone
+	// that hold stock, and the writes to them
+	ConnectionItems   map[string]int    `bson:"connection_items,omitempty"`
+	ConnectionStocked map[string]int    `bson:"connection_stocked,omitempty"`
+	ConnectionWrites  []ConnectionWrite `bson:"connection_writes,omitempty"`
+	// the stock read from the connections, recorded as their baseline when the plan is applied
+	ConnectionStock []ConnectionStockItem `bson:"connection_stock,omitempty"`
+	// the backlog the connection writes take up, and the changes left for the connections that could not
+	// be read, both recorded when the plan is applied
+	BacklogTaken      []ConnectionBacklogItem `bson:"backlog_taken,omitempty"`
+	ConnectionBacklog []ConnectionBacklogItem `bson:"connection_backlog,omitempty"`
+	// the variant prices an etsy_to_shopify price sync sets
+	ShopifyPrices []PlannedPrice `bson:"shopify_prices,omitempty"`
+	// the stock records the run moved on, committed when a held plan is approved
+	Baselines []StockBaseline `bson:"baselines,omitempty"`
+}
+
+// changes returns every planned level that alters the stock on either store
+func (p SyncPlan) changes() []PlannedLevel {
+	var changes []PlannedLevel
+	for _, w := range p.EtsyWrites {
+		for _, l := range w.Levels {
+			if l.Changed() {
+				changes = append(changes, l)
+			}
+		}
+	}
+	for _, s := range p.ShopifySets {
+		if s.Changed() {
+			changes = append(changes, s.PlannedLevel)
+		}
+	}
+	for _, w := range p.ConnectionWrites {
+		for _, l := range w.Levels {
+			if l.Changed() {
+				changes = append(changes, l.PlannedLevel)
+			}
+		}
+	}
+	return changes
+}
+
+func (p SyncPlan) isEmpty() bool {
+	return len(p.EtsyWrites) == 0 && len(p.ShopifySets) == 0 && len(p.ConnectionWrites) == 0 && len(p.ShopifyPrices) == 0
+}
+
+// isPending reports whether the plan is still waiting to be approved or rejected, which includes a plan
+// whose claim by an approve has expired
+func (p SyncPlan) isPending() bool {
+	return p.Status == planStatusNeedsApproval || p.Status == planStatusParked || p.claimExpired()
+}
+
+func (p SyncPlan) claimExpired() bool {
+	return p.Status == planStatusApplying && time.Since(p.ClaimedAt) > planClaimExpiry
+}
+
+// applySyncPlan sends every write in the plan to etsy and shopify, updating the db stock levels as it goes
+// and recording each change against the run. A failure on one listing or variant is logged and does not
+// stop the remaining writes.
+func applySyncPlan(config Config, plan SyncPlan, run *SyncRun, etsytoken etsyAccess, shopifytoken string, client *mongo.Client) error {
+	log.WithFields(log.Fields{
+		"File":   "plan_ops",
+		"Caller": "ApplySyncPlan",
+	}).Infof("Applying plan with %d etsy listing updates, %d shopify stock updates, %d shopify price updates and %d connection updates", len(plan.EtsyWrites), len(plan.ShopifySets), len(plan.ShopifyPrices), len(plan.ConnectionWrites))
+	for _, w := range plan.EtsyWrites {
+		if err := applyEtsyListingWrite(plan.ShopifyDomain, config.ETSY_CLIENT_ID, etsytoken, run, w, client); err != nil {
+			log.WithFields(log.Fields{
+				"File":    "plan_ops",
+				"Caller":  "ApplySyncPlan",
+				"Calling": "ApplyEtsyListingWrite",
+			}).Error(err)
+			run.recordError("UpdateEtsyShopListing", fmt.Errorf("listing %d: %v", w.ListingID, err))
+		}
+	}
+	for _, s := range plan.ShopifySets {
+		if err := applyShopifySetCall(plan.ShopifyDomain, shopifytoken, run, s, client); err != nil {
+			log.WithFields(log.Fields{
+				"File":    "plan_ops",
+				"Caller":  "ApplySyncPlan",
+				"Calling": "ApplyShopifySetCall",
+			}).Error(err)
+			run.recordError("SetShopifyInventoryLevel", fmt.Errorf("variant %s: %v", s.VariantID, err))
+		}
+	}
+	for _, p := range plan.ShopifyPrices {
+		if err := applyShopifyPrice(plan.ShopifyDomain, shopifytoken, p, client); err != nil {
+			log.WithFields(log.Fields{
+				"File":    "plan_ops",
+				"Caller":  "ApplySyncPlan",
+				"Calling": "ApplyShopifyPrice",
+			}).Error(err)
+			run.recordError("SetShopifyVariantPrice", fmt.Errorf("variant %s: %v", p.VariantID, err))
+		}
+	}
+	adapters := newConnectionAdapters(config, plan.ShopifyDomain, client)
+	for _, w := range plan.ConnectionWrites {
+		adapter, err := adapters.get(w.ConnectionID)
+		if err == nil {
+			err = applyConnectionWrite(adapter, plan.ShopifyDomain, run, w, client)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"File":    "plan_ops",
+				"Caller":  "ApplySyncPlan",
+				"Calling": "ApplyConnectionWrite",
+			}).Error(err)
+			run.recordError("ApplyConnectionWrite", fmt.Errorf("connection %s: %v", w.ConnectionID, err))
+		}
+	}
+	return nil
+}
+
+// submitSyncPlan applies the plan computed by a run, unless the plan trips one of the guardrails in which
+// case it is held for approval and an alert is raised. Plans are also parked for approval when running
+// with -hold or when they are larger than PLAN_APPROVAL_MIN_CHANGES. before holds the stock baselines
+// the run started from, which a held plan puts back until it is approved.
+func submitSyncPlan(config Config, run *SyncRun, plan SyncPlan, before map[primitive.ObjectID]bson.M, etsytoken etsyAccess, shopifytoken string, client *mongo.Client) error {
+	if plan.isEmpty() {
+		log.WithFields(log.Fields{
+			"File":   "plan_ops",
+			"Caller": "SubmitSyncPlan",
+		}).Info("No stock changes to apply")
+		return commitPlanConnections(plan, client)
+	}
+	if reasons := checkGuardrails(plan, config); len(reasons) > 0 {
+		plan.Status = planStatusNeedsApproval
+		plan.HoldReasons = reasons
+		planid, err := holdSyncPlan(plan, before, client)
+		if err != nil {
+			return err
+		}
+		run.PlanID = &planid
+		run.Status = runStatusHeld
+		raiseAlert(config, plan.ShopifyDomain, "plan_held", fmt.Sprintf("Stock sync plan %s held for approval, no changes were written", planid.Hex()), reasons)
+		return nil
+	}
+	if *holdplans || (config.PLAN_APPROVAL_MIN_CHANGES > 0 && len(plan.changes()) >= config.PLAN_APPROVAL_MIN_CHANGES) {
+		plan.Status = planStatusParked
+		planid, err := holdSyncPlan(plan, before, client)
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"File":   "plan_ops",
+			"Caller": "SubmitSyncPlan",
+		}).Infof("Stock sync plan %s with %d changes parked for approval", planid.Hex(), len(plan.changes()))
+		run.PlanID = &planid
+		run.Status = runStatusParked
+		return nil
+	}
+	if err := commitPlanConnections(plan, client); err != nil {
+		return err
+	}
+	return applySyncPlan(config, plan, run, etsytoken, shopifytoken, client)
+}
+
+// holdSyncPlan stores a plan for approval with the stock baselines the run moved on, and puts those
+// baselines back to where the run found them. The changes the plan was computed from are then only
+// taken up when it is approved, a rejected or stale plan leaving them for the next run.
+func holdSyncPlan(plan SyncPlan, before map[primitive.ObjectID]bson.M, client *mongo.Client) (primitive.ObjectID, error) {
+	if before != nil {
+		after, err := getStockBaselines(plan.ShopifyDomain, client)
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		plan.Baselines = stockBaselineChanges(before, after)
+	}
+	planid, err := savePendingPlan(plan, client)
+	if err != nil {
+		return planid, err
+	}
+	if err := setStockBaselines(plan.Baselines, false, client); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "plan_ops",
+			"Caller": "HoldSyncPlan",
+		}).Errorf("Unable to put back the stock baselines for plan %s %v", planid.Hex(), err)
+		return planid, err
+	}
+	return planid, nil
+}
+
+// savePendingPlan stores a plan that has not been applied in the pending_plans collection
+func savePendingPlan(plan SyncPlan, client *mongo.Client) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	planCollection := client.Database("etsync").Collection("pending_plans")
+	if plan.ID.IsZero() {
+		plan.ID = primitive.NewObjectID()
+	}
+	if _, err := planCollection.InsertOne(ctx, plan); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "plan_ops",
+			"Caller": "SavePendingPlan",
+		}).Errorf("Unable to store plan %v", err)
+		return primitive.NilObjectID, err
+	}
+	return plan.ID, nil
+}
+
+func getPendingPlan(storename, planid string, client *mongo.Client) (SyncPlan, error) {
+	var plan SyncPlan
+	id, err := primitive.ObjectIDFromHex(planid)
+	if err != nil {
+		return plan, fmt.Errorf("invalid plan id %s: %v", planid, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	planCollection := client.Database("etsync").Collection("pending_plans")
+	if err := planCollection.FindOne(ctx, bson.M{"_id": id, "shopify_domain": storename}).Decode(&plan); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "plan_ops",
+			"Caller": "GetPendingPlan",
+		}).Warnf("Unable to find plan %s for %s %v", planid, storename, err)
+		return plan, err
+	}
+	return plan, nil
+}
+
+// getPendingPlans returns the plans for the shop that are waiting for approval or being applied, oldest first
+func getPendingPlans(storename string, client *mongo.Client) ([]SyncPlan, error) {
+	var plans []SyncPlan
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	planCollection := client.Database("etsync").Collection("pending_plans")
+	filter := bson.M{
+		"shopify_domain": storename,
+		"status":         bson.M{"$in": []string{planStatusNeedsApproval, planStatusParked, planStatusApplying}},
+	}
+	cursor, err := planCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "plan_ops",
+			"Caller": "GetPendingPlans",
+		}).Errorf("Error getting pending plans %v", err)
+		return plans, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &plans); err != nil {
+		return plans, err
+	}
+	return plans, nil
+}
+
+// claimPlan marks a pending plan as applying. The update only matches the plan as it was read, so of two
+// operators approving the same plan only the first gets to claim it. A plan whose claim has expired keeps
+// the status it had before it was first claimed.
+func claimPlan(plan SyncPlan, client *mongo.Client) (SyncPlan, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	planCollection := client.Database("etsync").Collection("pending_plans")
+	filter := bson.M{"_id": plan.ID, "status": plan.Status}
+	if plan.Status == planStatusApplying {
+		filter["claimed_at"] = plan.ClaimedAt
+	} else {
+		plan.ClaimedFrom = plan.Status
+	}
+	plan.Status = planStatusApplying
+	plan.ClaimedAt = time.Now()
+	set := bson.M{"status": plan.Status, "claimed_at": plan.ClaimedAt, "claimed_from": plan.ClaimedFrom}
+	result, err := planCollection.UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "plan_ops",
+			"Caller": "ClaimPlan",
+		}).Errorf("Unable to claim plan %s %v", plan.ID.Hex(), err)
+		return plan, err
+	}
+	if result.MatchedCount == 0 {
+		return plan, fmt.Errorf("plan %s has been claimed by another approve or reject", plan.ID.Hex())
+	}
+	return plan, nil
+}
+
+// releasePlan hands a claimed plan back with the status it had before the claim, after an approve that
+// failed before writing to any store
+func releasePlan(plan SyncPlan, client *mongo.Client) {
+	if err := setPlanStatus(plan.ID, planStatusApplying, plan.ClaimedFrom, nil, client); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "plan_ops",
+			"Caller": "ReleasePlan",
+			"Plan":   plan.ID.Hex(),
+		}).Errorf("Unable to hand the plan back, it can be approved or rejected again once its claim expires at %s: %v", plan.ClaimedAt.Add(planClaimExpiry).Format("2006-01-02 15:04"), err)
+	}
+}
+
+// setPlanStatus moves a plan from one status to another. The update only matches while the plan still has
+// the from status, so of two operators acting on the same plan only the first gets to claim it.
+func setPlanStatus(id primitive.ObjectID, from, status string, staleitems []string, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	planCollection := client.Database("etsync").Collection("pending_plans")
+	set := bson.M{
+		"status": status,
+	}
+	if status == planStatusApplied || status == planStatusRejected || status == planStatusStale {
+		set["resolved_at"] = time.Now()
+	}
+	if len(staleitems) > 0 {
+		set["stale_items"] = staleitems
+	}
+	result, err := planCollection.UpdateOne(ctx, bson.M{"_id": id, "status": from}, bson.M{"$set": set})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "plan_ops",
+			"Caller": "SetPlanStatus",
+		}).Errorf("Unable to set status of plan %s to %s %v", id.Hex(), status, err)
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("plan %s is no longer %s, it has been claimed by another approve or reject", id.Hex(), from)
+	}
+	return nil
+}
+
+// verifyPlanIsCurrent compares the levels each item had when the plan was computed with the live
+// levels on etsy and shopify, returning a description of every item that has moved since
+func verifyPlanIsCurrent(config Config, plan SyncPlan, etsytoken etsyAccess, shopifytoken string, client *mongo.Client) ([]string, error) {
+	var moved []string
+	for _, w := range plan.EtsyWrites {
+		listing, err := getListingInventory(w.ListingID, config.ETSY_CLIENT_ID, etsytoken)
+		if err != nil {
+			return moved, err
+		}
+		for _, l := range w.Levels {
+			product, ok := findEtsyProduct(listing, l.ProductID, l.SKU)
+			if !ok {
+				moved = append(moved, fmt.Sprintf("etsy product %d (sku %s) is no longer in listing %d", l.ProductID, l.SKU, w.ListingID))
+			} else if live := product.Offerings[0].Quantity; live != l.Previous {
+				moved = append(moved, fmt.Sprintf("etsy product %d (sku %s) was %d and is now %d", l.ProductID, l.SKU, l.Previous, live))
+			}
+		}
+	}
+	for _, s := range plan.ShopifySets {
+		live, err := getShopifyInventoryLevel(plan.ShopifyDomain, shopifytoken, s.InventoryItemID, s.LocationID)
+		if err != nil {
+			return moved, err
+		}
+		if live != s.Previous {
+			moved = append(moved, fmt.Sprintf("shopify variant %s (sku %s) was %d and is now %d", s.VariantID, s.SKU, s.Previous, live))
+		}
+	}
+	adapters := newConnectionAdapters(config, plan.ShopifyDomain, client)
+	levels := make(map[string]map[string]int)
+	for _, w := range plan.ConnectionWrites {
+		live, ok := levels[w.ConnectionID]
+		if !ok {
+			adapter, err := adapters.get(w.ConnectionID)
+			if err != nil {
+				return moved, err
+			}
+			if live, err = liveConnectionLevels(adapter); err != nil {
+				return moved, err
+			}
+			levels[w.ConnectionID] = live
+		}
+		for _, l := range w.Levels {
+			if current, ok := live[l.ItemKey]; !ok {
+				moved = append(moved, fmt.Sprintf("%s item %s (sku %s) is no longer on connection %s", w.Channel, l.ItemID, l.SKU, w.ConnectionID))
+			} else if current != l.Previous {
+				moved = append(moved, fmt.Sprintf("%s item %s (sku %s) on connection %s was %d and is now %d", w.Channel, l.ItemID, l.SKU, w.ConnectionID, l.Previous, current))
+			}
+		}
+	}
+	return moved, nil
+}
+
+// checkPlanIsCurrent reads the tokens the plan needs and describes every item that has moved since the
+// plan was computed, on the stores or in the db baselines
+func checkPlanIsCurrent(config Config, plan SyncPlan, client *mongo.Client) ([]string, etsyAccess, string, error) {
+	// the primary store tokens are only needed when the plan writes to them, pairs have no primary stores
+	var etoken etsyAccess
+	var stoken string
+	if len(plan.EtsyWrites) > 0 || len(plan.ShopifySets) > 0 || len(plan.ShopifyPrices) > 0 {
+		if _, err := getetsytoken(plan.ShopifyDomain, config, client); err != nil {
+			return nil, etoken, stoken, err
+		}
+		etoken = etsyTokens(config, client).Access(plan.ShopifyDomain)
+		stoken = getstoretoken(plan.ShopifyDomain, client)
+	}
+	moved, err := verifyPlanIsCurrent(config, plan, etoken, stoken, client)
+	if err != nil {
+		return nil, etoken, stoken, err
+	}
+	movedbaselines, err := movedStockBaselines(plan.ShopifyDomain, plan.Baselines, client)
+	if err != nil {
+		return nil, etoken, stoken, err
+	}
+	return append(moved, movedbaselines...), etoken, stoken, nil
+}
+
+// approvePlan applies a pending plan, provided none of the stock levels it was computed from have
+// moved since. A plan that has gone stale is marked as such and must be recomputed by a new run.
+// The plan is claimed as applying before anything is checked, so that it is only ever applied once. It
+// is handed back when the approve fails before writing to a store, and marked stale when it fails after,
+// as some of its writes may have been made. A plan left applying by an approve that died is treated as
+// pending again once its claim expires; approving it then finds the writes it made as moved items.
+func approvePlan(storename, planid string, config Config, client *mongo.Client) error {
+	plan, err := getPendingPlan(storename, planid, client)
+	if err != nil {
+		return err
+	}
+	if !plan.isPending() {
+		return fmt.Errorf("plan %s is %s and cannot be approved", planid, plan.Status)
+	}
+	if plan, err = claimPlan(plan, client); err != nil {
+		return err
+	}
+	moved, etoken, stoken, err := checkPlanIsCurrent(config, plan, client)
+	if err != nil {
+		releasePlan(plan, client)
+		return err
+	}
+	if len(moved) > 0 {
+		for _, m := range moved {
+			log.WithFields(log.Fields{
+				"File":   "plan_ops",
+				"Caller": "ApprovePlan",
+				"Plan":   planid,
+			}).Warn(m)
+		}
+		if err := setPlanStatus(plan.ID, planStatusApplying, planStatusStale, moved, client); err != nil {
+			return err
+		}
+		return fmt.Errorf("plan %s is stale, %d items have changed since it was computed", planid, len(moved))
+	}
+	run := newSyncRun(plan.ShopifyDomain, "approve")
+	run.PlanID = &plan.ID
+	saveSyncRun(run, client)
+	log.WithFields(log.Fields{
+		"File":   "plan_ops",
+		"Caller": "ApprovePlan",
+	}).Infof("Applying plan %s as run %s", planid, run.ID.Hex())
+	if err := setStockBaselines(plan.Baselines, true, client); err != nil {
+		failSyncRun(run, "SetStockBaselines", err, client)
+		setStockBaselines(plan.Baselines, false, client)
+		releasePlan(plan, client)
+		return err
+	}
+	if err := commitPlanConnections(plan, client); err != nil {
+		failSyncRun(run, "CommitPlanConnections", err, client)
+		setStockBaselines(plan.Baselines, false, client)
+		releasePlan(plan, client)
+		return err
+	}
+	if err := applySyncPlan(config, plan, run, etoken, stoken, client); err != nil {
+		failSyncRun(run, "ApplySyncPlan", err, client)
+		if e := setPlanStatus(plan.ID, planStatusApplying, planStatusStale, []string{fmt.Sprintf("applying the plan failed: %v", err)}, client); e != nil {
+			log.WithFields(log.Fields{
+				"File":   "plan_ops",
+				"Caller": "ApprovePlan",
+				"Plan":   planid,
+			}).Error(e)
+		}
+		return err
+	}
+	if err := setPlanStatus(plan.ID, planStatusApplying, planStatusApplied, nil, client); err != nil {
+		failSyncRun(run, "SetPlanStatus", err, client)
+		return err
+	}
+	return finishSyncRun(run, client)
+}
+
+func rejectPlan(storename, planid string, client *mongo.Client) error {
+	plan, err := getPendingPlan(storename, planid, client)
+	if err != nil {
+		return err
+	}
+	if !plan.isPending() {
+		return fmt.Errorf("plan %s is %s and cannot be rejected", planid, plan.Status)
+	}
+	log.WithFields(log.Fields{
+		"File":   "plan_ops",
+		"Caller": "RejectPlan",
+	}).Infof("Discarding plan %s for %s", planid, plan.ShopifyDomain)
+	if plan.Status == planStatusApplying {
+		// the expired claim is taken over first, so that a reject cannot race an approve taking it over
+		if plan, err = claimPlan(plan, client); err != nil {
+			return err
+		}
+	}
+	return setPlanStatus(plan.ID, plan.Status, planStatusRejected, nil, client)
+}
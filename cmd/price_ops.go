@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The price sync copies the price of each sku from one store to the other, adding a markup, raising it to
+// a price ending and converting the currency on the way. It is off unless a direction is set on the shop.
+const (
+	priceSyncShopifyToEtsy = "shopify_to_etsy"
+	priceSyncEtsyToShopify = "etsy_to_shopify"
+)
+
+// PriceSync holds the price sync settings of a shop, stored in the price_sync field of the shop record.
+// The markup and ending are kept as decimals so that they are applied without rounding.
+type PriceSync struct {
+	Direction string `bson:"direction,omitempty"`
+	// a percentage added to the source price, then a fixed amount in the target currency
+	MarkupPercent string `bson:"markup_percent,omitempty"`
+	MarkupFixed   string `bson:"markup_fixed,omitempty"`
+	// the ending a price is raised to, eg. 0.99 makes 12.30 into 12.99 and 13.00 into 13.99
+	Ending string `bson:"ending,omitempty"`
+	// the currency of the shopify prices, which a direction needs to tell when a price must be converted
+	ShopifyCurrency string `bson:"shopify_currency,omitempty"`
+}
+
+// A PlannedPrice is the price a run intends to write for a single etsy product or shopify variant, as
+// decimals. Previous is the price the item had when the plan was computed.
+type PlannedPrice struct {
+	SKU       string `bson:"sku"`
+	ProductID int64  `bson:"e_product_id,omitempty"`
+	VariantID string `bson:"s_variant_id,omitempty"`
+	Previous  string `bson:"previous"`
+	Price     string `bson:"price"`
+	Currency  string `bson:"currency,omitempty"`
+}
+
+// priceRates holds the currency rates read from PRICE_RATES, by FROM:TO
+var priceRates = make(map[string]*big.Rat)
+
+// initPriceRates reads the currency rates the price sync converts with from PRICE_RATES, a comma separated
+// list of FROM:TO=rate, eg. EUR:USD=1.08. A rate is also used the other way unless that rate is given.
+func initPriceRates(config Config) error {
+	rates := make(map[string]*big.Rat)
+	for _, r := range strings.Split(config.PRICE_RATES, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		kv := strings.SplitN(r, "=", 2)
+		pair := strings.Split(strings.ToUpper(strings.TrimSpace(kv[0])), ":")
+		if len(kv) != 2 || len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return fmt.Errorf("invalid price rate %s, expected FROM:TO=rate", r)
+		}
+		rate, ok := new(big.Rat).SetString(strings.TrimSpace(kv[1]))
+		if !ok || rate.Sign() <= 0 {
+			return fmt.Errorf("invalid price rate %s", r)
+		}
+		rates[pair[0]+":"+pair[1]] = rate
+	}
+	priceRates = rates
+	return nil
+}
+
+// convertPrice converts a price between currencies. A price whose currency is not known is not converted
+// at all, as passing it through would set it in the wrong currency.
+func convertPrice(v *big.Rat, from, to string) (*big.Rat, error) {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	if from == "" || to == "" {
+		return nil, fmt.Errorf("unable to convert a price from currency %q to %q", from, to)
+	}
+	if from == to {
+		return v, nil
+	}
+	if rate, ok := priceRates[from+":"+to]; ok {
+		return new(big.Rat).Mul(v, rate), nil
+	}
+	if rate, ok := priceRates[to+":"+from]; ok {
+		return new(big.Rat).Quo(v, rate), nil
+	}
+	return nil, fmt.Errorf("no rate from %s to %s in PRICE_RATES", from, to)
+}
+
+func parseDecimal(name, s string) (*big.Rat, error) {
+	v, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || strings.Contains(s, "/") {
+		return nil, fmt.Errorf("invalid %s %s", name, s)
+	}
+	return v, nil
+}
+
+func (s PriceSync) validate() error {
+	switch s.Direction {
+	case "", priceSyncShopifyToEtsy, priceSyncEtsyToShopify:
+	default:
+		return fmt.Errorf("unknown price sync direction %s", s.Direction)
+	}
+	if s.MarkupPercent != "" {
+		pct, err := parseDecimal("markup percent", s.MarkupPercent)
+		if err != nil {
+			return err
+		}
+		if pct.Cmp(big.NewRat(-100, 1)) <= 0 {
+			return fmt.Errorf("markup percent %s would make every price 0 or less", s.MarkupPercent)
+		}
+	}
+	if s.MarkupFixed != "" {
+		if _, err := parseDecimal("markup", s.MarkupFixed); err != nil {
+			return err
+		}
+	}
+	if s.Ending != "" {
+		e, err := parseDecimal("ending", s.Ending)
+		if err != nil {
+			return err
+		}
+		if e.Sign() < 0 || e.Cmp(big.NewRat(1, 1)) >= 0 {
+			return fmt.Errorf("ending %s must be at least 0 and less than 1", s.Ending)
+		}
+	}
+	if s.Direction != "" && s.ShopifyCurrency == "" {
+		return fmt.Errorf("a price sync needs the currency of the shopify prices, set -shopify-currency")
+	}
+	if s.ShopifyCurrency != "" && len(s.ShopifyCurrency) != 3 {
+		return fmt.Errorf("invalid currency %s", s.ShopifyCurrency)
+	}
+	return nil
+}
+
+// targetPrice works out the price to set from the source price, as a decimal with the given places
+func (s PriceSync) targetPrice(source, from, to string, places int) (string, error) {
+	v, err := parseDecimal("price", source)
+	if err != nil {
+		return "", err
+	}
+	if v, err = convertPrice(v, from, to); err != nil {
+		return "", err
+	}
+	if s.MarkupPercent != "" {
+		pct, err := parseDecimal("markup percent", s.MarkupPercent)
+		if err != nil {
+			return "", err
+		}
+		v.Mul(v, new(big.Rat).Add(big.NewRat(1, 1), new(big.Rat).Quo(pct, big.NewRat(100, 1))))
+	}
+	if s.MarkupFixed != "" {
+		fixed, err := parseDecimal("markup", s.MarkupFixed)
+		if err != nil {
+			return "", err
+		}
+		v.Add(v, fixed)
+	}
+	if s.Ending != "" && v.Sign() > 0 {
+		e, err := parseDecimal("ending", s.Ending)
+		if err != nil {
+			return "", err
+		}
+		// the smallest price with the ending that is not below the marked up price
+		ended := new(big.Rat).Add(new(big.Rat).SetInt(new(big.Int).Quo(v.Num(), v.Denom())), e)
+		if ended.Cmp(v) < 0 {
+			ended.Add(ended, big.NewRat(1, 1))
+		}
+		v = ended
+	}
+	price := v.FloatString(places)
+	if v.Sign() <= 0 || strings.Trim(price, "0.") == "" {
+		return "", fmt.Errorf("price %s would be %s", source, price)
+	}
+	return price, nil
+}
+
+// divisorPlaces returns the number of decimal places of an etsy divisor, which must be a power of ten
+func divisorPlaces(divisor int64) (int, error) {
+	places := 0
+	for d := divisor; d > 1; d /= 10 {
+		if d%10 != 0 {
+			return 0, fmt.Errorf("price divisor %d is not a power of ten", divisor)
+		}
+		places++
+	}
+	if divisor < 1 {
+		return 0, fmt.Errorf("invalid price divisor %d", divisor)
+	}
+	return places, nil
+}
+
+// etsyTargetPrice is the etsy price for a shopify price, in the currency and divisor of the offering
+func (s PriceSync) etsyTargetPrice(shopifyprice string, current etsyMoney) (etsyMoney, error) {
+	places, err := divisorPlaces(current.Divisor)
+	if err != nil {
+		return current, err
+	}
+	price, err := s.targetPrice(shopifyprice, s.ShopifyCurrency, current.CurrencyCode, places)
+	if err != nil {
+		return current, err
+	}
+	return parseEtsyMoney(price, current.CurrencyCode)
+}
+
+// shopifyTargetPrice is the shopify price for an etsy price, shopify taking prices with two places
+func (s PriceSync) shopifyTargetPrice(etsyprice etsyMoney) (string, error) {
+	source, err := etsyprice.decimal()
+	if err != nil {
+		return "", err
+	}
+	return s.targetPrice(source, etsyprice.CurrencyCode, s.ShopifyCurrency, 2)
+}
+
+// samePrice compares two decimal prices by value, so 12.5 and 12.50 are the same
+func samePrice(a, b string) bool {
+	ra, ok := new(big.Rat).SetString(a)
+	if !ok {
+		return false
+	}
+	rb, ok := new(big.Rat).SetString(b)
+	return ok && ra.Cmp(rb) == 0
+}
+
+// comparePrices compares two decimal prices by value as big.Rat.Cmp does, a price that cannot be read
+// comparing as 0
+func comparePrices(a, b string) int {
+	ra, ok := new(big.Rat).SetString(a)
+	if !ok {
+		return 0
+	}
+	rb, ok := new(big.Rat).SetString(b)
+	if !ok {
+		return 0
+	}
+	return ra.Cmp(rb)
+}
+
+func getPriceSync(storename string, client *mongo.Client) (PriceSync, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var shop struct {
+		PriceSync PriceSync `bson:"price_sync"`
+	}
+	shopCollection := client.Database("etsync").Collection("shops")
+	opts := options.FindOne().SetProjection(bson.M{"price_sync": 1})
+	if err := shopCollection.FindOne(ctx, bson.M{"shopify_domain": storename}, opts).Decode(&shop); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "price_ops",
+			"Caller": "GetPriceSync",
+		}).Warnf("Unable to read shop record %v", err)
+		return shop.PriceSync, err
+	}
+	return shop.PriceSync, nil
+}
+
+func setPriceSync(storename string, pricesync PriceSync, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	result, err := shopCollection.UpdateOne(ctx, bson.M{"shopify_domain": storename}, bson.M{"$set": bson.M{"price_sync": pricesync}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("no shop record for %s", storename)
+	}
+	return nil
+}
+
+// getPricedStockItems returns the stock records of the shopify variants by sku
+func getPricedStockItems(storename string, client *mongo.Client) (map[string]StockItem, error) {
+	items := make(map[string]StockItem)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	filter := bson.M{"shopify_domain": storename, "s_variant_id": bson.M{"$exists": true}, "sku": bson.M{"$ne": ""}}
+	cursor, err := stockCollection.Find(ctx, filter)
+	if err != nil {
+		return items, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var item StockItem
+		if err := cursor.Decode(&item); err != nil {
+			return items, err
+		}
+		items[item.SKU] = item
+	}
+	return items, cursor.Err()
+}
+
+// planEtsyPrices works out the prices a shopify_to_etsy price sync gives the products of a listing, by
+// product id. Etsy keeps one price for the products that share the values of the price_on_property
+// properties (every product when it is empty), so a group of products is only repriced when they all
+// come to the same price. Products whose sku is not sold on shopify keep their price.
+func planEtsyPrices(pricesync PriceSync, etsy_listing etsyListing, eSkusToSet map[int]string, quarantined map[string]bool, items map[string]StockItem) map[int64]etsyMoney {
+	prices := make(map[int64]etsyMoney)
+	groups := make(map[string][]etsyProduct)
+	var groupkeys []string
+	for _, p := range etsy_listing.Products {
+		if p.IsDeleted || len(p.Offerings) == 0 {
+			continue
+		}
+		var key []string
+		for _, prop := range etsy_listing.PriceOnProperty {
+			for _, pv := range p.PropertyValues {
+				if fmt.Sprint(pv.PropertyID) == fmt.Sprint(prop) {
+					key = append(key, fmt.Sprint(pv.ValueIds))
+				}
+			}
+		}
+		k := strings.Join(key, "|")
+		if _, ok := groups[k]; !ok {
+			groupkeys = append(groupkeys, k)
+		}
+		groups[k] = append(groups[k], p)
+	}
+	for _, k := range groupkeys {
+		targets := make(map[int64]etsyMoney)
+		consistent := true
+		var first *etsyMoney
+		for _, p := range groups[k] {
+			target := p.Offerings[0].Price
+			sku := p.Sku
+			if s, ok := eSkusToSet[int(p.ProductID)]; ok {
+				sku = s
+			}
+			if item, ok := items[sku]; ok && !quarantined[sku] && item.ShopifyPrice != "" {
+				t, err := pricesync.etsyTargetPrice(item.ShopifyPrice, p.Offerings[0].Price)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"File":   "price_ops",
+						"Caller": "PlanEtsyPrices",
+						"Sku":    sku,
+					}).Warnf("Keeping the price of product %d: %v", p.ProductID, err)
+				} else {
+					target = t
+					targets[p.ProductID] = t
+				}
+			}
+			if first == nil {
+				first = &target
+			} else if target.Amount*first.Divisor != first.Amount*target.Divisor {
+				consistent = false
+			}
+		}
+		if !consistent {
+			log.WithFields(log.Fields{
+				"File":   "price_ops",
+				"Caller": "PlanEtsyPrices",
+			}).Warnf("Keeping the prices of %d products in listing sharing a price as the synced prices differ", len(groups[k]))
+			continue
+		}
+		for _, p := range groups[k] {
+			current := p.Offerings[0].Price
+			if t, ok := targets[p.ProductID]; ok && (t.Amount != current.Amount || t.Divisor != current.Divisor) {
+				prices[p.ProductID] = t
+			}
+		}
+	}
+	return prices
+}
+
+// planShopifyPrices works out the variant prices an etsy_to_shopify price sync sets from the etsy
+// offerings. A sku sold in more than one etsy product takes the price of the first listing it is in. A
+// variant with a compare at price keeps its price when the new one would be above it, as the variant
+// would then show as on sale for more than its full price.
+func planShopifyPrices(pricesync PriceSync, listings []etsyShopListingResult, inventories map[int]etsyListing, eSkusToSet map[int]string, quarantined map[string]bool, items map[string]StockItem) []PlannedPrice {
+	var prices []PlannedPrice
+	seen := make(map[string]bool)
+	for _, l := range listings {
+		for _, p := range inventories[l.ListingID].Products {
+			sku := p.Sku
+			if s, ok := eSkusToSet[int(p.ProductID)]; ok {
+				sku = s
+			}
+			item, ok := items[sku]
+			if !ok || seen[sku] || quarantined[sku] || p.IsDeleted || len(p.Offerings) == 0 || item.ShopifyPrice == "" {
+				continue
+			}
+			seen[sku] = true
+			target, err := pricesync.shopifyTargetPrice(p.Offerings[0].Price)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"File":   "price_ops",
+					"Caller": "PlanShopifyPrices",
+					"Sku":    sku,
+				}).Warnf("Keeping the price of variant %s: %v", item.VariantID, err)
+				continue
+			}
+			if samePrice(target, item.ShopifyPrice) {
+				continue
+			}
+			if item.ShopifyCompareAtPrice != "" && comparePrices(target, item.ShopifyCompareAtPrice) > 0 {
+				log.WithFields(log.Fields{
+					"File":   "price_ops",
+					"Caller": "PlanShopifyPrices",
+					"Sku":    sku,
+				}).Warnf("Keeping the price of variant %s as %s is above its compare at price %s", item.VariantID, target, item.ShopifyCompareAtPrice)
+				continue
+			}
+			prices = append(prices, PlannedPrice{
+				SKU:       sku,
+				VariantID: item.VariantID,
+				Previous:  item.ShopifyPrice,
+				Price:     target,
+				Currency:  pricesync.ShopifyCurrency,
+			})
+		}
+	}
+	return prices
+}
+
+// applyShopifyPrice sends a single variant price to shopify and records the new price
+func applyShopifyPrice(storename, token string, price PlannedPrice, client *mongo.Client) error {
+	log.WithFields(log.Fields{
+		"File":   "price_ops",
+		"Caller": "ApplyShopifyPrice",
+	}).Infof("Updating shopify price for item sku %s from %s to %s", price.SKU, price.Previous, price.Price)
+	variantid := price.VariantID[strings.LastIndex(price.VariantID, "/")+1:]
+	if err := setShopifyVariantPrice(storename, token, variantid, price.Price); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	filter := bson.M{"shopify_domain": storename, "s_variant_id": price.VariantID}
+	if _, err := stockCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"s_price": price.Price}}); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "price_ops",
+			"Caller": "ApplyShopifyPrice",
+		}).Errorf("Unable to record the shopify price of %s: %v", price.SKU, err)
+	}
+	return nil
+}
+
+// setEtsyPrices records the prices written to etsy products
+func setEtsyPrices(storename string, prices []PlannedPrice, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	for _, p := range prices {
+		filter := bson.M{"shopify_domain": storename, "e_product_id": p.ProductID}
+		if _, err := stockCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"e_price": p.Price, "e_currency": p.Currency}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func priceSyncCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("price-sync", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to show or set the price sync of")
+	direction := fs.String("direction", "", "off, shopify_to_etsy or etsy_to_shopify")
+	percent := fs.String("markup-percent", "", "the percentage added to the source price, eg. 10")
+	fixed := fs.String("markup-fixed", "", "the amount added after the percentage, in the target currency")
+	ending := fs.String("ending", "", "the ending prices are raised to, eg. 0.99, none to stop rounding")
+	currency := fs.String("shopify-currency", "", "the currency of the shopify prices, eg. USD")
+	fs.Parse(args)
+	if *shop == "" {
+		return fmt.Errorf("usage: %s", commands["price-sync"].Usage)
+	}
+	pricesync, err := getPriceSync(*shop, client)
+	if err != nil {
+		return err
+	}
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "direction":
+			pricesync.Direction = *direction
+			if *direction == "off" {
+				pricesync.Direction = ""
+			}
+		case "markup-percent":
+			pricesync.MarkupPercent = *percent
+		case "markup-fixed":
+			pricesync.MarkupFixed = *fixed
+		case "ending":
+			pricesync.Ending = *ending
+			if *ending == "none" {
+				pricesync.Ending = ""
+			}
+		case "shopify-currency":
+			pricesync.ShopifyCurrency = strings.ToUpper(*currency)
+		default:
+			return
+		}
+		set = true
+	})
+	if set {
+		if err := pricesync.validate(); err != nil {
+			return err
+		}
+		if err := setPriceSync(*shop, pricesync, client); err != nil {
+			return err
+		}
+	}
+	shown := pricesync.Direction
+	if shown == "" {
+		shown = "off"
+	}
+	fmt.Printf("%s price sync %s markup_percent=%s markup_fixed=%s ending=%s shopify_currency=%s\n",
+		*shop, shown, pricesync.MarkupPercent, pricesync.MarkupFixed, pricesync.Ending, pricesync.ShopifyCurrency)
+	var pairs []string
+	for pair, rate := range priceRates {
+		f, _ := rate.Float64()
+		pairs = append(pairs, pair+"="+strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	sort.Strings(pairs)
+	if len(pairs) > 0 {
+		fmt.Printf("    rates %s\n", strings.Join(pairs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestPriceSyncValidate(t *testing.T) {
+	for _, c := range []struct {
+		sync PriceSync
+		ok   bool
+	}{
+		{PriceSync{}, true},
+		{PriceSync{Direction: priceSyncShopifyToEtsy, ShopifyCurrency: "USD"}, true},
+		{PriceSync{Direction: priceSyncEtsyToShopify, ShopifyCurrency: "GBP", MarkupPercent: "10", Ending: "0.99"}, true},
+		{PriceSync{Direction: priceSyncShopifyToEtsy}, false},
+		{PriceSync{Direction: priceSyncEtsyToShopify}, false},
+		{PriceSync{Direction: "both", ShopifyCurrency: "USD"}, false},
+		{PriceSync{Direction: priceSyncShopifyToEtsy, ShopifyCurrency: "US"}, false},
+		{PriceSync{Direction: priceSyncShopifyToEtsy, ShopifyCurrency: "USD", MarkupPercent: "-100"}, false},
+		{PriceSync{Direction: priceSyncShopifyToEtsy, ShopifyCurrency: "USD", Ending: "1"}, false},
+	} {
+		if err := c.sync.validate(); (err == nil) != c.ok {
+			t.Errorf("%+v: got %v, want ok %v", c.sync, err, c.ok)
+		}
+	}
+}
+
+func TestConvertPrice(t *testing.T) {
+	saved := priceRates
+	t.Cleanup(func() { priceRates = saved })
+	if err := initPriceRates(Config{PRICE_RATES: "EUR:USD=1.25"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		from, to, want string
+	}{
+		{"EUR", "USD", "12.50"},
+		{"usd", "eur", "8.00"},
+		{"GBP", "GBP", "10.00"},
+	} {
+		v, err := convertPrice(big.NewRat(10, 1), c.from, c.to)
+		if err != nil {
+			t.Errorf("%s to %s: %v", c.from, c.to, err)
+		} else if got := v.FloatString(2); got != c.want {
+			t.Errorf("10 %s is %s %s, want %s", c.from, got, c.to, c.want)
+		}
+	}
+	// a price is never passed through when its currency differs or is not known
+	for _, pair := range [][2]string{{"EUR", "GBP"}, {"", "USD"}, {"EUR", ""}, {"", ""}} {
+		if v, err := convertPrice(big.NewRat(10, 1), pair[0], pair[1]); err == nil {
+			t.Errorf("%q to %q should not convert, got %s", pair[0], pair[1], v.FloatString(2))
+		}
+	}
+}
+
+func TestPlanShopifyPricesCompareAt(t *testing.T) {
+	pricesync := PriceSync{Direction: priceSyncEtsyToShopify, ShopifyCurrency: "GBP"}
+	listings := []etsyShopListingResult{{ListingID: 1}}
+	inventories := map[int]etsyListing{1: {Products: []etsyProduct{
+		{ProductID: 11, Sku: "MUG-BLUE", Offerings: []etsyOffering{{Price: etsyMoney{Amount: 1800, Divisor: 100, CurrencyCode: "GBP"}}}},
+		{ProductID: 12, Sku: "MUG-RED", Offerings: []etsyOffering{{Price: etsyMoney{Amount: 1400, Divisor: 100, CurrencyCode: "GBP"}}}},
+		{ProductID: 13, Sku: "BOWL", Offerings: []etsyOffering{{Price: etsyMoney{Amount: 2000, Divisor: 100, CurrencyCode: "GBP"}}}},
+	}}}
+	items := map[string]StockItem{
+		"MUG-BLUE": {SKU: "MUG-BLUE", VariantID: "101", ShopifyPrice: "12.50", ShopifyCompareAtPrice: "15.00"},
+		"MUG-RED":  {SKU: "MUG-RED", VariantID: "102", ShopifyPrice: "12.50", ShopifyCompareAtPrice: "15.00"},
+		"BOWL":     {SKU: "BOWL", VariantID: "201", ShopifyPrice: "18.00"},
+	}
+	prices := planShopifyPrices(pricesync, listings, inventories, nil, nil, items)
+	got := make(map[string]string)
+	for _, p := range prices {
+		got[p.SKU] = p.Price
+	}
+	// MUG-BLUE would go above its compare at price and keeps its price
+	if len(got) != 2 || got["MUG-RED"] != "14.00" || got["BOWL"] != "20.00" {
+		t.Errorf("got prices %v, want MUG-RED 14.00 and BOWL 20.00", got)
+	}
+}
+
+func TestPriceGuardrails(t *testing.T) {
+	config := Config{GUARD_MAX_CHANGED_PERCENT: 50, GUARD_MIN_ITEMS: 4, GUARD_MAX_PRICE_CHANGE_PERCENT: 50}
+	plan := SyncPlan{
+		ItemsChecked: 10,
+		EtsyWrites:   []EtsyListingWrite{{ListingID: 1, Prices: []PlannedPrice{{SKU: "MUG-BLUE", ProductID: 11, Previous: "12.50", Price: "13.50"}}}},
+		ShopifyPrices: []PlannedPrice{
+			{SKU: "BOWL", VariantID: "201", Previous: "18.00", Price: "20.00"},
+		},
+	}
+	if reasons := checkGuardrails(plan, config); len(reasons) != 0 {
+		t.Errorf("small repricing was held: %v", reasons)
+	}
+
+	// a rate entered as 10.8 rather than 1.08 moves a price tenfold
+	plan.ShopifyPrices = append(plan.ShopifyPrices, PlannedPrice{SKU: "PLATE", VariantID: "301", Previous: "9.00", Price: "97.20"})
+	reasons := checkGuardrails(plan, config)
+	if len(reasons) != 1 || !strings.Contains(reasons[0], "PLATE") {
+		t.Errorf("expected the PLATE price to be held, got %v", reasons)
+	}
+
+	// a small change to the price of most skus is held as well
+	plan.ShopifyPrices = nil
+	for _, sku := range []string{"A", "B", "C", "D", "E", "F"} {
+		plan.ShopifyPrices = append(plan.ShopifyPrices, PlannedPrice{SKU: sku, Previous: "10.00", Price: "10.50"})
+	}
+	reasons = checkGuardrails(plan, config)
+	if len(reasons) != 1 || !strings.Contains(reasons[0], "7 of 10 skus") {
+		t.Errorf("expected the repricing of 7 of 10 skus to be held, got %v", reasons)
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	runStatusRunning    = "running"
+	runStatusSucceeded  = "succeeded"
+	runStatusWithErrors = "completed_with_errors"
+	runStatusFailed     = "failed"
+	runStatusHeld       = "held"
+	runStatusParked     = "parked"
+)
+
+// A SyncRun is the record of a single run of the worker against a shop, stored in sync_runs so that
+// the app and operators can see the sync history for each shop
+type SyncRun struct {
+	ID              primitive.ObjectID  `bson:"_id"`
+	ShopifyDomain   string              `bson:"shopify_domain"`
+	Command         string              `bson:"command"`
+	StartedAt       time.Time           `bson:"started_at"`
+	FinishedAt      time.Time           `bson:"finished_at,omitempty"`
+	Variants        int                 `bson:"variants"`
+	InventoryLevels int                 `bson:"inventory_levels"`
+	Listings        int                 `bson:"listings"`
+	Products        int                 `bson:"products"`
+	ShopifyToEtsy   []RunDelta          `bson:"shopify_to_etsy"`
+	EtsyToShopify   []RunDelta          `bson:"etsy_to_shopify"`
+	ToConnections   []RunDelta          `bson:"to_connections,omitempty"`
+	Errors          []RunError          `bson:"errors"`
+	PlanID          *primitive.ObjectID `bson:"plan_id,omitempty"`
+	Status          string              `bson:"status"`
+}
+
+// A RunDelta is a stock change pushed to one of the stores during the run
+type RunDelta struct {
+	SKU        string `bson:"sku"`
+	ID         string `bson:"id"`
+	Connection string `bson:"connection,omitempty"`
+	Before     int    `bson:"before"`
+	After      int    `bson:"after"`
+	Delta      int    `bson:"delta"`
+}
+
+// A RunError is a failed api or db call made during the run
+type RunError struct {
+	Call       string    `bson:"call"`
+	Error      string    `bson:"error"`
+	OccurredAt time.Time `bson:"occurred_at"`
+}
+
+func newSyncRun(storename, command string) *SyncRun {
+	return &SyncRun{
+		ID:            primitive.NewObjectID(),
+		ShopifyDomain: storename,
+		Command:       command,
+		StartedAt:     time.Now(),
+		ShopifyToEtsy: []RunDelta{},
+		EtsyToShopify: []RunDelta{},
+		Errors:        []RunError{},
+		Status:        runStatusRunning,
+	}
+}
+
+func (r *SyncRun) recordError(call string, err error) {
+	r.Errors = append(r.Errors, RunError{
+		Call:       call,
+		Error:      err.Error(),
+		OccurredAt: time.Now(),
+	})
+}
+
+func (r *SyncRun) recordDeltas(changes []RunChange) {
+	for _, c := range changes {
+		d := RunDelta{
+			SKU:    c.SKU,
+			Before: c.Before,
+			After:  c.After,
+			Delta:  c.After - c.Before,
+		}
+		if c.ConnectionID != "" {
+			d.ID = c.ItemID
+			d.Connection = c.ConnectionID
+			r.ToConnections = append(r.ToConnections, d)
+		} else if c.Channel == "etsy" {
+			d.ID = fmt.Sprintf("%d", c.ProductID)
+			r.ShopifyToEtsy = append(r.ShopifyToEtsy, d)
+		} else {
+			d.ID = c.VariantID
+			r.EtsyToShopify = append(r.EtsyToShopify, d)
+		}
+	}
+}
+
+// saveSyncRun writes the current state of the run, it is called when the run starts and again when it finishes
+func saveSyncRun(run *SyncRun, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	runCollection := client.Database("etsync").Collection("sync_runs")
+	opts := options.Replace().SetUpsert(true)
+	if _, err := runCollection.ReplaceOne(ctx, bson.M{"_id": run.ID}, run, opts); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "run_ops",
+			"Caller": "SaveSyncRun",
+		}).Errorf("Unable to save run %s %v", run.ID.Hex(), err)
+		return err
+	}
+	return nil
+}
+
+// finishSyncRun sets the final status of the run, unless a status such as held has already been set
+func finishSyncRun(run *SyncRun, client *mongo.Client) error {
+	if run.Status == runStatusRunning {
+		if len(run.Errors) > 0 {
+			run.Status = runStatusWithErrors
+		} else {
+			run.Status = runStatusSucceeded
+		}
+	}
+	run.FinishedAt = time.Now()
+	log.WithFields(log.Fields{
+		"File":   "run_ops",
+		"Caller": "FinishSyncRun",
+		"Run":    run.ID.Hex(),
+	}).Infof("Run finished with status %s: %d stock changes pushed to etsy, %d to shopify, %d errors", run.Status, len(run.ShopifyToEtsy), len(run.EtsyToShopify), len(run.Errors))
+	return saveSyncRun(run, client)
+}
+
+// failSyncRun records the error that stopped the run and saves it as failed
+func failSyncRun(run *SyncRun, call string, err error, client *mongo.Client) {
+	run.recordError(call, err)
+	run.Status = runStatusFailed
+	finishSyncRun(run, client)
+}
+
+// getSyncRuns returns the most recent runs for the shop, newest first
+func getSyncRuns(storename string, limit int64, client *mongo.Client) ([]SyncRun, error) {
+	var runs []SyncRun
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	runCollection := client.Database("etsync").Collection("sync_runs")
+	opts := options.Find().SetSort(bson.M{"started_at": -1}).SetLimit(limit)
+	cursor, err := runCollection.Find(ctx, bson.M{"shopify_domain": storename}, opts)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "run_ops",
+			"Caller": "GetSyncRuns",
+		}).Errorf("Error getting runs %v", err)
+		return runs, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &runs); err != nil {
+		return runs, err
+	}
+	return runs, nil
+}
+
+// A RunChange records a single stock level written to etsy, shopify or a further connection during a
+// run, with the quantity the item had before the write so that the run can be rolled back
+type RunChange struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty"`
+	RunID           primitive.ObjectID `bson:"run_id"`
+	ShopifyDomain   string             `bson:"shopify_domain"`
+	Channel         string             `bson:"channel"`
+	SKU             string             `bson:"sku"`
+	ListingID       int                `bson:"e_listing_id,omitempty"`
+	ProductID       int64              `bson:"e_product_id,omitempty"`
+	VariantID       string             `bson:"s_variant_id,omitempty"`
+	LocationID      string             `bson:"s_location_id,omitempty"`
+	InventoryItemID string             `bson:"s_inventory_id,omitempty"`
+	ConnectionID    string             `bson:"connection_id,omitempty"`
+	ItemKey         string             `bson:"item_key,omitempty"`
+	ItemID          string             `bson:"item_id,omitempty"`
+	ParentID        string             `bson:"parent_id,omitempty"`
+	Before          int                `bson:"before"`
+	After           int                `bson:"after"`
+	ChangedAt       time.Time          `bson:"changed_at"`
+	RolledBack      bool               `bson:"rolled_back"`
+}
+
+// recordRunChanges adds the changes to the deltas pushed by the run and stores them in run_changes
+func recordRunChanges(run *SyncRun, changes []RunChange, client *mongo.Client) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	run.recordDeltas(changes)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	changeCollection := client.Database("etsync").Collection("run_changes")
+	docs := make([]interface{}, len(changes))
+	for i, c := range changes {
+		c.ChangedAt = time.Now()
+		docs[i] = c
+	}
+	if _, err := changeCollection.InsertMany(ctx, docs); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "run_ops",
+			"Caller": "RecordRunChanges",
+		}).Errorf("Unable to record changes for run %s %v", changes[0].RunID.Hex(), err)
+		return err
+	}
+	return nil
+}
+
+// etsyRunChanges returns the changes to record for a listing write that etsy has accepted
+func etsyRunChanges(storename string, runid primitive.ObjectID, write EtsyListingWrite) []RunChange {
+	var changes []RunChange
+	for _, l := range write.Levels {
+		if !l.Changed() {
+			continue
+		}
+		changes = append(changes, RunChange{
+			RunID:         runid,
+			ShopifyDomain: storename,
+			Channel:       "etsy",
+			SKU:           l.SKU,
+			ListingID:     write.ListingID,
+			ProductID:     l.ProductID,
+			Before:        l.Previous,
+			After:         l.Quantity,
+		})
+	}
+	return changes
+}
+
+func shopifyRunChange(storename string, runid primitive.ObjectID, call ShopifySetCall) RunChange {
+	return RunChange{
+		RunID:           runid,
+		ShopifyDomain:   storename,
+		Channel:         "shopify",
+		SKU:             call.SKU,
+		VariantID:       call.VariantID,
+		LocationID:      call.LocationID,
+		InventoryItemID: call.InventoryItemID,
+		Before:          call.Previous,
+		After:           call.Quantity,
+	}
+}
+
+// connectionRunChanges returns the changes to record for a write that a connection has accepted
+func connectionRunChanges(storename string, runid primitive.ObjectID, write ConnectionWrite) []RunChange {
+	var changes []RunChange
+	for _, l := range write.Levels {
+		if !l.Changed() {
+			continue
+		}
+		changes = append(changes, RunChange{
+			RunID:           runid,
+			ShopifyDomain:   storename,
+			Channel:         write.Channel,
+			SKU:             l.SKU,
+			LocationID:      l.LocationID,
+			InventoryItemID: l.InventoryItemID,
+			ConnectionID:    write.ConnectionID,
+			ItemKey:         l.ItemKey,
+			ItemID:          l.ItemID,
+			ParentID:        l.ParentID,
+			Before:          l.Previous,
+			After:           l.Quantity,
+		})
+	}
+	return changes
+}
+
+// itemKey identifies the item a change was written to, so that a restore can be matched with the change
+func (c RunChange) itemKey() string {
+	if c.ConnectionID != "" {
+		return fmt.Sprintf("%s/%s", c.ConnectionID, c.ItemKey)
+	}
+	if c.Channel == "etsy" {
+		return fmt.Sprintf("etsy/%d/%d", c.ListingID, c.ProductID)
+	}
+	return fmt.Sprintf("%s/%s/%s", c.Channel, c.InventoryItemID, c.LocationID)
+}
+
+func getRunChanges(runid primitive.ObjectID, client *mongo.Client) ([]RunChange, error) {
+	var changes []RunChange
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	changeCollection := client.Database("etsync").Collection("run_changes")
+	filter := bson.M{"run_id": runid, "rolled_back": false}
+	cursor, err := changeCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"changed_at": 1}))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "run_ops",
+			"Caller": "GetRunChanges",
+		}).Errorf("Error getting changes for run %s %v", runid.Hex(), err)
+		return changes, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &changes); err != nil {
+		return changes, err
+	}
+	return changes, nil
+}
+
+func markRunChangesRolledBack(ids []primitive.ObjectID, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	changeCollection := client.Database("etsync").Collection("run_changes")
+	_, err := changeCollection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"rolled_back": true}})
+	return err
+}
+
+// rollbackRun restores every stock level written by a run to the level it had before the run, on both
+// stores, and resets the db baselines to match. If any item has moved since the run wrote it the
+// rollback is refused, unless forced in which case those items are also restored.
+// The rollback is itself recorded as a new run so that it can be undone in turn.
+func rollbackRun(runidhex string, force bool, config Config, client *mongo.Client) error {
+	runid, err := primitive.ObjectIDFromHex(runidhex)
+	if err != nil {
+		return fmt.Errorf("invalid run id %s: %v", runidhex, err)
+	}
+	changes, err := getRunChanges(runid, client)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return fmt.Errorf("no changes recorded for run %s", runidhex)
+	}
+	storename := changes[0].ShopifyDomain
+	// the primary store tokens are only needed when the run wrote to them, pairs have no primary stores
+	var etoken etsyAccess
+	var stoken string
+	for _, c := range changes {
+		if c.ConnectionID == "" {
+			if _, err = getetsytoken(storename, config, client); err != nil {
+				return err
+			}
+			etoken = etsyTokens(config, client).Access(storename)
+			stoken = getstoretoken(storename, client)
+			break
+		}
+	}
+
+	// work out the writes needed from the live levels, grouping the etsy changes by listing. ids holds the
+	// changes that are already back at their level before the run, restoring the changes waiting on the
+	// write of their item.
+	var moved []string
+	var ids []primitive.ObjectID
+	restoring := make(map[string][]primitive.ObjectID)
+	listings := make(map[int]etsyListing)
+	etsyRestore := make(map[int]map[int64]int)
+	var shopifySets []ShopifySetCall
+	adapters := newConnectionAdapters(config, storename, client)
+	connectionLive := make(map[string]map[string]int)
+	connectionRestore := make(map[string][]ConnectionLevel)
+	var connectionOrder []string
+	for _, c := range changes {
+		if c.ConnectionID != "" {
+			live, ok := connectionLive[c.ConnectionID]
+			if !ok {
+				adapter, err := adapters.get(c.ConnectionID)
+				if err != nil {
+					return err
+				}
+				if live, err = liveConnectionLevels(adapter); err != nil {
+					return err
+				}
+				connectionLive[c.ConnectionID] = live
+				connectionOrder = append(connectionOrder, c.ConnectionID)
+			}
+			current, ok := live[c.ItemKey]
+			if !ok {
+				moved = append(moved, fmt.Sprintf("%s item %s (sku %s) is no longer on connection %s", c.Channel, c.ItemID, c.SKU, c.ConnectionID))
+				continue
+			}
+			if current != c.After {
+				moved = append(moved, fmt.Sprintf("%s item %s (sku %s) on connection %s was set to %d and is now %d", c.Channel, c.ItemID, c.SKU, c.ConnectionID, c.After, current))
+			}
+			if current == c.Before {
+				ids = append(ids, c.ID)
+				continue
+			}
+			restoring[c.itemKey()] = append(restoring[c.itemKey()], c.ID)
+			connectionRestore[c.ConnectionID] = append(connectionRestore[c.ConnectionID], ConnectionLevel{
+				PlannedLevel:    PlannedLevel{SKU: c.SKU, Previous: current, Quantity: c.Before},
+				ItemKey:         c.ItemKey,
+				ItemID:          c.ItemID,
+				ParentID:        c.ParentID,
+				LocationID:      c.LocationID,
+				InventoryItemID: c.InventoryItemID,
+			})
+			continue
+		}
+		switch c.Channel {
+		case "etsy":
+			listing, ok := listings[c.ListingID]
+			if !ok {
+				listing, err = getListingInventory(c.ListingID, config.ETSY_CLIENT_ID, etoken)
+				if err != nil {
+					return err
+				}
+				listings[c.ListingID] = listing
+				etsyRestore[c.ListingID] = make(map[int64]int)
+			}
+			product, ok := findEtsyProduct(listing, c.ProductID, c.SKU)
+			if !ok {
+				moved = append(moved, fmt.Sprintf("etsy product %d (sku %s) is no longer in listing %d", c.ProductID, c.SKU, c.ListingID))
+				continue
+			}
+			live := product.Offerings[0].Quantity
+			if live != c.After {
+				moved = append(moved, fmt.Sprintf("etsy product %d (sku %s) was set to %d and is now %d", c.ProductID, c.SKU, c.After, live))
+			}
+			if live == c.Before {
+				ids = append(ids, c.ID)
+				continue
+			}
+			// etsy gives the products new ids on every update, the restore is recorded against the live one
+			restored := c
+			restored.ProductID = product.ProductID
+			restoring[restored.itemKey()] = append(restoring[restored.itemKey()], c.ID)
+			etsyRestore[c.ListingID][product.ProductID] = c.Before - live
+		case "shopify":
+			live, err := getShopifyInventoryLevel(storename, stoken, c.InventoryItemID, c.LocationID)
+			if err != nil {
+				return err
+			}
+			if live != c.After {
+				moved = append(moved, fmt.Sprintf("shopify variant %s (sku %s) was set to %d and is now %d", c.VariantID, c.SKU, c.After, live))
+			}
+			if live == c.Before {
+				ids = append(ids, c.ID)
+				continue
+			}
+			restoring[c.itemKey()] = append(restoring[c.itemKey()], c.ID)
+			shopifySets = append(shopifySets, ShopifySetCall{
+				PlannedLevel: PlannedLevel{
+					SKU:       c.SKU,
+					VariantID: c.VariantID,
+					Previous:  live,
+					Quantity:  c.Before,
+				},
+				LocationID:      c.LocationID,
+				InventoryItemID: c.InventoryItemID,
+			})
+		}
+	}
+	for _, m := range moved {
+		log.WithFields(log.Fields{
+			"File":   "run_ops",
+			"Caller": "RollbackRun",
+			"Run":    runidhex,
+		}).Warn(m)
+	}
+	if len(moved) > 0 && !force {
+		return fmt.Errorf("refusing to roll back run %s as %d items have changed since, use -force to restore them anyway", runidhex, len(moved))
+	}
+
+	plan := SyncPlan{
+		ShopifyDomain: storename,
+		CreatedAt:     time.Now(),
+		ShopifySets:   shopifySets,
+	}
+	for listingid, restore := range etsyRestore {
+		write, haschanges, err := buildEtsyListingWrite(listingid, listings[listingid], StockReconciliationDelta{EtsyDelta: restore}, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		if haschanges {
+			plan.EtsyWrites = append(plan.EtsyWrites, write)
+		}
+	}
+	for _, id := range connectionOrder {
+		adapter, _ := adapters.get(id)
+		writes, err := adapter.planWrites(connectionRestore[id])
+		if err != nil {
+			return err
+		}
+		conn, err := getConnection(storename, id, client)
+		if err != nil {
+			return err
+		}
+		for i := range writes {
+			writes[i].ConnectionID = id
+			writes[i].Channel = conn.Channel
+		}
+		plan.ConnectionWrites = append(plan.ConnectionWrites, writes...)
+	}
+	run := newSyncRun(storename, "rollback")
+	saveSyncRun(run, client)
+	log.WithFields(log.Fields{
+		"File":   "run_ops",
+		"Caller": "RollbackRun",
+	}).Infof("Rolling back run %s for %s as run %s", runidhex, storename, run.ID.Hex())
+	if err := applySyncPlan(config, plan, run, etoken, stoken, client); err != nil {
+		failSyncRun(run, "ApplySyncPlan", err, client)
+		return err
+	}
+	// only the changes whose restore was accepted are rolled back, the rest are left for another rollback
+	restored, err := getRunChanges(run.ID, client)
+	if err != nil {
+		failSyncRun(run, "GetRunChanges", err, client)
+		return err
+	}
+	for _, r := range restored {
+		ids = append(ids, restoring[r.itemKey()]...)
+		delete(restoring, r.itemKey())
+	}
+	if len(restoring) > 0 {
+		log.WithFields(log.Fields{
+			"File":   "run_ops",
+			"Caller": "RollbackRun",
+			"Run":    runidhex,
+		}).Warnf("%d items could not be restored and are left to roll back", len(restoring))
+	}
+	if err := markRunChangesRolledBack(ids, client); err != nil {
+		failSyncRun(run, "MarkRunChangesRolledBack", err, client)
+		return err
+	}
+	return finishSyncRun(run, client)
+}
+
+// findEtsyProduct looks up a product in a listing by product id or failing that by sku, as etsy
+// issues new product ids whenever the listing inventory is updated
+func findEtsyProduct(listing etsyListing, productid int64, sku string) (etsyProduct, bool) {
+	for _, p := range listing.Products {
+		if p.ProductID == productid && len(p.Offerings) > 0 {
+			return p, true
+		}
+	}
+	for _, p := range listing.Products {
+		if sku != "" && p.Sku == sku && len(p.Offerings) > 0 {
+			return p, true
+		}
+	}
+	return etsyProduct{}, false
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -59,9 +61,11 @@ type ProductVariant struct {
 	InventoryItem       struct {
 		ID string `json:"id"`
 	} `json:"inventoryItem"`
-	Product  Product `json:"product"`
-	ParentID string  `json:"__parentId"`
-	Sku      string  `json:"sku`
+	Product        Product `json:"product"`
+	ParentID       string  `json:"__parentId"`
+	Sku            string  `json:"sku`
+	Price          string  `json:"price"`
+	CompareAtPrice string  `json:"compareAtPrice"`
 }
 
 type InventoryLevel struct {
@@ -87,14 +91,14 @@ type Product struct {
 
 func registerbulkquery(storeurl, token, query string) (string, error) {
 	var response BulkRequest
-	url := fmt.Sprintf("https://%s/admin/api/2021-01/graphql.json", storeurl)
+	url := shopifyURL(storeurl, "/admin/api/2021-01/graphql.json")
 	log.WithFields(log.Fields{
 		"File":   "shopify_ops",
 		"Caller": "RegisterBulkQuery",
 	}).Debugf("sending request to %s", url)
 	method := "POST"
 	payload := strings.NewReader(query)
-	client := &http.Client{}
+	client := apiHTTP
 	req, err := http.NewRequest(method, url, payload)
 
 	if err != nil {
@@ -161,12 +165,12 @@ func registerbulkquery(storeurl, token, query string) (string, error) {
 
 func getBulkRequestStatus(storeurl, token string) (string, string, error) {
 	var response BulkRequestStatus
-	url := fmt.Sprintf("https://%s/admin/api/2021-01/graphql.json", storeurl)
+	url := shopifyURL(storeurl, "/admin/api/2021-01/graphql.json")
 	method := "POST"
 
 	payload := strings.NewReader("{\"query\":\"query {\\n  currentBulkOperation {\\n    id\\n    status\\n    errorCode\\n    createdAt\\n    completedAt\\n    objectCount\\n    fileSize\\n    url\\n    partialDataUrl\\n  }\\n}\\n\",\"variables\":{}}")
 
-	client := &http.Client{}
+	client := apiHTTP
 	req, err := http.NewRequest(method, url, payload)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -180,7 +184,11 @@ func getBulkRequestStatus(storeurl, token string) (string, string, error) {
 
 	res, err := client.Do(req)
 	if err != nil {
-		fmt.Println(err)
+		log.WithFields(log.Fields{
+			"File":   "shopify_ops",
+			"Caller": "GetBulkRequestStatus",
+			"Action": "Do request",
+		}).Errorf("Error with http request: %v", err)
 		return "", "", err
 	}
 	defer res.Body.Close()
@@ -201,7 +209,7 @@ func getBulkRequestStatus(storeurl, token string) (string, string, error) {
 }
 
 func getproductvariants(storeurl, token string) (string, error) {
-	query := "{\"query\":\"mutation {\\n  bulkOperationRunQuery(\\n   query: \\\"\\\"\\\"\\n    {\\n      products {\\n        edges {\\n          node {\\n            id,\\n            variants {\\n              edges {\\n                node {\\n                  displayName,\\n                  id,\\n                  inventoryManagement,\\n                  inventoryItem  {\\n                     id\\n                  },\\n                  sku,\\n                  product {\\n                    id,\\n                    title\\n                  }\\n                }\\n              }\\n            }\\n          }\\n        }\\n      }\\n    }\\n    \\\"\\\"\\\"\\n  ) {\\n    bulkOperation {\\n      id\\n      status\\n    }\\n    userErrors {\\n      field\\n      message\\n    }\\n  }\\n}\",\"variables\":{}}"
+	query := "{\"query\":\"mutation {\\n  bulkOperationRunQuery(\\n   query: \\\"\\\"\\\"\\n    {\\n      products {\\n        edges {\\n          node {\\n            id,\\n            variants {\\n              edges {\\n                node {\\n                  displayName,\\n                  id,\\n                  inventoryManagement,\\n                  inventoryItem  {\\n                     id\\n                  },\\n                  sku,\\n                  price,\\n                  compareAtPrice,\\n                  product {\\n                    id,\\n                    title\\n                  }\\n                }\\n              }\\n            }\\n          }\\n        }\\n      }\\n    }\\n    \\\"\\\"\\\"\\n  ) {\\n    bulkOperation {\\n      id\\n      status\\n    }\\n    userErrors {\\n      field\\n      message\\n    }\\n  }\\n}\",\"variables\":{}}"
 	_, err := registerbulkquery(storeurl, token, query)
 	if err != nil {
 		return "", err
@@ -272,19 +280,41 @@ func getinventorylevels(storeurl, token string) (string, error) {
 	return url, nil
 }
 
-func processinventorylevels(url, storename string, client *mongo.Client) error {
+// processinventorylevels writes the inventory levels from the bulk query results to the DB and
+// returns the number of levels processed
+func processinventorylevels(url, storename string, client *mongo.Client) (int, error) {
 
 	log.Debugf("Started processing inventory list for %s", storename)
+	Items, err := readinventorylevels(url)
+	if err != nil {
+		return 0, err
+	}
+	if err := setshopstock(storename, Items, client); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "shopify_ops",
+			"Caller": "ProcessInventoryLevels",
+		}).Errorf("Error with DB upsert %v", err)
+		return 0, err
+	}
+	log.WithFields(log.Fields{
+		"File":   "shopify_ops",
+		"Caller": "ProcessInventoryLevels",
+	}).Debugf("Writing %d inventory levels to DB", len(Items))
+	return len(Items), nil
+}
+
+// readinventorylevels reads the inventory levels from the bulk query results
+func readinventorylevels(url string) ([]StockItem, error) {
 	var Items []StockItem
 
-	response, err := http.Get(url)
+	response, err := downloadHTTP.Get(url)
 
 	if err != nil {
 		log.WithFields(log.Fields{
 			"File":   "shopify_ops",
 			"Caller": "ProcessInventoryLevels",
 		}).Errorf("Error reading products: %v", err)
-		return err
+		return nil, err
 	}
 
 	defer response.Body.Close()
@@ -325,37 +355,55 @@ func processinventorylevels(url, storename string, client *mongo.Client) error {
 		log.WithFields(log.Fields{
 			"File":   "shopify_ops",
 			"Caller": "ProcessInventoryLevels",
-		}).Errorf("Error reading input:", err)
+		}).Errorf("Error reading input: %v", err)
+	}
+	return Items, nil
+}
+
+// processproductlevels writes the product variants from the bulk query results to the DB and
+// returns the number of variants processed
+func processproductlevels(url, storename string, client *mongo.Client) (int, error) {
+	log.WithFields(log.Fields{
+		"File":   "shopify_ops",
+		"Caller": "ProcessProductLevels",
+	}).Infof("Started processing inventory list for %s", storename)
+	Items, err := readproductvariants(url)
+	if err != nil {
+		return 0, err
 	}
 	if err := setshopstock(storename, Items, client); err != nil {
 		log.WithFields(log.Fields{
 			"File":   "shopify_ops",
 			"Caller": "ProcessInventoryLevels",
 		}).Errorf("Error with DB upsert %v", err)
-		return err
+		return 0, err
+	}
+	if err := saveSkuConflicts(storename, "shopify", shopifySkuConflicts(storename, Items), client); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "shopify_ops",
+			"Caller": "ProcessProductLevels",
+		}).Errorf("Error recording sku conflicts %v", err)
+		return 0, err
 	}
 	log.WithFields(log.Fields{
 		"File":   "shopify_ops",
 		"Caller": "ProcessInventoryLevels",
-	}).Debugf("Writing %d inventory levels to DB", len(Items))
-	return nil
+	}).Debugf("Writing %d products to DB", len(Items))
+	return len(Items), nil
 }
 
-func processproductlevels(url, storename string, client *mongo.Client) error {
-	log.WithFields(log.Fields{
-		"File":   "shopify_ops",
-		"Caller": "ProcessProductLevels",
-	}).Infof("Started processing inventory list for %s", storename)
+// readproductvariants reads the product variants with shopify managed inventory from the bulk query results
+func readproductvariants(url string) ([]StockItem, error) {
 	var Items []StockItem
 
-	response, err := http.Get(url)
+	response, err := downloadHTTP.Get(url)
 
 	if err != nil {
 		log.WithFields(log.Fields{
 			"File":   "shopify_ops",
 			"Caller": "ProcessInventoryLevels",
 		}).Errorf("Error reading products: %v", err)
-		return err
+		return nil, err
 	}
 
 	defer response.Body.Close()
@@ -374,13 +422,15 @@ func processproductlevels(url, storename string, client *mongo.Client) error {
 		}
 		if productvariant.InventoryManagement == "SHOPIFY" {
 			item := StockItem{
-				InventoryID: productvariant.InventoryItem.ID,
-				ItemType:    "productvariant",
-				VariantName: productvariant.DisplayName,
-				VariantID:   productvariant.ID,
-				Parent:      productvariant.Product.Title,
-				ParentID:    productvariant.Product.ID,
-				SKU:         productvariant.Sku,
+				InventoryID:           productvariant.InventoryItem.ID,
+				ItemType:              "productvariant",
+				VariantName:           productvariant.DisplayName,
+				VariantID:             productvariant.ID,
+				Parent:                productvariant.Product.Title,
+				ParentID:              productvariant.Product.ID,
+				SKU:                   productvariant.Sku,
+				ShopifyPrice:          productvariant.Price,
+				ShopifyCompareAtPrice: productvariant.CompareAtPrice,
 			}
 			Items = append(Items, item)
 		}
@@ -389,45 +439,43 @@ func processproductlevels(url, storename string, client *mongo.Client) error {
 		log.WithFields(log.Fields{
 			"File":   "shopify_ops",
 			"Caller": "ProcessInventoryLevels",
-		}).Errorf("Error reading input:", err)
-	}
-	if err := setshopstock(storename, Items, client); err != nil {
-		log.WithFields(log.Fields{
-			"File":   "shopify_ops",
-			"Caller": "ProcessInventoryLevels",
-		}).Errorf("Error with DB upsert %v", err)
-		return err
+		}).Errorf("Error reading input: %v", err)
 	}
-	log.WithFields(log.Fields{
-		"File":   "shopify_ops",
-		"Caller": "ProcessInventoryLevels",
-	}).Debugf("Writing %d products to DB", len(Items))
-	return nil
+	return Items, nil
 }
 
-func reconcileShopifyStockLevel(storename, clientid, token string, delta StockReconciliationDelta, overrideStock map[string]int, client *mongo.Client) error {
-	log.Debugf("Setting Shopify stock:delta [%v] overrides [%v]", delta.ShopifyDelta, overrideStock)
-	url := fmt.Sprintf("https://%s/admin/api/2020-10/inventory_levels/set.json", storename)
-	method := "POST"
+// planShopifyStockLevel works out the inventory_levels/set.json calls needed to apply the etsy stock
+// changes (and any stock levels set via the app) to shopify
+func planShopifyStockLevel(storename string, shopifyDelta map[string]int, overrideStock map[string]int, quarantined map[string]bool, client *mongo.Client) []ShopifySetCall {
+	log.Debugf("Setting Shopify stock:delta [%v] overrides [%v]", shopifyDelta, overrideStock)
+	var calls []ShopifySetCall
 	overridesprocessed := make(map[string]bool)
-	for k, v := range delta.ShopifyDelta {
+	for k, v := range shopifyDelta {
 
 		var newstock int
+		override := false
 		log.WithFields(log.Fields{
 			"File":   "shopify_ops",
-			"Caller": "ReconcileShopifyStockLevel",
+			"Caller": "PlanShopifyStockLevel",
 		}).Debugf("Update stock for %s by %d", k, v)
 		item, err := getShopifyStockItem(storename, k, client)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"File":   "shopify_ops",
-				"Caller": "ReconcileShopifyStockLevel",
+				"Caller": "PlanShopifyStockLevel",
 			}).Warnf("Error getting record for %s from DB %v", k, err)
+			continue
+		}
+		if quarantined[item.SKU] {
+			log.WithFields(log.Fields{
+				"File":   "shopify_ops",
+				"Caller": "PlanShopifyStockLevel",
+			}).Warnf("Skipping stock update for %s as sku %s is quarantined", k, item.SKU)
+			continue
 		}
-		loc := item.LocationID[strings.LastIndex(item.LocationID, "/")+1:]
-		i := item.InventoryID[strings.LastIndex(item.InventoryID, "/")+1:]
 		if stockset, ok := overrideStock[item.SKU]; ok {
 			newstock = stockset
+			override = true
 			overridesprocessed[item.SKU] = true
 		} else {
 			newstock = item.Available + v
@@ -437,100 +485,337 @@ func reconcileShopifyStockLevel(storename, clientid, token string, delta StockRe
 		}
 		log.WithFields(log.Fields{
 			"File":   "shopify_ops",
-			"Caller": "ReconcileShopifyStockLevel",
+			"Caller": "PlanShopifyStockLevel",
 		}).Debugf("Updating shopify for item sku %s new stock %d", item.SKU, newstock)
-		payload := strings.NewReader(fmt.Sprintf("location_id=%s&inventory_item_id=%s&available=%d", loc, i, newstock))
-
-		httpclient := &http.Client{}
-		req, err := http.NewRequest(method, url, payload)
-
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		req.Header.Add("X-Shopify-Access-Token", token)
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-		res, err := httpclient.Do(req)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"File":   "shopify_ops",
-				"Caller": "ReconcileShopifyStockLevel",
-				"Action": "http request",
-			}).Error(err)
-			continue
-		}
-		if res.StatusCode != 200 {
-			log.WithFields(log.Fields{
-				"File":   "shopify_ops",
-				"Caller": "ReconcileShopifyStockLevel",
-				"Action": "http response",
-			}).Errorf("Unable to set Shopify stock level in API for %s, Got response %d", k, res.StatusCode)
-		}
-		if err = setShopifyStockLevelForVariant(storename, k, newstock, client); err != nil {
-			log.WithFields(log.Fields{
-				"File":   "shopify_ops",
-				"Caller": "ReconcileShopifyStockLevel",
-				"Action": "setShopifyStockLevelForVariant",
-			}).Error(err)
-		}
-
+		calls = append(calls, newShopifySetCall(item, newstock, override))
 	}
 	// need to handle cases where the override is set but that sku is not in the regular stock delta
 	for k, v := range overrideStock {
 		if overridesprocessed[k] {
 			log.WithFields(log.Fields{
 				"File":   "shopify_ops",
-				"Caller": "ReconcileShopifyStockLevel",
+				"Caller": "PlanShopifyStockLevel",
 			}).Debugf("Skipping set shopify stock for %s as already processed", k)
 			continue
 		}
+		if quarantined[k] {
+			log.WithFields(log.Fields{
+				"File":   "shopify_ops",
+				"Caller": "PlanShopifyStockLevel",
+			}).Warnf("Skipping set shopify stock for %s as the sku is quarantined", k)
+			continue
+		}
 		log.WithFields(log.Fields{
 			"File":   "shopify_ops",
-			"Caller": "ReconcileShopifyStockLevel",
+			"Caller": "PlanShopifyStockLevel",
 		}).Debugf("Force set shopify stock for %s as requested via app", k)
 		item, err := getShopifyStockItemBySku(storename, k, client)
 		if err != nil {
 			log.Warnf("Error getting record for %s from DB %v", k, err)
+			continue
 		}
-		loc := item.LocationID[strings.LastIndex(item.LocationID, "/")+1:]
-		i := item.InventoryID[strings.LastIndex(item.InventoryID, "/")+1:]
+		calls = append(calls, newShopifySetCall(item, v, true))
+	}
+	return calls
+}
 
+func newShopifySetCall(item StockItem, newstock int, override bool) ShopifySetCall {
+	return ShopifySetCall{
+		PlannedLevel: PlannedLevel{
+			SKU:       item.SKU,
+			VariantID: item.VariantID,
+			Previous:  item.Available,
+			Quantity:  newstock,
+			Override:  override,
+		},
+		LocationID:      item.LocationID[strings.LastIndex(item.LocationID, "/")+1:],
+		InventoryItemID: item.InventoryID[strings.LastIndex(item.InventoryID, "/")+1:],
+	}
+}
+
+// shopifyStockedVariants counts the tracked shopify variants that hold stock and are not set by the plan,
+// for the guardrail that holds a plan dropping every variant to zero
+func shopifyStockedVariants(storename string, sets []ShopifySetCall, quarantined map[string]bool, client *mongo.Client) (int, error) {
+	planned := make(map[string]bool)
+	for _, s := range sets {
+		planned[s.VariantID] = true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	stockCollection := client.Database("etsync").Collection("stock")
+	filter := bson.M{"shopify_domain": storename, "s_variant_id": bson.M{"$exists": true}, "s_curr_stock": bson.M{"$gt": 0}}
+	cursor, err := stockCollection.Find(ctx, filter)
+	if err != nil {
 		log.WithFields(log.Fields{
 			"File":   "shopify_ops",
-			"Caller": "ReconcileShopifyStockLevel",
-		}).Debugf("Updating shopify for item sku %s new stock %d", k, v)
-		payload := strings.NewReader(fmt.Sprintf("location_id=%s&inventory_item_id=%s&available=%d", loc, i, v))
-
-		httpclient := &http.Client{}
-		req, err := http.NewRequest(method, url, payload)
-
-		if err != nil {
-			log.Error(err)
-			continue
+			"Caller": "ShopifyStockedVariants",
+		}).Errorf("Error reading the shopify stock %v", err)
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	stocked := 0
+	for cursor.Next(ctx) {
+		var item StockItem
+		if err := cursor.Decode(&item); err != nil {
+			return 0, err
 		}
-		req.Header.Add("X-Shopify-Access-Token", token)
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-		res, err := httpclient.Do(req)
-		if err != nil {
-			log.Error(err)
+		if item.SKU == "" || quarantined[item.SKU] || planned[item.VariantID] {
 			continue
 		}
-		if res.StatusCode != 200 {
-			log.WithFields(log.Fields{
-				"File":   "shopify_ops",
-				"Caller": "ReconcileShopifyStockLevel",
-			}).Errorf("Unable to set Shopify stock level in API for %s, Got response %d", k, res.StatusCode)
-		}
-		if err = setShopifyStockLevelForVariant(storename, item.VariantID, v, client); err != nil {
+		stocked++
+	}
+	return stocked, cursor.Err()
+}
+
+// applyShopifySetCall sends a single inventory level to shopify and records the new stock level
+func applyShopifySetCall(storename, token string, run *SyncRun, call ShopifySetCall, client *mongo.Client) error {
+	log.WithFields(log.Fields{
+		"File":   "shopify_ops",
+		"Caller": "ApplyShopifySetCall",
+	}).Debugf("Updating shopify for item sku %s new stock %d", call.SKU, call.Quantity)
+	if err := setShopifyInventoryLevel(storename, token, call.LocationID, call.InventoryItemID, call.Quantity); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "shopify_ops",
+			"Caller": "ApplyShopifySetCall",
+		}).Errorf("Unable to set Shopify stock level in API for %s: %v", call.VariantID, err)
+		return err
+	}
+	if call.Changed() {
+		if err := recordRunChanges(run, []RunChange{shopifyRunChange(storename, run.ID, call)}, client); err != nil {
 			log.WithFields(log.Fields{
 				"File":   "shopify_ops",
-				"Caller": "ReconcileShopifyStockLevel",
+				"Caller": "ApplyShopifySetCall",
+				"Action": "recordRunChanges",
 			}).Error(err)
-
 		}
+	}
+	if err := setShopifyStockLevelForVariant(storename, call.VariantID, call.Quantity, client); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "shopify_ops",
+			"Caller": "ApplyShopifySetCall",
+			"Action": "setShopifyStockLevelForVariant",
+		}).Error(err)
+		return err
+	}
+	return nil
+}
+
+// setShopifyInventoryLevel sets the available stock of an inventory item at a location through inventory_levels/set.json
+func setShopifyInventoryLevel(storename, token, locationID, inventoryItemID string, available int) error {
+	url := shopifyURL(storename, "/admin/api/2020-10/inventory_levels/set.json")
+	method := "POST"
+	payload := strings.NewReader(fmt.Sprintf("location_id=%s&inventory_item_id=%s&available=%d", locationID, inventoryItemID, available))
 
+	httpclient := apiHTTP
+	req, err := http.NewRequest(method, url, payload)
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	req.Header.Add("X-Shopify-Access-Token", token)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := httpclient.Do(req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "shopify_ops",
+			"Caller": "SetShopifyInventoryLevel",
+			"Action": "http request",
+		}).Error(err)
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		log.WithFields(log.Fields{
+			"File":   "shopify_ops",
+			"Caller": "SetShopifyInventoryLevel",
+			"Action": "http response",
+		}).Errorf("Unable to set Shopify stock level for inventory item %s, Got response %d", inventoryItemID, res.StatusCode)
+		return fmt.Errorf("Failed to set inventory level with status %d", res.StatusCode)
 	}
 	return nil
 }
+
+// setShopifyVariantPrice sets the price of a variant through the variants REST api
+func setShopifyVariantPrice(storename, token, variantID, price string) error {
+	url := shopifyURL(storename, fmt.Sprintf("/admin/api/2020-10/variants/%s.json", variantID))
+	method := "PUT"
+	payload := strings.NewReader(fmt.Sprintf("{\"variant\":{\"id\":%s,\"price\":\"%s\"}}", variantID, price))
+
+	httpclient := apiHTTP
+	req, err := http.NewRequest(method, url, payload)
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	req.Header.Add("X-Shopify-Access-Token", token)
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := httpclient.Do(req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "shopify_ops",
+			"Caller": "SetShopifyVariantPrice",
+			"Action": "http request",
+		}).Error(err)
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		log.WithFields(log.Fields{
+			"File":   "shopify_ops",
+			"Caller": "SetShopifyVariantPrice",
+			"Action": "http response",
+		}).Errorf("Unable to set Shopify price for variant %s, Got response %d", variantID, res.StatusCode)
+		return fmt.Errorf("Failed to set variant price with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+type inventoryLevelsResponse struct {
+	InventoryLevels []struct {
+		InventoryItemID int64 `json:"inventory_item_id"`
+		LocationID      int64 `json:"location_id"`
+		Available       int   `json:"available"`
+	} `json:"inventory_levels"`
+}
+
+// getShopifyInventoryLevel reads the live available stock for an inventory item at a location
+func getShopifyInventoryLevel(storename, token, inventoryItemID, locationID string) (int, error) {
+	var response inventoryLevelsResponse
+	url := shopifyURL(storename, fmt.Sprintf("/admin/api/2020-10/inventory_levels.json?inventory_item_ids=%s&location_ids=%s", inventoryItemID, locationID))
+	method := "GET"
+
+	httpclient := apiHTTP
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	req.Header.Add("X-Shopify-Access-Token", token)
+
+	res, err := httpclient.Do(req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "shopify_ops",
+			"Caller": "GetShopifyInventoryLevel",
+			"Action": "http request",
+		}).Error(err)
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return 0, fmt.Errorf("Failed to get inventory level with status %d", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "shopify_ops",
+			"Caller": "GetShopifyInventoryLevel",
+			"Action": "unmarshall",
+		}).Errorf("Error with response unmarshall: %v", err)
+		return 0, err
+	}
+	if len(response.InventoryLevels) == 0 {
+		return 0, fmt.Errorf("no inventory level for item %s at location %s", inventoryItemID, locationID)
+	}
+	return response.InventoryLevels[0].Available, nil
+}
+
+// shopifyConnection is the channel adapter for a further shopify store
+type shopifyConnection struct {
+	conn   ChannelConnection
+	domain string
+	token  string
+}
+
+func newShopifyConnection(conn ChannelConnection, client *mongo.Client) (*shopifyConnection, error) {
+	if conn.Account == "" {
+		return nil, fmt.Errorf("shopify connection %s has no account", conn.ID)
+	}
+	tokenfrom := conn.TokenFrom
+	if tokenfrom == "" {
+		tokenfrom = conn.Account
+	}
+	token := getstoretoken(tokenfrom, client)
+	if token == "" {
+		return nil, fmt.Errorf("no shopify token stored for %s", tokenfrom)
+	}
+	return &shopifyConnection{conn: conn, domain: conn.Account, token: token}, nil
+}
+
+func shopifyNumericID(gid string) string {
+	return gid[strings.LastIndex(gid, "/")+1:]
+}
+
+// fetch reads the variants and inventory levels through the bulk queries, taking the level at the
+// connection's location, or at the first location of each item when none is set
+func (s *shopifyConnection) fetch() ([]ConnectionStockItem, error) {
+	var items []ConnectionStockItem
+	inventoryurl, err := getinventorylevels(s.domain, s.token)
+	if err != nil {
+		return nil, err
+	}
+	levels, err := readinventorylevels(inventoryurl)
+	if err != nil {
+		return nil, err
+	}
+	productsurl, err := getproductvariants(s.domain, s.token)
+	if err != nil {
+		return nil, err
+	}
+	variants, err := readproductvariants(productsurl)
+	if err != nil {
+		return nil, err
+	}
+	byitem := make(map[string]StockItem)
+	for _, l := range levels {
+		if s.conn.LocationID != "" && shopifyNumericID(l.LocationID) != s.conn.LocationID {
+			continue
+		}
+		if _, ok := byitem[l.InventoryID]; !ok {
+			byitem[l.InventoryID] = l
+		}
+	}
+	for _, v := range variants {
+		level, ok := byitem[v.InventoryID]
+		if !ok {
+			continue
+		}
+		items = append(items, ConnectionStockItem{
+			ItemKey:         v.VariantID,
+			SKU:             v.SKU,
+			ItemID:          v.VariantID,
+			LocationID:      shopifyNumericID(level.LocationID),
+			InventoryItemID: shopifyNumericID(v.InventoryID),
+			Title:           v.VariantName,
+			Current:         level.Available,
+		})
+	}
+	return items, nil
+}
+
+// planWrites sets each variant with its own inventory_levels/set.json call
+func (s *shopifyConnection) planWrites(levels []ConnectionLevel) ([]ConnectionWrite, error) {
+	var writes []ConnectionWrite
+	for _, l := range levels {
+		writes = append(writes, ConnectionWrite{Target: l.ItemID, Levels: []ConnectionLevel{l}})
+	}
+	return writes, nil
+}
+
+func (s *shopifyConnection) applyWrite(write ConnectionWrite) ([]ConnectionLevel, error) {
+	var accepted []ConnectionLevel
+	for _, l := range write.Levels {
+		if err := setShopifyInventoryLevel(s.domain, s.token, l.LocationID, l.InventoryItemID, l.Quantity); err != nil {
+			return accepted, err
+		}
+		accepted = append(accepted, l)
+	}
+	return accepted, nil
+}
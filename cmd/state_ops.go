@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The onboarding and health state of a shop, stored in the state field of the shop record
+const (
+	shopStateAwaitingShopify  = "awaiting_shopify"
+	shopStateAwaitingEtsyAuth = "awaiting_etsy_auth"
+	shopStateEtsyResolved     = "etsy_shop_resolved"
+	shopStateActive           = "active"
+	shopStatePaused           = "paused"
+	shopStateNeedsReauth      = "needs_reauth"
+	shopStateFailing          = "failing"
+)
+
+var shopStates = []string{
+	shopStateAwaitingShopify,
+	shopStateAwaitingEtsyAuth,
+	shopStateEtsyResolved,
+	shopStateActive,
+	shopStatePaused,
+	shopStateNeedsReauth,
+	shopStateFailing,
+}
+
+// the kind of a shop record which syncs two stores of the same channel, see pair_ops
+const shopKindPair = "pair"
+
+// the number of transitions kept in the state history of a shop
+const shopStateHistoryLimit = 50
+
+type ShopStateTransition struct {
+	From   string    `bson:"from"`
+	To     string    `bson:"to"`
+	Reason string    `bson:"reason"`
+	At     time.Time `bson:"at"`
+}
+
+// ShopState holds the fields of the shop record that decide whether the shop can be synced
+type ShopState struct {
+	ShopifyDomain     string                `bson:"shopify_domain"`
+	Kind              string                `bson:"kind,omitempty"`
+	State             string                `bson:"state"`
+	StateReason       string                `bson:"state_reason,omitempty"`
+	StateChangedAt    time.Time             `bson:"state_changed_at,omitempty"`
+	StateHistory      []ShopStateTransition `bson:"state_history,omitempty"`
+	OnBoarded         bool                  `bson:"onBoarded"`
+	AccessToken       string                `bson:"accessToken,omitempty"`
+	EtsyOnBoarded     bool                  `bson:"etsyOnBoarded"`
+	EtsyCodeReference string                `bson:"etsy_code_reference,omitempty"`
+	EtsyShopID        int                   `bson:"etsy_shop_id,omitempty"`
+}
+
+func isShopState(state string) bool {
+	for _, s := range shopStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// derivedState works out the state of a shop record written before states were recorded
+func (s ShopState) derivedState() string {
+	switch {
+	case s.Kind == shopKindPair:
+		return shopStateActive
+	case !s.OnBoarded || s.AccessToken == "":
+		return shopStateAwaitingShopify
+	case !s.EtsyOnBoarded:
+		return shopStateAwaitingEtsyAuth
+	case s.EtsyShopID == 0:
+		return shopStateEtsyResolved
+	default:
+		return shopStateActive
+	}
+}
+
+func getShopState(storename string, client *mongo.Client) (ShopState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var state ShopState
+	shopCollection := client.Database("etsync").Collection("shops")
+	if err := shopCollection.FindOne(ctx, bson.M{"shopify_domain": storename}).Decode(&state); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "state_ops",
+			"Caller": "GetShopState",
+		}).Warnf("Unable to read shop record %v", err)
+		return state, err
+	}
+	return state, nil
+}
+
+// setShopState moves the shop to the state, recording the transition in the shop's state history.
+// Setting the state the shop is already in only updates the reason.
+func setShopState(storename, state, reason string, client *mongo.Client) error {
+	current, err := getShopState(storename, client)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	now := time.Now()
+	update := bson.M{"$set": bson.M{"state_reason": reason}}
+	if current.State != state {
+		update = bson.M{
+			"$set": bson.M{
+				"state":            state,
+				"state_reason":     reason,
+				"state_changed_at": now,
+			},
+			"$push": bson.M{"state_history": bson.M{
+				"$each":  bson.A{ShopStateTransition{From: current.State, To: state, Reason: reason, At: now}},
+				"$slice": -shopStateHistoryLimit,
+			}},
+		}
+		log.WithFields(log.Fields{
+			"File":   "state_ops",
+			"Caller": "SetShopState",
+			"Shop":   storename,
+		}).Infof("Shop state %s -> %s: %s", current.State, state, reason)
+	}
+	if _, err := shopCollection.UpdateOne(ctx, bson.M{"shopify_domain": storename}, update); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "state_ops",
+			"Caller": "SetShopState",
+		}).Errorf("Unable to set shop state to %s %v", state, err)
+		return err
+	}
+	return nil
+}
+
+// checkShopState returns the shop record, with its current state, and whether the worker should sync it.
+// Shops waiting on shopify are moved on once the shopify app has onboarded them, and shops without a
+// recorded state have one derived from their record.
+func checkShopState(storename string, client *mongo.Client) (ShopState, bool, error) {
+	shop, err := getShopState(storename, client)
+	if err != nil {
+		return shop, false, err
+	}
+	if shop.State == "" {
+		shop.State = shop.derivedState()
+		if err := setShopState(storename, shop.State, "derived from the existing shop record", client); err != nil {
+			return shop, false, err
+		}
+	}
+	if shop.State == shopStateAwaitingShopify && shop.OnBoarded && shop.AccessToken != "" {
+		shop.State = shopStateAwaitingEtsyAuth
+		if err := setShopState(storename, shop.State, "shopify app installed", client); err != nil {
+			return shop, false, err
+		}
+	}
+	switch shop.State {
+	case shopStateAwaitingShopify, shopStatePaused, shopStateNeedsReauth:
+		return shop, false, nil
+	case shopStateAwaitingEtsyAuth:
+		// the app has stored an authorisation code which the token manager will exchange
+		return shop, shop.EtsyCodeReference != "", nil
+	}
+	return shop, true, nil
+}
+
+// failShop fails the run and moves the shop to failing with the reason
+func failShop(run *SyncRun, call string, err error, client *mongo.Client) {
+	failSyncRun(run, call, err, client)
+	if serr := setShopState(run.ShopifyDomain, shopStateFailing, fmt.Sprintf("%s: %v", call, err), client); serr != nil {
+		log.WithFields(log.Fields{
+			"File":   "state_ops",
+			"Caller": "FailShop",
+		}).Error(serr)
+	}
+}
+
+// updateShopStateAfterRun sets the state of the shop from the outcome of a sync run
+func updateShopStateAfterRun(run *SyncRun, client *mongo.Client) error {
+	switch run.Status {
+	case runStatusSucceeded, runStatusHeld, runStatusParked:
+		return setShopState(run.ShopifyDomain, shopStateActive, fmt.Sprintf("run %s %s", run.ID.Hex(), run.Status), client)
+	case runStatusWithErrors:
+		e := run.Errors[len(run.Errors)-1]
+		return setShopState(run.ShopifyDomain, shopStateFailing, fmt.Sprintf("run %s %s: %s", run.ID.Hex(), e.Call, e.Error), client)
+	}
+	return nil
+}
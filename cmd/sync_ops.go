@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// syncShop runs the full pipeline for a shop: it reads both stores, works out the changes made on each
+// since the last run and applies them to the other, as a single sync run
+func syncShop(config Config, storename string, client *mongo.Client) {
+	shop, proceed, err := checkShopState(storename, client)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":    "sync_ops",
+			"Caller":  "SyncShop",
+			"Calling": "CheckShopState",
+		}).Fatalf("Unable to read the state of %s: %v", storename, err)
+	}
+	if !proceed {
+		log.WithFields(log.Fields{
+			"File":   "sync_ops",
+			"Caller": "SyncShop",
+		}).Infof("Shop %s is %s, nothing to sync", storename, shop.State)
+		return
+	}
+	// a plan held for approval was computed from the current baselines, which a further run would move on
+	pending, err := getPendingPlans(storename, client)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":    "sync_ops",
+			"Caller":  "SyncShop",
+			"Calling": "GetPendingPlans",
+		}).Fatalf("Unable to read the pending plans of %s: %v", storename, err)
+	}
+	if len(pending) > 0 {
+		log.WithFields(log.Fields{
+			"File":   "sync_ops",
+			"Caller": "SyncShop",
+		}).Infof("Shop %s has %d plans waiting for approval, nothing to sync until they are approved or rejected", storename, len(pending))
+		return
+	}
+	if shop.Kind == shopKindPair {
+		if err := runPairSync(config, storename, client); err != nil {
+			log.WithFields(log.Fields{
+				"File":    "sync_ops",
+				"Caller":  "SyncShop",
+				"Calling": "RunPairSync",
+			}).Fatalf("Could not sync pair %s: %v", storename, err)
+		}
+		return
+	}
+
+	run := newSyncRun(storename, "sync")
+	saveSyncRun(run, client)
+	log.WithFields(log.Fields{
+		"File":   "sync_ops",
+		"Caller": "SyncShop",
+	}).Infof("Starting run %s", run.ID.Hex())
+
+	// Check if any stock levels are set via the app
+	overridestock, e := getOverrides(storename, client)
+	if e != nil {
+		log.Error(e)
+		run.recordError("GetOverrides", e)
+	}
+
+	// Check if any SKUs are set via the app
+	eSkusToSet, e := getItemsToLink(storename, client)
+	if e != nil {
+		log.Error(e)
+		run.recordError("GetItemsToLink", e)
+	}
+	bstock := new(bytes.Buffer)
+	for key, value := range overridestock {
+		fmt.Fprintf(bstock, "%s=%d ", key, value)
+	}
+	bsku := new(bytes.Buffer)
+	for key, value := range eSkusToSet {
+		fmt.Fprintf(bsku, "%d=%s ", key, value)
+	}
+	if len(overridestock) > 0 {
+		log.WithFields(log.Fields{
+			"File":   "sync_ops",
+			"Caller": "SyncShop",
+		}).Infof("Items for which we need to set stock levels: %v", bstock)
+	}
+	if len(eSkusToSet) > 0 {
+		log.WithFields(log.Fields{
+			"File":   "sync_ops",
+			"Caller": "SyncShop",
+		}).Infof("Etsy Items for which we need to set the sku: %v", bsku)
+	}
+
+	// the baselines the run starts from, put back when the run fails or its plan is held
+	before, err := getStockBaselines(storename, client)
+	if err != nil {
+		failShop(run, "GetStockBaselines", err, client)
+		log.WithFields(log.Fields{
+			"File":    "sync_ops",
+			"Caller":  "SyncShop",
+			"Calling": "GetStockBaselines",
+		}).Fatalf("Unable to read the stock baselines: %v", err)
+	}
+	if call, err := fetchShopifyStock(run, storename, client); err != nil {
+		restoreRunBaselines(storename, before, client)
+		failShop(run, call, err, client)
+		log.WithFields(log.Fields{
+			"File":    "sync_ops",
+			"Caller":  "SyncShop",
+			"Calling": call,
+		}).Fatalf("Unable to read the shopify stock: %v", err)
+	}
+
+	// get the etsy stock levels and apply any shopify changes
+	tokens := etsyTokens(config, client)
+	e_token, err := tokens.Token(storename)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":    "sync_ops",
+			"Caller":  "SyncShop",
+			"Calling": "GetEtsyToken",
+		}).Errorf("Error getting etsy token %v", err)
+		restoreRunBaselines(storename, before, client)
+		if errors.Is(err, errEtsyReauthRequired) {
+			// the token manager has moved the shop to needs_reauth, nothing more can be done for
+			// this shop until the merchant authorises etsync again
+			failSyncRun(run, "GetEtsyToken", err, client)
+			return
+		}
+		failShop(run, "GetEtsyToken", err, client)
+		log.Fatal("Cannot get Etsy token")
+	}
+	tokens.Start(storename)
+	defer tokens.Stop()
+	etsyaccess := tokens.Access(storename)
+	log.WithFields(log.Fields{
+		"File":    "sync_ops",
+		"Caller":  "SyncShop",
+		"Calling": "GetEtsyToken",
+	}).Infof("Got Token for Etsy (shopify store %s) with expiration time %v", e_token.ShopifyDomain, e_token.EtsyTokenExpires)
+
+	etsyshopid, err := getUsersEtsyShops(storename, config.ETSY_CLIENT_ID, etsyaccess, client)
+	if err != nil {
+		restoreRunBaselines(storename, before, client)
+		failShop(run, "GetUsersEtsyShops", err, client)
+		log.WithFields(log.Fields{
+			"File":    "sync_ops",
+			"Caller":  "SyncShop",
+			"Calling": "GetUsersEtsyShops",
+		}).Fatalf("Unable to resolve the etsy shop: %v", err)
+	}
+	if shop.State == shopStateAwaitingEtsyAuth {
+		setShopState(storename, shopStateEtsyResolved, fmt.Sprintf("etsy shop %s", etsyshopid), client)
+	}
+
+	//apply any shopify stock changes to etsy and etsy stock changes to shopify
+	err = getAndSetEtsyShopListings(config, run, storename, etsyshopid, etsyaccess, eSkusToSet, overridestock, before, client)
+	if err != nil {
+		restoreRunBaselines(storename, before, client)
+		failShop(run, "GetAndSetEtsyShopListings", err, client)
+		log.WithFields(log.Fields{
+			"File":    "sync_ops",
+			"Caller":  "SyncShop",
+			"Calling": "GetAndSetEtsyShopListings",
+		}).Fatalf("Could not retrieve Etsy Listings %v", err)
+	}
+	finishSyncRun(run, client)
+	if err := updateShopStateAfterRun(run, client); err != nil {
+		log.WithFields(log.Fields{
+			"File":    "sync_ops",
+			"Caller":  "SyncShop",
+			"Calling": "UpdateShopStateAfterRun",
+		}).Error(err)
+	}
+}
+
+// restoreRunBaselines puts the stock baselines back to where the run found them, so that the changes read
+// by a run that did not apply them are picked up by the next one
+func restoreRunBaselines(storename string, before map[primitive.ObjectID]bson.M, client *mongo.Client) {
+	if err := restoreStockBaselines(storename, before, client); err != nil {
+		log.WithFields(log.Fields{
+			"File":    "sync_ops",
+			"Caller":  "RestoreRunBaselines",
+			"Calling": "RestoreStockBaselines",
+		}).Errorf("Unable to put back the stock baselines of %s: %v", storename, err)
+	}
+}
+
+// fetchShopifyStock reads the inventory levels and product variants of the shopify store into the stock
+// collection, returning the call that failed along with the error
+func fetchShopifyStock(run *SyncRun, storename string, client *mongo.Client) (string, error) {
+	// Get the Shopify token
+	token := getstoretoken(storename, client)
+
+	//Submit the Graphql request for shopify inventory levels at location
+	//returns a url from which to download the results
+	inventoryurl, err := getinventorylevels(storename, token)
+	if err != nil {
+		return "GetInventoryLevels", err
+	}
+	if run.InventoryLevels, err = processinventorylevels(inventoryurl, storename, client); err != nil {
+		return "ProcessInventoryLevels", err
+	}
+
+	//Submit the Graphql request for shopify product variants
+	//returns a url from which to download the results
+	productsurl, err := getproductvariants(storename, token)
+	if err != nil {
+		return "GetProductVariants", err
+	}
+	log.WithFields(log.Fields{
+		"File":    "sync_ops",
+		"Caller":  "FetchShopifyStock",
+		"Calling": "GetProductVariants",
+	}).Info("Ready to process productvariants")
+	if run.Variants, err = processproductlevels(productsurl, storename, client); err != nil {
+		return "ProcessProductLevels", err
+	}
+	return "", nil
+}
+
+func syncCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to sync")
+	fs.Parse(args)
+	if *shop == "" {
+		return fmt.Errorf("usage: %s", commands["sync"].Usage)
+	}
+	syncShop(config, *shop, client)
+	return nil
+}
+
+// fetchCommand reads the live levels of one store and prints them, eg. to see what a store reports when a
+// merchant questions a count. Nothing is recorded, the baselines are left for the next sync.
+func fetchCommand(args []string, config Config, client *mongo.Client) error {
+	if len(args) == 0 || (args[0] != "shopify" && args[0] != "etsy") {
+		return fmt.Errorf("usage: %s", commands["fetch"].Usage)
+	}
+	fs := flag.NewFlagSet("fetch "+args[0], flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop to fetch")
+	fs.Parse(args[1:])
+	if *shop == "" {
+		return fmt.Errorf("usage: %s", commands["fetch"].Usage)
+	}
+	if args[0] == "shopify" {
+		return printShopifyLevels(*shop, client)
+	}
+	return printEtsyLevels(config, *shop, client)
+}
+
+// printShopifyLevels reads the variants and inventory levels through the bulk queries, without storing them
+func printShopifyLevels(storename string, client *mongo.Client) error {
+	token := getstoretoken(storename, client)
+	inventoryurl, err := getinventorylevels(storename, token)
+	if err != nil {
+		return err
+	}
+	levels, err := readinventorylevels(inventoryurl)
+	if err != nil {
+		return err
+	}
+	productsurl, err := getproductvariants(storename, token)
+	if err != nil {
+		return err
+	}
+	variants, err := readproductvariants(productsurl)
+	if err != nil {
+		return err
+	}
+	available := make(map[string]StockItem)
+	for _, l := range levels {
+		available[l.InventoryID] = l
+	}
+	sort.Slice(variants, func(i, j int) bool { return variants[i].SKU < variants[j].SKU })
+	for _, v := range variants {
+		level, ok := available[v.InventoryID]
+		if !ok {
+			fmt.Printf("%s variant %s (%s): no inventory level at the location\n", v.SKU, v.VariantID, v.VariantName)
+			continue
+		}
+		fmt.Printf("%s variant %s (%s): %d available at %s\n", v.SKU, v.VariantID, v.VariantName, level.Available, level.LocationID)
+	}
+	fmt.Printf("%d variants, %d inventory levels\n", len(variants), len(levels))
+	return nil
+}
+
+// printEtsyLevels reads the listing inventories of the shop's etsy shop, without storing them. The shop
+// must have been synced before so that its etsy shop is known.
+func printEtsyLevels(config Config, storename string, client *mongo.Client) error {
+	shop, err := getShopState(storename, client)
+	if err != nil {
+		return err
+	}
+	if shop.EtsyShopID == 0 {
+		return fmt.Errorf("the etsy shop of %s has not been resolved yet, run a sync first", storename)
+	}
+	tokens := etsyTokens(config, client)
+	if _, err := tokens.Token(storename); err != nil {
+		return err
+	}
+	etoken := tokens.Access(storename)
+	listings, err := getEtsyShopListings(strconv.Itoa(shop.EtsyShopID), config.ETSY_CLIENT_ID, etoken)
+	if err != nil {
+		return err
+	}
+	products := 0
+	for _, l := range listings {
+		inventory, err := getListingInventory(l.ListingID, config.ETSY_CLIENT_ID, etoken)
+		if err != nil {
+			return err
+		}
+		for _, p := range inventory.Products {
+			products++
+			if len(p.Offerings) == 0 {
+				fmt.Printf("%s listing %d product %d: no offerings\n", p.Sku, l.ListingID, p.ProductID)
+				continue
+			}
+			fmt.Printf("%s listing %d product %d: %d\n", p.Sku, l.ListingID, p.ProductID, p.Offerings[0].Quantity)
+		}
+	}
+	fmt.Printf("%d listings, %d products\n", len(listings), products)
+	return nil
+}
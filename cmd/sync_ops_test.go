@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The end to end tests run syncShop against the fake stores and a real mongo, as the worker reads and
+// writes its records through the driver. They are skipped unless ETSYNC_TEST_MONGO_URI is set, which
+// should point at a scratch mongo; every record they write belongs to a shop of their own, which is
+// removed when the test ends.
+
+func testMongoClient(t *testing.T) *mongo.Client {
+	uri := os.Getenv("ETSYNC_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("set ETSYNC_TEST_MONGO_URI to run the end to end sync tests")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client
+}
+
+// newTestShop stores a shop record of its own for the test, with the fields given, and removes every
+// record of the shop when the test ends
+func newTestShop(t *testing.T, client *mongo.Client, fields bson.M) string {
+	storename := fmt.Sprintf("test-%d.myshopify.com", time.Now().UnixNano())
+	record := bson.M{"shopify_domain": storename}
+	for k, v := range fields {
+		record[k] = v
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	db := client.Database("etsync")
+	if _, err := db.Collection("shops").InsertOne(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, c := range []string{"shops", "stock", "connection_stock", "connection_backlog", "pending_plans", "run_changes", "sku_conflicts", "sync_runs"} {
+			db.Collection(c).DeleteMany(context.Background(), bson.M{"shopify_domain": storename})
+		}
+	})
+	return storename
+}
+
+// newE2EShop serves the default fixture under a shop of its own, stores the shop record with its tokens
+// and runs a first sync, which records the baseline the test's changes are seen against
+func newE2EShop(t *testing.T, config Config) (*fakeStores, string, *mongo.Client) {
+	client := testMongoClient(t)
+	storename := newTestShop(t, client, bson.M{
+		"state":              shopStateActive,
+		"onBoarded":          true,
+		"accessToken":        "shpat_test",
+		"etsyOnBoarded":      true,
+		"etsy_access_token":  "12345.access",
+		"etsy_refresh_token": "12345.refresh",
+		"etsy_token_type":    "Bearer",
+		"etsy_token_expires": time.Now().Add(time.Hour),
+	})
+	f := startFakeStores(t, defaultFakeFixture)
+	f.fixture.Shopify[0].Shop = storename
+	syncShop(config, storename, client)
+	return f, storename, client
+}
+
+func e2eConfig() Config {
+	return Config{ETSY_CLIENT_ID: "test", ETSY_TOKEN_REFRESH_MINUTES: 15}
+}
+
+func checkLevels(t *testing.T, f *fakeStores, sku string, shopify, etsy int) {
+	t.Helper()
+	if got := f.level(t, "shopify", sku); got != shopify {
+		t.Errorf("shopify %s is %d, want %d", sku, got, shopify)
+	}
+	if got := f.level(t, "etsy", sku); got != etsy {
+		t.Errorf("etsy %s is %d, want %d", sku, got, etsy)
+	}
+}
+
+func TestSyncShopSales(t *testing.T) {
+	config := e2eConfig()
+	f, storename, client := newE2EShop(t, config)
+	checkLevels(t, f, "MUG-BLUE", 5, 5)
+	checkLevels(t, f, "BOWL", 8, 8)
+
+	f.sell(t, "shopify", "MUG-BLUE", 2)
+	f.sell(t, "etsy", "BOWL", 3)
+	f.sell(t, "shopify", "MUG-RED", 1)
+	f.sell(t, "etsy", "MUG-RED", 1)
+	syncShop(config, storename, client)
+	checkLevels(t, f, "MUG-BLUE", 3, 3)
+	checkLevels(t, f, "BOWL", 5, 5)
+	checkLevels(t, f, "MUG-RED", 1, 1)
+
+	// the levels the run wrote are its new baseline, so a run without sales changes nothing
+	syncShop(config, storename, client)
+	checkLevels(t, f, "MUG-BLUE", 3, 3)
+	checkLevels(t, f, "BOWL", 5, 5)
+	checkLevels(t, f, "MUG-RED", 1, 1)
+}
+
+func TestSyncShopOverride(t *testing.T) {
+	config := e2eConfig()
+	f, storename, client := newE2EShop(t, config)
+	if err := applyOverrideRows(storename, []importRow{{SKU: "MUG-RED", Quantity: 10}}, client); err != nil {
+		t.Fatal(err)
+	}
+	// a sale made before the override is applied is replaced by the level set through the app
+	f.sell(t, "shopify", "MUG-RED", 1)
+	syncShop(config, storename, client)
+	checkLevels(t, f, "MUG-RED", 10, 10)
+	checkLevels(t, f, "MUG-BLUE", 5, 5)
+
+	overrides, err := getOverrides(storename, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overrides) != 0 {
+		t.Errorf("the override was not cleared after it was applied: %v", overrides)
+	}
+	syncShop(config, storename, client)
+	checkLevels(t, f, "MUG-RED", 10, 10)
+}
+
+func TestSyncShopLink(t *testing.T) {
+	config := e2eConfig()
+	f, storename, client := newE2EShop(t, config)
+	if err := applyLinkRows(storename, []importRow{{ProductID: 31, SKU: "PLATE"}}, client); err != nil {
+		t.Fatal(err)
+	}
+	syncShop(config, storename, client)
+	if sku := f.etsyListing(3).Products[0].SKU; sku != "PLATE" {
+		t.Errorf("the etsy product was given sku %q, want PLATE", sku)
+	}
+	checkLevels(t, f, "PLATE", 4, 4)
+}
+
+func TestSyncShopHeldPlan(t *testing.T) {
+	config := e2eConfig()
+	config.GUARD_MAX_SKU_DELTA = 2
+	f, storename, client := newE2EShop(t, config)
+
+	f.sell(t, "etsy", "BOWL", 5)
+	syncShop(config, storename, client)
+	checkLevels(t, f, "BOWL", 8, 3)
+	plans, err := getPendingPlans(storename, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 1 || plans[0].Status != planStatusNeedsApproval {
+		t.Fatalf("expected a plan held for approval, got %+v", plans)
+	}
+
+	// no run takes up further changes while the plan waits
+	f.sell(t, "shopify", "MUG-BLUE", 1)
+	syncShop(config, storename, client)
+	checkLevels(t, f, "MUG-BLUE", 4, 5)
+
+	if err := approvePlan(storename, plans[0].ID.Hex(), config, client); err != nil {
+		t.Fatal(err)
+	}
+	checkLevels(t, f, "BOWL", 3, 3)
+	syncShop(config, storename, client)
+	checkLevels(t, f, "MUG-BLUE", 4, 4)
+	checkLevels(t, f, "BOWL", 3, 3)
+}
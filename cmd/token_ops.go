@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// errEtsyReauthRequired is returned when the shop's refresh token is no longer accepted by etsy
+// and the merchant has to go through the etsy authorisation again
+var errEtsyReauthRequired = errors.New("etsy authorisation has to be renewed for this shop")
+
+const (
+	// how long a worker may hold the refresh lock on a shop before another worker can take it over
+	etsyRefreshLockTTL = time.Minute
+	// how often the background refresh checks the token expiry
+	etsyRefreshInterval = time.Minute
+)
+
+// etsyTokenManager hands out etsy access tokens, refreshing them before they expire.
+// Etsy issues a new refresh token with every refresh so only one refresh may be in flight per shop:
+// refreshes are serialised within the process by a per shop mutex and across workers by a lock
+// held on the shop record.
+type etsyTokenManager struct {
+	config Config
+	client *mongo.Client
+	owner  string
+	mu     sync.Mutex
+	shops  map[string]*sync.Mutex
+	stop   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// etsyAccess hands out the access token to send with an etsy request. It is asked on every request, so
+// a long run picks up the token the background refresh stores rather than the one it started with.
+type etsyAccess func() (string, error)
+
+// fixedEtsyAccess always hands out the same token, for a token that has just been issued
+func fixedEtsyAccess(token string) etsyAccess {
+	return func() (string, error) {
+		return token, nil
+	}
+}
+
+var (
+	tokenManager     *etsyTokenManager
+	tokenManagerOnce sync.Once
+)
+
+// etsyTokens returns the token manager shared by the process
+func etsyTokens(config Config, client *mongo.Client) *etsyTokenManager {
+	tokenManagerOnce.Do(func() {
+		tokenManager = newEtsyTokenManager(config, client)
+	})
+	return tokenManager
+}
+
+func newEtsyTokenManager(config Config, client *mongo.Client) *etsyTokenManager {
+	hostname, _ := os.Hostname()
+	return &etsyTokenManager{
+		config: config,
+		client: client,
+		owner:  fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), primitive.NewObjectID().Hex()),
+		shops:  make(map[string]*sync.Mutex),
+		stop:   make(chan struct{}),
+	}
+}
+
+func (m *etsyTokenManager) shopLock(storename string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.shops[storename]
+	if !ok {
+		l = &sync.Mutex{}
+		m.shops[storename] = l
+	}
+	return l
+}
+
+func (m *etsyTokenManager) refreshWindow() time.Duration {
+	return time.Duration(m.config.ETSY_TOKEN_REFRESH_MINUTES) * time.Minute
+}
+
+func (m *etsyTokenManager) needsRefresh(token etsytoken) bool {
+	return !token.EtsyOnBoarded || time.Now().Add(m.refreshWindow()).After(token.EtsyTokenExpires)
+}
+
+// Token returns the current token for the shop, refreshing it first if it expires within the refresh window
+func (m *etsyTokenManager) Token(storename string) (etsytoken, error) {
+	l := m.shopLock(storename)
+	l.Lock()
+	defer l.Unlock()
+
+	token, err := readEtsyToken(storename, m.client)
+	if err != nil {
+		return etsytoken{}, err
+	}
+	if token.ShopState == shopStateNeedsReauth {
+		return etsytoken{}, errEtsyReauthRequired
+	}
+	if !m.needsRefresh(token) {
+		log.WithFields(log.Fields{
+			"File":   "token_ops",
+			"Caller": "Token",
+		}).Debugf("Etsy token has more than %v ttl, reusing current token", m.refreshWindow())
+		return token, nil
+	}
+	return m.refresh(storename)
+}
+
+// Access returns the etsy access for the shop, which takes the current token from the manager on every request
+func (m *etsyTokenManager) Access(storename string) etsyAccess {
+	return func() (string, error) {
+		token, err := m.Token(storename)
+		if err != nil {
+			return "", err
+		}
+		return token.EtsyAccessToken, nil
+	}
+}
+
+// refresh takes the refresh lock on the shop record and requests a new token. If another worker holds
+// the lock we wait for it to finish and use the token it stored.
+func (m *etsyTokenManager) refresh(storename string) (etsytoken, error) {
+	deadline := time.Now().Add(etsyRefreshLockTTL)
+	for {
+		acquired, err := m.acquireRefreshLock(storename)
+		if err != nil {
+			return etsytoken{}, err
+		}
+		if acquired {
+			break
+		}
+		if time.Now().After(deadline) {
+			return etsytoken{}, fmt.Errorf("timed out waiting for another worker to refresh the etsy token for %s", storename)
+		}
+		log.WithFields(log.Fields{
+			"File":   "token_ops",
+			"Caller": "Refresh",
+		}).Debug("Etsy token refresh in progress on another worker, waiting")
+		time.Sleep(2 * time.Second)
+	}
+	defer m.releaseRefreshLock(storename)
+
+	// the token may have been refreshed by the worker that held the lock before us
+	token, err := readEtsyToken(storename, m.client)
+	if err != nil {
+		return etsytoken{}, err
+	}
+	if token.ShopState == shopStateNeedsReauth {
+		return etsytoken{}, errEtsyReauthRequired
+	}
+	if !m.needsRefresh(token) {
+		return token, nil
+	}
+
+	log.WithFields(log.Fields{
+		"File":   "token_ops",
+		"Caller": "Refresh",
+	}).Info("New Etsy token required, sending request to etsy API")
+	rtoken, err := getEtsyTokenFromAPI(m.config.ETSY_CLIENT_ID, m.config.ETSY_REDIRECT_URI, token)
+	if err != nil {
+		var oautherr *etsyOAuthError
+		if errors.As(err, &oautherr) {
+			if recerr := recordEtsyTokenError(storename, oautherr, m.client); recerr != nil {
+				log.WithFields(log.Fields{
+					"File":   "token_ops",
+					"Caller": "Refresh",
+				}).Errorf("Unable to record etsy token error %v", recerr)
+			}
+			if token.EtsyOnBoarded && oautherr.refreshTokenRejected() {
+				return etsytoken{}, m.markNeedsReauth(storename, oautherr)
+			}
+		}
+		return etsytoken{}, err
+	}
+	rtoken.EtsyOnBoarded = true
+	rtoken.ShopifyDomain = storename // if this is a new token from etsy API then it won't have the shop
+	log.WithFields(log.Fields{
+		"File":   "token_ops",
+		"Caller": "Refresh",
+	}).Infof("Token retrieved from etsy api for %s with expiration %v", rtoken.ShopifyDomain, rtoken.EtsyTokenExpires)
+
+	if token.EtsyOnBoarded {
+		err = writeRefreshedEtsyToken(storename, m.owner, token.EtsyRefreshToken, rtoken, m.client)
+	} else {
+		err = writeEtsyToken(storename, rtoken, m.client)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "token_ops",
+			"Caller": "Refresh",
+		}).Errorf("Unable to store the etsy token in database! %v", err)
+		return etsytoken{}, err
+	}
+	return rtoken, nil
+}
+
+func (m *etsyTokenManager) markNeedsReauth(storename string, cause error) error {
+	if err := setShopState(storename, shopStateNeedsReauth, cause.Error(), m.client); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "token_ops",
+			"Caller": "MarkNeedsReauth",
+		}).Errorf("Unable to flag shop for etsy re-authorisation %v", err)
+		return err
+	}
+	raiseAlert(m.config, storename, "etsy_reauth_required", "Etsy refresh token was rejected, the shop has to authorise etsync again", []string{cause.Error()})
+	return errEtsyReauthRequired
+}
+
+// acquireRefreshLock sets this worker as the owner of the refresh lock on the shop record, provided
+// no other worker holds an unexpired lock
+func (m *etsyTokenManager) acquireRefreshLock(storename string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := m.client.Database("etsync").Collection("shops")
+	now := time.Now()
+	filter := bson.M{
+		"shopify_domain": storename,
+		"$or": bson.A{
+			bson.M{"etsy_refresh_lock_until": bson.M{"$exists": false}},
+			bson.M{"etsy_refresh_lock_until": bson.M{"$lt": now}},
+			bson.M{"etsy_refresh_lock_owner": m.owner},
+		},
+	}
+	update := bson.M{"$set": bson.M{
+		"etsy_refresh_lock_owner": m.owner,
+		"etsy_refresh_lock_until": now.Add(etsyRefreshLockTTL),
+	}}
+	result, err := shopCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "token_ops",
+			"Caller": "AcquireRefreshLock",
+		}).Errorf("Unable to take etsy refresh lock %v", err)
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (m *etsyTokenManager) releaseRefreshLock(storename string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := m.client.Database("etsync").Collection("shops")
+	filter := bson.M{"shopify_domain": storename, "etsy_refresh_lock_owner": m.owner}
+	update := bson.M{"$unset": bson.M{"etsy_refresh_lock_owner": "", "etsy_refresh_lock_until": ""}}
+	if _, err := shopCollection.UpdateOne(ctx, filter, update); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "token_ops",
+			"Caller": "ReleaseRefreshLock",
+		}).Warnf("Unable to release etsy refresh lock %v", err)
+	}
+}
+
+// Start refreshes the shop's token in the background for as long as the process runs, so that
+// the token never gets within the refresh window while the worker is busy
+func (m *etsyTokenManager) Start(storename string) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(etsyRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				if _, err := m.Token(storename); err != nil {
+					log.WithFields(log.Fields{
+						"File":   "token_ops",
+						"Caller": "Start",
+					}).Warnf("Background etsy token refresh failed %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the background refreshes, it may be called more than once
+func (m *etsyTokenManager) Stop() {
+	m.once.Do(func() {
+		close(m.stop)
+	})
+	m.wg.Wait()
+}
+
+// writeRefreshedEtsyToken stores a refreshed token. Etsy has already retired the refresh token it replaces,
+// so the new token is always kept while this worker holds the refresh lock. Should the lock have expired
+// underneath us it is kept as long as the stored refresh token, compared decrypted, is still the one it
+// replaces; otherwise another worker has rotated the token since and its token is kept.
+func writeRefreshedEtsyToken(storename, owner, oldrefreshtoken string, token etsytoken, client *mongo.Client) error {
+	accesstoken, err := encryptToken(storename, "etsy_access_token", token.EtsyAccessToken)
+	if err != nil {
+		return err
+	}
+	refreshtoken, err := encryptToken(storename, "etsy_refresh_token", token.EtsyRefreshToken)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	update := bson.M{
+		"$set": bson.M{
+			"etsyOnBoarded":      token.EtsyOnBoarded,
+			"etsy_access_token":  accesstoken,
+			"etsy_refresh_token": refreshtoken,
+			"etsy_token_expires": token.EtsyTokenExpires,
+		},
+		"$unset": bson.M{
+			"etsy_code_error":        "",
+			"etsy_error_description": "",
+			"etsy_error_uri":         "",
+		},
+	}
+	result, err := shopCollection.UpdateOne(ctx, bson.M{"shopify_domain": storename, "etsy_refresh_lock_owner": owner}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 1 {
+		return nil
+	}
+	stored, err := readEtsyToken(storename, client)
+	if err != nil {
+		return err
+	}
+	if stored.EtsyRefreshToken != oldrefreshtoken {
+		log.WithFields(log.Fields{
+			"File":   "token_ops",
+			"Caller": "WriteRefreshedEtsyToken",
+		}).Warn("Etsy refresh token was rotated by another worker, keeping the stored token")
+		return nil
+	}
+	// the ciphertext just read guards against a rotation between the read and the write
+	result, err = shopCollection.UpdateOne(ctx, bson.M{"shopify_domain": storename, "etsy_refresh_token": stored.storedRefreshToken}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		log.WithFields(log.Fields{
+			"File":   "token_ops",
+			"Caller": "WriteRefreshedEtsyToken",
+		}).Warn("Etsy refresh token was rotated by another worker, keeping the stored token")
+	}
+	return nil
+}
+
+// recordEtsyTokenError stores the error returned by etsy against the shop so the app can show it
+func recordEtsyTokenError(storename string, oautherr *etsyOAuthError, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	update := bson.M{"$set": bson.M{
+		"etsy_code_error":        oautherr.Code,
+		"etsy_error_description": oautherr.Description,
+		"etsy_error_uri":         oautherr.URI,
+	}}
+	_, err := shopCollection.UpdateOne(ctx, bson.M{"shopify_domain": storename}, update)
+	return err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestEtsyTokenManagerStopTwice(t *testing.T) {
+	m := newEtsyTokenManager(e2eConfig(), nil)
+	m.Stop()
+	// a second stop, as from a deferred stop after an earlier one, must not close the channel again
+	m.Stop()
+}
+
+func TestEtsyAccessFollowsStoredToken(t *testing.T) {
+	client := testMongoClient(t)
+	storename := newTestShop(t, client, bson.M{
+		"state":              shopStateActive,
+		"etsyOnBoarded":      true,
+		"etsy_access_token":  "12345.access",
+		"etsy_refresh_token": "12345.refresh",
+		"etsy_token_type":    "Bearer",
+		"etsy_token_expires": time.Now().Add(time.Hour),
+	})
+	access := newEtsyTokenManager(e2eConfig(), client).Access(storename)
+	if token, err := access(); err != nil || token != "12345.access" {
+		t.Fatalf("access gave %q, %v, want the stored token", token, err)
+	}
+
+	// the token a background refresh stores is used by the next request
+	refreshed := etsytoken{
+		ShopifyDomain:    storename,
+		EtsyOnBoarded:    true,
+		EtsyAccessToken:  "12345.refreshed",
+		EtsyRefreshToken: "12345.refresh2",
+		EtsyTokenExpires: time.Now().Add(time.Hour),
+	}
+	if err := writeEtsyToken(storename, refreshed, client); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := access(); err != nil || token != "12345.refreshed" {
+		t.Errorf("access gave %q, %v, want the refreshed token", token, err)
+	}
+}
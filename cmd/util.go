@@ -5,12 +5,35 @@ import (
 )
 
 type Config struct {
-	MONGO_URI         string `mapstructure:"MONGO_URI"`
-	ATLAS_MONGO_URI   string `mapstructure:"ATLAS_MONGO_URI"`
-	ETSY_CLIENT_ID    string `mapstructure:"ETSY_CLIENT_ID"`
-	ETSY_REDIRECT_URI string `mapstructure:"ETSY_REDIRECT_URI"`
-	APP_ENV           string `mapstructure:"APP_ENV"`
-	SHOP_NAME         string `mapstructure:"SHOP_NAME"`
+	MONGO_URI                      string  `mapstructure:"MONGO_URI"`
+	ATLAS_MONGO_URI                string  `mapstructure:"ATLAS_MONGO_URI"`
+	ETSY_CLIENT_ID                 string  `mapstructure:"ETSY_CLIENT_ID"`
+	ETSY_REDIRECT_URI              string  `mapstructure:"ETSY_REDIRECT_URI"`
+	ETSY_API_URL                   string  `mapstructure:"ETSY_API_URL"`
+	ETSY_OAUTH_URL                 string  `mapstructure:"ETSY_OAUTH_URL"`
+	SHOPIFY_API_URL                string  `mapstructure:"SHOPIFY_API_URL"`
+	EBAY_API_URL                   string  `mapstructure:"EBAY_API_URL"`
+	HTTP_TIMEOUT_SECONDS           int     `mapstructure:"HTTP_TIMEOUT_SECONDS"`
+	BULK_DOWNLOAD_TIMEOUT_MINUTES  int     `mapstructure:"BULK_DOWNLOAD_TIMEOUT_MINUTES"`
+	HTTP_RECORD_DIR                string  `mapstructure:"HTTP_RECORD_DIR"`
+	HTTP_REPLAY_DIR                string  `mapstructure:"HTTP_REPLAY_DIR"`
+	PRICE_RATES                    string  `mapstructure:"PRICE_RATES"`
+	EBAY_CLIENT_ID                 string  `mapstructure:"EBAY_CLIENT_ID"`
+	EBAY_CLIENT_SECRET             string  `mapstructure:"EBAY_CLIENT_SECRET"`
+	EBAY_TOKEN_REFRESH_MINUTES     int     `mapstructure:"EBAY_TOKEN_REFRESH_MINUTES"`
+	APP_ENV                        string  `mapstructure:"APP_ENV"`
+	SHOP_NAME                      string  `mapstructure:"SHOP_NAME"`
+	ALERT_WEBHOOK_URL              string  `mapstructure:"ALERT_WEBHOOK_URL"`
+	GUARD_MAX_CHANGED_PERCENT      float64 `mapstructure:"GUARD_MAX_CHANGED_PERCENT"`
+	GUARD_MIN_ITEMS                int     `mapstructure:"GUARD_MIN_ITEMS"`
+	GUARD_MAX_SKU_DELTA            int     `mapstructure:"GUARD_MAX_SKU_DELTA"`
+	GUARD_BLOCK_ALL_ZERO           bool    `mapstructure:"GUARD_BLOCK_ALL_ZERO"`
+	GUARD_MAX_PRICE_CHANGE_PERCENT float64 `mapstructure:"GUARD_MAX_PRICE_CHANGE_PERCENT"`
+	PLAN_APPROVAL_MIN_CHANGES      int     `mapstructure:"PLAN_APPROVAL_MIN_CHANGES"`
+	ETSY_TOKEN_REFRESH_MINUTES     int     `mapstructure:"ETSY_TOKEN_REFRESH_MINUTES"`
+	TOKEN_ENCRYPTION_KEYS          string  `mapstructure:"TOKEN_ENCRYPTION_KEYS"`
+	TOKEN_ENCRYPTION_KEY_FILE      string  `mapstructure:"TOKEN_ENCRYPTION_KEY_FILE"`
+	TOKEN_ENCRYPTION_ACTIVE_KEY    string  `mapstructure:"TOKEN_ENCRYPTION_ACTIVE_KEY"`
 }
 
 func LoadConfig(path string) (config Config, err error) {
@@ -18,6 +41,41 @@ func LoadConfig(path string) (config Config, err error) {
 	viper.SetConfigName("app")
 	viper.SetConfigType("env")
 
+	// guardrails that hold a run for approval, a limit of 0 disables the check
+	viper.SetDefault("ALERT_WEBHOOK_URL", "")
+	viper.SetDefault("GUARD_MAX_CHANGED_PERCENT", 50)
+	viper.SetDefault("GUARD_MIN_ITEMS", 10)
+	viper.SetDefault("GUARD_MAX_SKU_DELTA", 100)
+	viper.SetDefault("GUARD_BLOCK_ALL_ZERO", true)
+	viper.SetDefault("GUARD_MAX_PRICE_CHANGE_PERCENT", 50)
+	// plans with at least this many stock changes are parked for approval, 0 applies every plan
+	viper.SetDefault("PLAN_APPROVAL_MIN_CHANGES", 0)
+	// etsy tokens are refreshed once they have less than this many minutes left
+	viper.SetDefault("ETSY_TOKEN_REFRESH_MINUTES", 15)
+	// keys used to encrypt the shop tokens at rest, tokens are stored in plain text when no key is set
+	viper.SetDefault("TOKEN_ENCRYPTION_KEYS", "")
+	viper.SetDefault("TOKEN_ENCRYPTION_KEY_FILE", "")
+	viper.SetDefault("TOKEN_ENCRYPTION_ACTIVE_KEY", "")
+	// the ebay app used by ebay connections
+	viper.SetDefault("EBAY_CLIENT_ID", "")
+	viper.SetDefault("EBAY_CLIENT_SECRET", "")
+	// ebay access tokens are refreshed once they have less than this many minutes left
+	viper.SetDefault("EBAY_TOKEN_REFRESH_MINUTES", 15)
+	// base urls of the store apis, empty uses the live apis, {shop} in the shopify url is replaced by the
+	// shop's domain, eg. http://localhost:8080/{shop}
+	viper.SetDefault("ETSY_API_URL", "")
+	viper.SetDefault("ETSY_OAUTH_URL", "")
+	viper.SetDefault("SHOPIFY_API_URL", "")
+	viper.SetDefault("EBAY_API_URL", "")
+	viper.SetDefault("HTTP_TIMEOUT_SECONDS", 60)
+	// the timeout of the download of a shopify bulk query result, which can run to hundreds of megabytes
+	viper.SetDefault("BULK_DOWNLOAD_TIMEOUT_MINUTES", 30)
+	// record the api calls of a run to a cassette directory, or replay them from one
+	viper.SetDefault("HTTP_RECORD_DIR", "")
+	viper.SetDefault("HTTP_REPLAY_DIR", "")
+	// the currency rates the price sync converts with, eg. EUR:USD=1.08,EUR:GBP=0.86
+	viper.SetDefault("PRICE_RATES", "")
+
 	viper.AutomaticEnv()
 
 	err = viper.ReadInConfig()
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const channelWooCommerce = "woocommerce"
+
+// the largest page and batch sizes the woocommerce REST api accepts
+const wooPageSize = 100
+const wooBatchSize = 100
+
+type wooProduct struct {
+	ID            int64          `json:"id"`
+	ParentID      int64          `json:"parent_id"`
+	Name          string         `json:"name"`
+	Type          string         `json:"type"`
+	SKU           string         `json:"sku"`
+	ManageStock   wooManageStock `json:"manage_stock"`
+	StockQuantity *int           `json:"stock_quantity"`
+	Variations    []int64        `json:"variations"`
+}
+
+// wooManageStock is the manage_stock field, a bool on products and true, false or "parent" on the
+// variations whose stock is kept on their parent product
+type wooManageStock int
+
+const (
+	wooStockUnmanaged wooManageStock = iota
+	wooStockManaged
+	wooStockParent
+)
+
+func (m *wooManageStock) UnmarshalJSON(b []byte) error {
+	var managed bool
+	if err := json.Unmarshal(b, &managed); err == nil {
+		*m = wooStockUnmanaged
+		if managed {
+			*m = wooStockManaged
+		}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil || s != "parent" {
+		return fmt.Errorf("unexpected woocommerce manage_stock %s", b)
+	}
+	*m = wooStockParent
+	return nil
+}
+
+func (m wooManageStock) MarshalJSON() ([]byte, error) {
+	if m == wooStockParent {
+		return []byte(`"parent"`), nil
+	}
+	return json.Marshal(m == wooStockManaged)
+}
+
+type wooStockUpdate struct {
+	ID            int64 `json:"id"`
+	StockQuantity int   `json:"stock_quantity"`
+}
+
+type wooBatchRequest struct {
+	Update []wooStockUpdate `json:"update"`
+}
+
+type wooBatchResponse struct {
+	Update []struct {
+		ID    int64 `json:"id"`
+		Error *struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error,omitempty"`
+	} `json:"update"`
+}
+
+// wooCommerceConnection is the channel adapter for a woocommerce store, the account is the url of the
+// site and the REST api keys are kept on the token_from shop record
+type wooCommerceConnection struct {
+	conn   ChannelConnection
+	site   string
+	key    string
+	secret string
+}
+
+func newWooCommerceConnection(conn ChannelConnection, client *mongo.Client) (*wooCommerceConnection, error) {
+	if conn.Account == "" {
+		return nil, fmt.Errorf("woocommerce connection %s has no account", conn.ID)
+	}
+	tokenfrom := conn.TokenFrom
+	if tokenfrom == "" {
+		tokenfrom = conn.Account
+	}
+	key, secret, err := getWooKeys(tokenfrom, client)
+	if err != nil {
+		return nil, err
+	}
+	return &wooCommerceConnection{
+		conn:   conn,
+		site:   strings.TrimSuffix(conn.Account, "/"),
+		key:    key,
+		secret: secret,
+	}, nil
+}
+
+// getWooKeys reads the woocommerce consumer key and secret stored on a shop record
+func getWooKeys(storename string, client *mongo.Client) (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var shop struct {
+		Key    string `bson:"woo_consumer_key"`
+		Secret string `bson:"woo_consumer_secret"`
+	}
+	shopCollection := client.Database("etsync").Collection("shops")
+	if err := shopCollection.FindOne(ctx, bson.M{"shopify_domain": storename}).Decode(&shop); err != nil {
+		log.WithFields(log.Fields{
+			"File":   "woo_ops",
+			"Caller": "GetWooKeys",
+		}).Warnf("Unable to read shop record %v", err)
+		return "", "", err
+	}
+	if shop.Key == "" || shop.Secret == "" {
+		return "", "", fmt.Errorf("no woocommerce keys stored for %s", storename)
+	}
+	secret, err := decryptToken(storename, "woo_consumer_secret", shop.Secret)
+	if err != nil {
+		return "", "", err
+	}
+	return shop.Key, secret, nil
+}
+
+// writeWooKeys stores the woocommerce api keys on a shop record, creating it if needed
+func writeWooKeys(storename, key, secret string, client *mongo.Client) error {
+	encsecret, err := encryptToken(storename, "woo_consumer_secret", secret)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	shopCollection := client.Database("etsync").Collection("shops")
+	update := bson.M{"$set": bson.M{
+		"woo_consumer_key":    key,
+		"woo_consumer_secret": encsecret,
+	}}
+	_, err = shopCollection.UpdateOne(ctx, bson.M{"shopify_domain": storename}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func wooKeysCommand(args []string, config Config, client *mongo.Client) error {
+	fs := flag.NewFlagSet("woo-keys", flag.ExitOnError)
+	shop := fs.String("shop", *shopname, "the shop record to store the keys on, eg. the url of the woocommerce site")
+	key := fs.String("key", "", "the woocommerce consumer key (ck_...)")
+	secret := fs.String("secret", "", "the woocommerce consumer secret (cs_...)")
+	fs.Parse(args)
+	if *shop == "" || *key == "" || *secret == "" {
+		return fmt.Errorf("usage: %s", commands["woo-keys"].Usage)
+	}
+	return writeWooKeys(*shop, *key, *secret, client)
+}
+
+// wooRequest sends a request to the woocommerce REST api, authenticating with the consumer key and secret
+func (w *wooCommerceConnection) wooRequest(method, path string, body interface{}) (*http.Response, []byte, error) {
+	var payload *strings.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload = strings.NewReader(string(b))
+	} else {
+		payload = strings.NewReader("")
+	}
+	httpclient := apiHTTP
+	req, err := http.NewRequest(method, w.site+"/wp-json/wc/v3/"+path, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.SetBasicAuth(w.key, w.secret)
+	req.Header.Add("Content-Type", "application/json")
+	res, err := httpclient.Do(req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"File":   "woo_ops",
+			"Caller": "WooRequest",
+			"Action": "http request",
+		}).Error(err)
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	resbody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res, nil, err
+	}
+	if res.StatusCode != 200 && res.StatusCode != 201 {
+		log.WithFields(log.Fields{
+			"File":   "woo_ops",
+			"Caller": "WooRequest",
+			"Action": "http response",
+		}).Errorf("%s %s got response %d: %s", method, path, res.StatusCode, string(resbody))
+		return res, resbody, fmt.Errorf("woocommerce %s %s failed with status %d", method, path, res.StatusCode)
+	}
+	return res, resbody, nil
+}
+
+// getWooProducts reads every page of products (or variations) at the path
+func (w *wooCommerceConnection) getWooProducts(path string) ([]wooProduct, error) {
+	var products []wooProduct
+	for page := 1; ; page++ {
+		res, body, err := w.wooRequest("GET", fmt.Sprintf("%s?per_page=%d&page=%d", path, wooPageSize, page), nil)
+		if err != nil {
+			return nil, err
+		}
+		var results []wooProduct
+		if err := json.Unmarshal(body, &results); err != nil {
+			return nil, fmt.Errorf("unable to read woocommerce %s: %v", path, err)
+		}
+		products = append(products, results...)
+		pages, _ := strconv.Atoi(res.Header.Get("X-WP-TotalPages"))
+		if len(results) < wooPageSize || page >= pages {
+			return products, nil
+		}
+	}
+}
+
+// fetch reads the simple products and the variations of variable products, skipping anything whose
+// stock is not managed by woocommerce. Variations whose stock is managed on the parent product all draw
+// on the parent's stock, so the parent is read as a single item in their place.
+func (w *wooCommerceConnection) fetch() ([]ConnectionStockItem, error) {
+	var items []ConnectionStockItem
+	products, err := w.getWooProducts("products")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range products {
+		if p.Type == "variable" {
+			variations, err := w.getWooProducts(fmt.Sprintf("products/%d/variations", p.ID))
+			if err != nil {
+				return nil, err
+			}
+			parentstock := false
+			for _, v := range variations {
+				if v.ManageStock == wooStockParent {
+					parentstock = true
+					continue
+				}
+				if v.ManageStock != wooStockManaged || v.StockQuantity == nil {
+					continue
+				}
+				items = append(items, ConnectionStockItem{
+					ItemKey:  fmt.Sprintf("%d/%d", p.ID, v.ID),
+					SKU:      v.SKU,
+					ItemID:   strconv.FormatInt(v.ID, 10),
+					ParentID: strconv.FormatInt(p.ID, 10),
+					Title:    p.Name,
+					Current:  *v.StockQuantity,
+				})
+			}
+			if !parentstock {
+				continue
+			}
+		}
+		if p.ManageStock != wooStockManaged || p.StockQuantity == nil {
+			continue
+		}
+		items = append(items, ConnectionStockItem{
+			ItemKey: strconv.FormatInt(p.ID, 10),
+			SKU:     p.SKU,
+			ItemID:  strconv.FormatInt(p.ID, 10),
+			Title:   p.Name,
+			Current: *p.StockQuantity,
+		})
+	}
+	return items, nil
+}
+
+// planWrites groups simple products into products/batch requests and variations into a
+// variations/batch request per parent product, at most wooBatchSize items each
+func (w *wooCommerceConnection) planWrites(levels []ConnectionLevel) ([]ConnectionWrite, error) {
+	var writes []ConnectionWrite
+	var order []string
+	byparent := make(map[string][]ConnectionLevel)
+	for _, l := range levels {
+		if _, ok := byparent[l.ParentID]; !ok {
+			order = append(order, l.ParentID)
+		}
+		byparent[l.ParentID] = append(byparent[l.ParentID], l)
+	}
+	for _, parent := range order {
+		path := "products/batch"
+		if parent != "" {
+			path = fmt.Sprintf("products/%s/variations/batch", parent)
+		}
+		grouped := byparent[parent]
+		for start := 0; start < len(grouped); start += wooBatchSize {
+			end := start + wooBatchSize
+			if end > len(grouped) {
+				end = len(grouped)
+			}
+			var batch wooBatchRequest
+			for _, l := range grouped[start:end] {
+				id, err := strconv.ParseInt(l.ItemID, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid woocommerce id %s: %v", l.ItemID, err)
+				}
+				batch.Update = append(batch.Update, wooStockUpdate{ID: id, StockQuantity: l.Quantity})
+			}
+			payload, err := json.Marshal(batch)
+			if err != nil {
+				return nil, err
+			}
+			writes = append(writes, ConnectionWrite{Target: path, Payload: string(payload), Levels: grouped[start:end]})
+		}
+	}
+	return writes, nil
+}
+
+// applyWrite sends a batch update, woocommerce reports errors per item within a successful response so
+// the items it updated are returned along with an error for the rest
+func (w *wooCommerceConnection) applyWrite(write ConnectionWrite) ([]ConnectionLevel, error) {
+	_, body, err := w.wooRequest("POST", write.Target, json.RawMessage(write.Payload))
+	if err != nil {
+		return nil, err
+	}
+	var result wooBatchResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("unable to read woocommerce batch response: %v", err)
+	}
+	updated := make(map[string]bool)
+	var failed []string
+	for _, u := range result.Update {
+		if u.Error != nil {
+			failed = append(failed, fmt.Sprintf("%d: %s", u.ID, u.Error.Message))
+			continue
+		}
+		updated[strconv.FormatInt(u.ID, 10)] = true
+	}
+	var accepted []ConnectionLevel
+	for _, l := range write.Levels {
+		if updated[l.ItemID] {
+			accepted = append(accepted, l)
+		}
+	}
+	if len(accepted) < len(write.Levels) {
+		if len(failed) == 0 {
+			failed = append(failed, "no result returned")
+		}
+		return accepted, fmt.Errorf("woocommerce rejected %d stock updates: %s", len(write.Levels)-len(accepted), strings.Join(failed, "; "))
+	}
+	return accepted, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeWooStore serves the products, variations and batch endpoints of the woocommerce REST api. Batch
+// updates of the ids in reject are answered with a per item error, as woocommerce does.
+type fakeWooStore struct {
+	products   []wooProduct
+	variations map[int64][]wooProduct
+	reject     map[int64]bool
+	batches    []wooBatchRequest
+}
+
+func (f *fakeWooStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if key, secret, ok := r.BasicAuth(); !ok || key != "ck_test" || secret != "cs_test" {
+		http.Error(w, `{"code":"woocommerce_rest_cannot_view"}`, http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/wp-json/wc/v3/")
+	switch {
+	case r.Method == "GET" && path == "products":
+		f.page(w, r, f.products)
+	case r.Method == "GET" && strings.HasSuffix(path, "/variations"):
+		var parent int64
+		fmt.Sscanf(path, "products/%d/variations", &parent)
+		f.page(w, r, f.variations[parent])
+	case r.Method == "POST" && strings.HasSuffix(path, "batch"):
+		var batch wooBatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.batches = append(f.batches, batch)
+		var results []map[string]interface{}
+		for _, u := range batch.Update {
+			if f.reject[u.ID] {
+				results = append(results, map[string]interface{}{
+					"id":    u.ID,
+					"error": map[string]string{"code": "woocommerce_rest_invalid_id", "message": "Invalid ID."},
+				})
+				continue
+			}
+			results = append(results, map[string]interface{}{"id": u.ID, "stock_quantity": u.StockQuantity})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"update": results})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeWooStore) page(w http.ResponseWriter, r *http.Request, products []wooProduct) {
+	var perpage, page int
+	fmt.Sscanf(r.URL.Query().Get("per_page"), "%d", &perpage)
+	fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+	start := (page - 1) * perpage
+	if start > len(products) {
+		start = len(products)
+	}
+	end := start + perpage
+	if end > len(products) {
+		end = len(products)
+	}
+	w.Header().Set("X-WP-TotalPages", fmt.Sprint((len(products)+perpage-1)/perpage))
+	json.NewEncoder(w).Encode(products[start:end])
+}
+
+func newTestWooConnection(t *testing.T, store *fakeWooStore) *wooCommerceConnection {
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+	return &wooCommerceConnection{
+		conn:   ChannelConnection{ID: "woo", Channel: channelWooCommerce, Account: server.URL},
+		site:   server.URL,
+		key:    "ck_test",
+		secret: "cs_test",
+	}
+}
+
+func wooStock(n int) *int {
+	return &n
+}
+
+func TestWooFetch(t *testing.T) {
+	store := &fakeWooStore{
+		products: []wooProduct{
+			{ID: 1, Name: "Mug", Type: "simple", SKU: "MUG", ManageStock: wooStockManaged, StockQuantity: wooStock(4)},
+			{ID: 2, Name: "Bowl", Type: "simple", SKU: "BOWL"},
+			{ID: 3, Name: "Shirt", Type: "variable", Variations: []int64{31, 32}},
+			{ID: 4, Name: "Scarf", Type: "variable", SKU: "SCARF", ManageStock: wooStockManaged, StockQuantity: wooStock(6), Variations: []int64{41, 42}},
+		},
+		variations: map[int64][]wooProduct{
+			3: {
+				{ID: 31, ParentID: 3, SKU: "SHIRT-S", ManageStock: wooStockManaged, StockQuantity: wooStock(2)},
+				{ID: 32, ParentID: 3, SKU: "SHIRT-M", ManageStock: wooStockManaged, StockQuantity: wooStock(0)},
+			},
+			// woocommerce reports the parent's stock on variations whose stock it manages on the parent
+			4: {
+				{ID: 41, ParentID: 4, SKU: "SCARF-RED", ManageStock: wooStockParent, StockQuantity: wooStock(6)},
+				{ID: 42, ParentID: 4, SKU: "SCARF-BLUE", ManageStock: wooStockParent, StockQuantity: wooStock(6)},
+			},
+		},
+	}
+	for i := 0; i < wooPageSize; i++ {
+		store.products = append(store.products, wooProduct{ID: int64(100 + i), Type: "simple", SKU: fmt.Sprintf("BULK-%d", i), ManageStock: wooStockManaged, StockQuantity: wooStock(i)})
+	}
+	items, err := newTestWooConnection(t, store).fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bykey := make(map[string]ConnectionStockItem)
+	for _, item := range items {
+		bykey[item.ItemKey] = item
+	}
+	if len(items) != 4+wooPageSize {
+		t.Fatalf("got %d items, want %d", len(items), 4+wooPageSize)
+	}
+	if _, ok := bykey["2"]; ok {
+		t.Errorf("the bowl does not have its stock managed by woocommerce and should be skipped")
+	}
+	if mug := bykey["1"]; mug.SKU != "MUG" || mug.Current != 4 || mug.ParentID != "" {
+		t.Errorf("unexpected mug %+v", mug)
+	}
+	if shirt := bykey["3/31"]; shirt.SKU != "SHIRT-S" || shirt.Current != 2 || shirt.ItemID != "31" || shirt.ParentID != "3" {
+		t.Errorf("unexpected shirt variation %+v", shirt)
+	}
+	if scarf := bykey["4"]; scarf.SKU != "SCARF" || scarf.Current != 6 || scarf.ItemID != "4" || scarf.ParentID != "" {
+		t.Errorf("the scarf variations draw on the stock of the scarf, got %+v", scarf)
+	}
+	if _, ok := bykey["4/41"]; ok {
+		t.Errorf("a variation whose stock is managed on its parent should be skipped")
+	}
+	if last := bykey[fmt.Sprint(100+wooPageSize-1)]; last.Current != wooPageSize-1 {
+		t.Errorf("the second page of products was not read, got %+v", last)
+	}
+}
+
+func TestWooPlanWrites(t *testing.T) {
+	var levels []ConnectionLevel
+	for i := 0; i < wooBatchSize+1; i++ {
+		levels = append(levels, ConnectionLevel{PlannedLevel: PlannedLevel{SKU: fmt.Sprintf("S%d", i), Quantity: i}, ItemID: fmt.Sprint(i + 1)})
+	}
+	levels = append(levels, ConnectionLevel{PlannedLevel: PlannedLevel{SKU: "SHIRT-S", Quantity: 5}, ItemID: "31", ParentID: "3"})
+	writes, err := (&wooCommerceConnection{}).planWrites(levels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != 3 {
+		t.Fatalf("got %d writes, want 3", len(writes))
+	}
+	if writes[0].Target != "products/batch" || len(writes[0].Levels) != wooBatchSize || len(writes[1].Levels) != 1 {
+		t.Errorf("products were not split into batches of %d: %s %d, %s %d", wooBatchSize, writes[0].Target, len(writes[0].Levels), writes[1].Target, len(writes[1].Levels))
+	}
+	if writes[2].Target != "products/3/variations/batch" || writes[2].Payload != `{"update":[{"id":31,"stock_quantity":5}]}` {
+		t.Errorf("unexpected variation write %s %s", writes[2].Target, writes[2].Payload)
+	}
+}
+
+func TestWooApplyWrite(t *testing.T) {
+	levels := []ConnectionLevel{
+		{PlannedLevel: PlannedLevel{SKU: "MUG", Previous: 4, Quantity: 3}, ItemKey: "1", ItemID: "1"},
+		{PlannedLevel: PlannedLevel{SKU: "PLATE", Previous: 2, Quantity: 1}, ItemKey: "7", ItemID: "7"},
+		{PlannedLevel: PlannedLevel{SKU: "CUP", Previous: 9, Quantity: 8}, ItemKey: "8", ItemID: "8"},
+	}
+	for _, tc := range []struct {
+		name     string
+		reject   map[int64]bool
+		accepted []string
+		fails    bool
+	}{
+		{name: "all accepted", accepted: []string{"MUG", "PLATE", "CUP"}},
+		{name: "one rejected", reject: map[int64]bool{7: true}, accepted: []string{"MUG", "CUP"}, fails: true},
+		{name: "all rejected", reject: map[int64]bool{1: true, 7: true, 8: true}, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeWooStore{reject: tc.reject}
+			w := newTestWooConnection(t, store)
+			writes, err := w.planWrites(levels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			accepted, err := w.applyWrite(writes[0])
+			if (err != nil) != tc.fails {
+				t.Errorf("got error %v, want an error %v", err, tc.fails)
+			}
+			var skus []string
+			for _, l := range accepted {
+				skus = append(skus, l.SKU)
+			}
+			if strings.Join(skus, ",") != strings.Join(tc.accepted, ",") {
+				t.Errorf("accepted %v, want %v", skus, tc.accepted)
+			}
+			if len(store.batches) != 1 || len(store.batches[0].Update) != len(levels) {
+				t.Errorf("expected a single batch of %d updates, got %+v", len(levels), store.batches)
+			}
+		})
+	}
+}
+
+func TestWooApplyWriteRequestFailure(t *testing.T) {
+	w := newTestWooConnection(t, &fakeWooStore{})
+	w.secret = "wrong"
+	accepted, err := w.applyWrite(ConnectionWrite{Target: "products/batch", Payload: `{"update":[{"id":1,"stock_quantity":3}]}`, Levels: []ConnectionLevel{{ItemID: "1"}}})
+	if err == nil || len(accepted) != 0 {
+		t.Errorf("a rejected request should accept nothing, got %v %v", accepted, err)
+	}
+}